@@ -0,0 +1,191 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"os"
+
+	"github.com/ansel1/merry"
+	"github.com/mikesimons/kpatch/pkg/kpatch"
+
+	"github.com/spf13/cobra"
+)
+
+func queryCommand() *cobra.Command {
+	var opts kpatch.Options
+
+	cmd := &cobra.Command{
+		Use:   "query <expression> [files...]",
+		Short: "Write the result of an expression for each selected document",
+		Args:  cobra.MinimumNArgs(1),
+		Run: func(cmd *cobra.Command, args []string) {
+			opts.Query = args[0]
+			err := kpatch.Run(args[1:], opts, os.Stdout)
+			if err != nil {
+				log.Fatalln(err)
+			}
+		},
+	}
+
+	inputFlags(cmd, &opts)
+	transformFlags(cmd, &opts)
+	schemaFlags(cmd, &opts)
+	return cmd
+}
+
+// diffCommand exits 1 when the files differ and 2 on errors like diff(1)
+func diffCommand() *cobra.Command {
+	var opts kpatch.Options
+	var format string
+
+	cmd := &cobra.Command{
+		Use:   "diff <old> <new>",
+		Short: "Compare two sets of manifests by resource",
+		Args:  cobra.ExactArgs(2),
+		Run: func(cmd *cobra.Command, args []string) {
+			changed, err := kpatch.Diff(args[0], args[1], opts, format, os.Stdout)
+			if err != nil {
+				log.Println(err)
+				os.Exit(2)
+			}
+			if changed {
+				os.Exit(1)
+			}
+		},
+	}
+
+	inputFlags(cmd, &opts)
+	transformFlags(cmd, &opts)
+	schemaFlags(cmd, &opts)
+	cmd.Flags().StringVar(&format, "format", "text", "Diff format: text or json")
+	return cmd
+}
+
+func checkCommand() *cobra.Command {
+	var opts kpatch.Options
+
+	cmd := &cobra.Command{
+		Use:   "check [files...]",
+		Short: "Apply to files without writing them, failing on assertions, validation and other errors",
+		Run: func(cmd *cobra.Command, args []string) {
+			if err := kpatch.Check(args, opts); err != nil {
+				log.Fatalln(err)
+			}
+		},
+	}
+
+	inputFlags(cmd, &opts)
+	transformFlags(cmd, &opts)
+	schemaFlags(cmd, &opts)
+	validateFlag(cmd, &opts)
+	return cmd
+}
+
+func validateCommand() *cobra.Command {
+	var opts kpatch.Options
+
+	cmd := &cobra.Command{
+		Use:   "validate [files...]",
+		Short: "Validate files against Kubernetes and CRD schemas",
+		Run: func(cmd *cobra.Command, args []string) {
+			opts.Validate = true
+			if err := kpatch.Check(args, opts); err != nil {
+				log.Fatalln(err)
+			}
+		},
+	}
+
+	inputFlags(cmd, &opts)
+	transformFlags(cmd, &opts)
+	schemaFlags(cmd, &opts)
+	return cmd
+}
+
+// fmtCommand exits 1 with --check when files aren't formatted like gofmt -l in CI
+func fmtCommand() *cobra.Command {
+	var opts kpatch.Options
+	var format kpatch.FormatOptions
+
+	cmd := &cobra.Command{
+		Use:   "fmt [files...]",
+		Short: "Write files in a canonical YAML format",
+		Run: func(cmd *cobra.Command, args []string) {
+			if err := kpatch.Format(args, opts, format, os.Stdout); err != nil {
+				log.Fatalln(err)
+			}
+		},
+	}
+
+	cmd.Flags().IntVar(&format.Indent, "indent", 2, "Spaces to indent each level by.")
+	cmd.Flags().BoolVar(&format.SortKeys, "sort-keys", false, "Put apiVersion, kind, metadata and spec first in each document.")
+	cmd.Flags().BoolVarP(&format.Write, "write", "w", false, "Rewrite files in place instead of writing them to stdout.")
+	cmd.Flags().BoolVar(&format.Check, "check", false, "List files that aren't formatted and fail if there are any.")
+	schemaFlags(cmd, &opts)
+	return cmd
+}
+
+// postRenderCommand runs kpatch as a Helm post-renderer. Helm shows whatever is written to stderr
+// when a post-renderer fails so errors are written as a single line without log decoration.
+func postRenderCommand() *cobra.Command {
+	var config string
+
+	cmd := &cobra.Command{
+		Use:   "post-render",
+		Short: "Apply a rules file to manifests from helm --post-renderer",
+		Args:  cobra.NoArgs,
+		Run: func(cmd *cobra.Command, args []string) {
+			if config == "" {
+				config = os.Getenv(kpatch.PostRenderConfigEnv)
+			}
+			if config == "" {
+				fmt.Fprintf(os.Stderr, "kpatch post-render: no rules file, use --config or set %s\n", kpatch.PostRenderConfigEnv)
+				os.Exit(1)
+			}
+
+			if err := kpatch.PostRender(config, os.Stdin, os.Stdout); err != nil {
+				fmt.Fprintf(os.Stderr, "kpatch post-render: %s\n", merry.UserMessage(err))
+				os.Exit(1)
+			}
+		},
+	}
+
+	cmd.Flags().StringVarP(&config, "config", "c", "", "Rules file to apply. Defaults to $"+kpatch.PostRenderConfigEnv+".")
+	return cmd
+}
+
+// fnCommand runs kpatch as a KRM function. The ResourceList is written even when the rules fail
+// so the results reach kustomize and the exit code tells it the function failed.
+func fnCommand() *cobra.Command {
+	return &cobra.Command{
+		Use:   "fn",
+		Short: "Run as a KRM function reading a ResourceList from stdin",
+		Args:  cobra.NoArgs,
+		Run: func(cmd *cobra.Command, args []string) {
+			if err := kpatch.Fn(os.Stdin, os.Stdout); err != nil {
+				fmt.Fprintf(os.Stderr, "kpatch fn: %s\n", merry.UserMessage(err))
+				os.Exit(1)
+			}
+		},
+	}
+}
+
+// replCommand reads commands from stdin so the files can't also be read from it
+func replCommand() *cobra.Command {
+	var opts kpatch.Options
+
+	cmd := &cobra.Command{
+		Use:   "repl files...",
+		Short: "Build selectors and actions interactively against files and save them as a rules file",
+		Args:  cobra.MinimumNArgs(1),
+		Run: func(cmd *cobra.Command, args []string) {
+			if err := kpatch.Repl(args, opts, os.Stdin, os.Stdout); err != nil {
+				log.Fatalln(err)
+			}
+		},
+	}
+
+	selectFlags(cmd, &opts)
+	typedFlag(cmd, &opts)
+	schemaFlags(cmd, &opts)
+	return cmd
+}
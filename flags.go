@@ -0,0 +1,75 @@
+package main
+
+import (
+	"github.com/mikesimons/kpatch/pkg/kpatch"
+
+	"github.com/spf13/cobra"
+)
+
+// selectFlags control which documents are selected and what selectors and actions can read
+func selectFlags(cmd *cobra.Command, opts *kpatch.Options) {
+	cmd.Flags().StringVarP(&opts.Selector, "selector", "s", "", "Document selector to specify which to apply expressions / merges to.")
+	cmd.Flags().StringArrayVarP(&opts.Params, "params", "p", opts.Params, "Parameters to be used in action expressions.")
+	cmd.Flags().BoolVar(&opts.Strict, "strict", false, "Error when a selector or action reads a key that does not exist.")
+	cmd.Flags().StringVar(&opts.AgeKeyFile, "age-key-file", "", "age key file used to decrypt values with decrypt() and --decrypt-secrets.")
+}
+
+// inputFlags control which documents are read and selected
+func inputFlags(cmd *cobra.Command, opts *kpatch.Options) {
+	selectFlags(cmd, opts)
+	cmd.Flags().BoolVar(&opts.Trace, "trace", false, "Write the selector result with the value of each part, the variables actions read and the changes they make for each document to stderr.")
+	cmd.Flags().StringVar(&opts.Log, "log", "", "File to append print() output and --trace to instead of stderr.")
+	cmd.Flags().StringArrayVar(&opts.ConfigMaps, "configmap", opts.ConfigMaps, "Generate a ConfigMap from a directory, files or .env files given as name=path[,path...]. May be used more than once.")
+	cmd.Flags().StringArrayVar(&opts.Secrets, "secret", opts.Secrets, "Generate a Secret from a directory, files or .env files given as name=path[,path...]. May be used more than once.")
+	cmd.Flags().BoolVar(&opts.SecretsDecoded, "secrets-decoded", false, "Decode Secret data in to stringData before selectors and actions run and encode it back in to data on output.")
+	cmd.Flags().BoolVar(&opts.DecryptSecrets, "decrypt-secrets", false, "Decrypt age encrypted Secret values before selectors and actions run. Requires --age-key-file.")
+}
+
+// transformFlags control how selected documents are changed
+func transformFlags(cmd *cobra.Command, opts *kpatch.Options) {
+	cmd.Flags().StringArrayVarP(&opts.Merges, "merge", "m", opts.Merges, "YAML/JSON file or inline YAML/JSON to merge with selected documents. May be used more than once.")
+	cmd.Flags().StringArrayVarP(&opts.Actions, "action", "a", opts.Actions, "Action expression to apply to selected documents. May be used more than once.")
+	cmd.Flags().StringVar(&opts.Images, "images", "", "Images config file or inline YAML to rewrite container images in selected documents.")
+	cmd.Flags().StringVarP(&opts.Namespace, "namespace", "n", "", "Namespace to move selected namespaced documents to. References to the namespace are updated and cluster scoped documents have their namespace removed.")
+	cmd.Flags().StringVar(&opts.NamePrefix, "name-prefix", "", "Prefix to add to the names of selected documents. References to renamed documents are updated.")
+	cmd.Flags().StringVar(&opts.NameSuffix, "name-suffix", "", "Suffix to add to the names of selected documents. References to renamed documents are updated.")
+	cmd.Flags().StringArrayVar(&opts.NameKinds, "name-kind", opts.NameKinds, "Only add name prefix / suffix to documents of this kind. May be used more than once.")
+	cmd.Flags().StringVar(&opts.NameReferences, "name-references", "", "YAML file or inline YAML of extra fields that refer to documents by name.")
+	cmd.Flags().StringVar(&opts.HashConfigMaps, "hash-configmaps", "", "Add a content hash to selected ConfigMaps and Secrets so workloads roll when they change. 'name' (default) suffixes their names, 'annotation' adds a checksum/config annotation to pod templates.")
+	cmd.Flags().Lookup("hash-configmaps").NoOptDefVal = "name"
+	cmd.Flags().BoolVar(&opts.NormalizeSecrets, "normalize-secrets", false, "Encode Secret stringData in to data on output.")
+	cmd.Flags().StringVar(&opts.MigrateAPIs, "migrate-apis", "", "Kubernetes version (e.g. 1.25) to migrate selected documents using APIs removed in or before it to. Anything that can't be converted is reported as a warning.")
+	typedFlag(cmd, opts)
+	cmd.Flags().StringVar(&opts.Dedupe, "dedupe", "", "How to handle documents with the same group, kind, namespace and name: error, first, last or merge.")
+	cmd.Flags().StringVar(&opts.DedupeStrategy, "dedupe-strategy", "replace", "How --dedupe=merge merges lists: replace or append.")
+	cmd.Flags().StringVar(&opts.Sort, "sort", "none", "Order of the output: install, uninstall, name or none to keep input order.")
+	cmd.Flags().StringVar(&opts.SortOrder, "sort-order", "", "YAML file or inline YAML list of kinds to install in, with '*' for any other kind. Used by --sort=install and --sort=uninstall.")
+}
+
+// typedFlag is --typed bound to Options.Typed
+func typedFlag(cmd *cobra.Command, opts *kpatch.Options) {
+	cmd.Flags().BoolVar(&opts.Typed, "typed", false, "Convert values assigned by actions to the type of the field in the schema, failing if they can't be converted exactly.")
+}
+
+// schemaFlags choose the Kubernetes version and schemas used by validation, typed assignment, reports and fmt
+func schemaFlags(cmd *cobra.Command, opts *kpatch.Options) {
+	cmd.Flags().StringVar(&opts.KubeVersion, "kube-version", "", "Kubernetes version (e.g. 1.25) for reports, validation and the schema used to type assignments and find string fields.")
+	cmd.Flags().StringArrayVar(&opts.Schemas, "schema", opts.Schemas, "Kubernetes OpenAPI schema (JSON) or CRD YAML file to validate, type assignments and find string fields with. May be used more than once.")
+}
+
+// validateFlag turns on validation for commands that don't always validate
+func validateFlag(cmd *cobra.Command, opts *kpatch.Options) {
+	cmd.Flags().BoolVar(&opts.Validate, "validate", false, "Validate output documents against the Kubernetes OpenAPI schema (bundled for 1.23 only, otherwise give --schema) and the schemas of CRDs in the input.")
+}
+
+// outputFlags control what is written and where
+func outputFlags(cmd *cobra.Command, opts *kpatch.Options) {
+	cmd.Flags().StringVar(&opts.OutputDir, "output-dir", "", "Write each output document to its own file in this directory instead of stdout.")
+	cmd.Flags().StringVar(&opts.Layout, "layout", "{{namespace}}/{{kind}}-{{name}}.yaml", "Path of each document in --output-dir. {{namespace}}, {{kind}}, {{name}}, {{group}}, {{version}} and {{index}} are replaced and empty parts of the path are dropped.")
+	cmd.Flags().StringVar(&opts.OnCollision, "on-collision", "append", "What to do when documents have the same path in --output-dir: append or error.")
+	cmd.Flags().BoolVar(&opts.Kustomization, "kustomization", false, "Write a kustomization.yaml listing the files written to --output-dir.")
+	cmd.Flags().BoolVar(&opts.Clean, "clean", false, "Remove YAML files in --output-dir that weren't written by this run.")
+	cmd.Flags().BoolVar(&opts.ListImages, "list-images", false, "List container images in selected documents instead of printing them.")
+	cmd.Flags().StringVar(&opts.Report, "report", "", "Write a report on selected documents instead of the documents. 'deprecations' lists APIs deprecated in --kube-version and fails if any have been removed.")
+	cmd.Flags().StringVar(&opts.ReportFormat, "report-format", "table", "Report format: table or json.")
+}
@@ -0,0 +1,87 @@
+//go:build ignore
+// +build ignore
+
+// openapi-schema strips a Kubernetes OpenAPI v2 document down to what kpatch needs to validate
+// documents and writes it gzipped for bundling, e.g.
+//
+//	kubectl get --raw /openapi/v2 | go run hack/openapi-schema.go > pkg/kpatch/schemas/kubernetes-1.23.json.gz
+package main
+
+import (
+	"compress/gzip"
+	"encoding/json"
+	"log"
+	"os"
+)
+
+var keep = map[string]bool{
+	"type":                                 true,
+	"format":                               true,
+	"properties":                           true,
+	"additionalProperties":                 true,
+	"items":                                true,
+	"required":                             true,
+	"enum":                                 true,
+	"allOf":                                true,
+	"$ref":                                 true,
+	"x-kubernetes-group-version-kind":      true,
+	"x-kubernetes-int-or-string":           true,
+	"x-kubernetes-preserve-unknown-fields": true,
+}
+
+func strip(s map[string]interface{}) map[string]interface{} {
+	out := make(map[string]interface{})
+	for key, value := range s {
+		if !keep[key] {
+			continue
+		}
+
+		switch key {
+		case "properties":
+			props := make(map[string]interface{})
+			for name, prop := range value.(map[string]interface{}) {
+				props[name] = strip(prop.(map[string]interface{}))
+			}
+			value = props
+		case "items", "additionalProperties":
+			if m, ok := value.(map[string]interface{}); ok {
+				value = strip(m)
+			}
+		case "allOf":
+			var all []interface{}
+			for _, item := range value.([]interface{}) {
+				all = append(all, strip(item.(map[string]interface{})))
+			}
+			value = all
+		}
+		out[key] = value
+	}
+	return out
+}
+
+func main() {
+	var doc struct {
+		Definitions map[string]map[string]interface{} `json:"definitions"`
+	}
+	if err := json.NewDecoder(os.Stdin).Decode(&doc); err != nil {
+		log.Fatalln(err)
+	}
+
+	definitions := make(map[string]interface{})
+	for name, def := range doc.Definitions {
+		definitions[name] = strip(def)
+	}
+
+	// Quantities are strings in the schema but numbers are accepted too
+	if q, ok := definitions["io.k8s.apimachinery.pkg.api.resource.Quantity"].(map[string]interface{}); ok {
+		q["format"] = "quantity"
+	}
+
+	w := gzip.NewWriter(os.Stdout)
+	if err := json.NewEncoder(w).Encode(map[string]interface{}{"definitions": definitions}); err != nil {
+		log.Fatalln(err)
+	}
+	if err := w.Close(); err != nil {
+		log.Fatalln(err)
+	}
+}
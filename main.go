@@ -11,27 +11,45 @@ import (
 
 var versionString = "dev"
 
-func main() {
-	var selector string
-	var merges []string
-	var exprs []string
-	var params []string
+// applyCommand returns a command that runs selectors, actions and transformers over files.
+// The root command is an apply command so existing invocations keep working.
+func applyCommand(use string, short string) *cobra.Command {
+	var opts kpatch.Options
 
 	cmd := &cobra.Command{
-		Use:     "kpatch",
-		Version: versionString,
+		Use:   use,
+		Short: short,
+		// Without this cobra treats files as unknown subcommands of the root command
+		Args: cobra.ArbitraryArgs,
 		Run: func(cmd *cobra.Command, args []string) {
-			err := kpatch.Run(args, selector, merges, exprs, params, os.Stdout)
+			err := kpatch.Run(args, opts, os.Stdout)
 			if err != nil {
 				log.Fatalln(err)
 			}
 		},
 	}
 
-	cmd.Flags().StringVarP(&selector, "selector", "s", "", "Document selector to specify which to apply expressions / merges to.")
-	cmd.Flags().StringArrayVarP(&merges, "merge", "m", merges, "YAML/JSON file or inline YAML/JSON to merge with selected documents. May be used more than once.")
-	cmd.Flags().StringArrayVarP(&exprs, "action", "a", exprs, "Action expression to apply to selected documents. May be used more than once.")
-	cmd.Flags().StringArrayVarP(&params, "params", "p", params, "Parameters to be used in action expressions.")
+	inputFlags(cmd, &opts)
+	transformFlags(cmd, &opts)
+	schemaFlags(cmd, &opts)
+	validateFlag(cmd, &opts)
+	outputFlags(cmd, &opts)
+	return cmd
+}
+
+func main() {
+	cmd := applyCommand("kpatch", "Select and patch Kubernetes manifests")
+	cmd.Version = versionString
+
+	cmd.AddCommand(applyCommand("apply [files...]", "Apply selectors, actions and transformers to files (the default)"))
+	cmd.AddCommand(queryCommand())
+	cmd.AddCommand(diffCommand())
+	cmd.AddCommand(checkCommand())
+	cmd.AddCommand(validateCommand())
+	cmd.AddCommand(fmtCommand())
+	cmd.AddCommand(postRenderCommand())
+	cmd.AddCommand(fnCommand())
+	cmd.AddCommand(replCommand())
 
 	err := cmd.Execute()
 	if err != nil {
@@ -0,0 +1,49 @@
+package kpatch
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/ansel1/merry"
+)
+
+// assertionsKey is the merry value holding the []assertionFailure of a failed Run
+const assertionsKey = "assertions"
+
+// assertionFailure is an assert() in an action that didn't hold
+type assertionFailure struct {
+	message string
+	source  string
+	index   int
+	doc     map[interface{}]interface{}
+}
+
+func (f assertionFailure) String() string {
+	return fmt.Sprintf("%s (document %d of '%s'): %s", docID(f.doc), f.index, f.source, f.message)
+}
+
+// fnAssert records a failure when cond isn't true. Every assertion is checked before Run fails.
+func (s *kpatch) fnAssert(args ...interface{}) (interface{}, error) {
+	if len(args) != 2 {
+		return nil, merry.Errorf("assert(cond, message) requires exactly two arguments")
+	}
+	message, ok := args[1].(string)
+	if !ok {
+		return nil, merry.Errorf("assert(cond, message) expects message to be a string")
+	}
+
+	if args[0] != true {
+		*s.failures = append(*s.failures, assertionFailure{message: message, source: s.source, index: s.index, doc: s.doc})
+	}
+	return nil, nil
+}
+
+// assertionError returns an error listing failures that carries them as the assertionsKey value
+func assertionError(failures []assertionFailure) error {
+	var lines []string
+	for _, f := range failures {
+		lines = append(lines, f.String())
+	}
+	msg := fmt.Sprintf("assertions failed:\n  %s", strings.Join(lines, "\n  "))
+	return merry.New(msg).WithValue(assertionsKey, failures).WithUserMessage(msg)
+}
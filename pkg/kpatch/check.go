@@ -0,0 +1,9 @@
+package kpatch
+
+import "io/ioutil"
+
+// Check runs files through Run with opts discarding the output so only failed assertions,
+// validation and other errors are reported
+func Check(files []string, opts Options) error {
+	return Run(files, opts, nopWriteCloser{ioutil.Discard})
+}
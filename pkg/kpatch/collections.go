@@ -0,0 +1,403 @@
+package kpatch
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+	"sort"
+
+	"github.com/PaesslerAG/gval"
+	"github.com/ansel1/merry"
+)
+
+// collectionLanguage contains the list and map functions available to selectors and actions.
+// Functions taking an expression evaluate it once per element with @ set to the element.
+func (s *kpatch) collectionLanguage() gval.Language {
+	return gval.NewLanguage(
+		gval.Function("map", s.fnMap),
+		gval.Function("filter", s.fnFilter),
+		gval.Function("find", s.fnFind),
+		gval.Function("any", s.fnAny),
+		gval.Function("all", s.fnAll),
+		gval.Function("keys", s.fnKeys),
+		gval.Function("values", s.fnValues),
+		gval.Function("len", s.fnLen),
+		gval.Function("sort_by", s.fnSortBy),
+		gval.Function("uniq", s.fnUniq),
+		gval.Function("flatten", s.fnFlatten),
+		gval.Function("group_by", s.fnGroupBy),
+		gval.Function("to_entries", s.fnToEntries),
+		gval.Function("from_entries", s.fnFromEntries),
+	)
+}
+
+// lambdaArgs validates the (list, expr) arguments of a higher order function and
+// returns a function to evaluate expr against a list element
+func (s *kpatch) lambdaArgs(signature string, args []interface{}) ([]interface{}, func(interface{}) (interface{}, error), error) {
+	if len(args) != 2 {
+		return nil, nil, merry.Errorf("%s requires exactly 2 arguments", signature)
+	}
+
+	list, ok := listArg(args[0])
+	if !ok {
+		return nil, nil, merry.Errorf("%s expects list to be a slice", signature)
+	}
+
+	expr, ok := args[1].(string)
+	if !ok {
+		return nil, nil, merry.Errorf("%s expects expr to be a string", signature)
+	}
+
+	eval, err := s.lang.NewEvaluable(expr)
+	if err != nil {
+		return nil, nil, merry.Errorf("%s error parsing expr: %s", signature, err)
+	}
+
+	return list, func(item interface{}) (interface{}, error) {
+		tmp := s.currentItem
+		s.currentItem = item
+		defer func() { s.currentItem = tmp }()
+
+		val, err := eval(context.Background(), s.doc)
+		if err != nil {
+			return nil, merry.Errorf("%s error evaluating expr: %s", signature, err)
+		}
+		return val, nil
+	}, nil
+}
+
+// listArg treats a missing (nil) list as an empty one
+func listArg(arg interface{}) ([]interface{}, bool) {
+	if arg == nil {
+		return []interface{}{}, true
+	}
+	list, ok := arg.([]interface{})
+	return list, ok
+}
+
+// mapArg accepts both decoded YAML maps and map literals from expressions
+func mapArg(arg interface{}) (map[interface{}]interface{}, bool) {
+	switch m := arg.(type) {
+	case map[interface{}]interface{}:
+		return m, true
+	case map[string]interface{}:
+		out := make(map[interface{}]interface{}, len(m))
+		for k, v := range m {
+			out[k] = v
+		}
+		return out, true
+	}
+	return nil, false
+}
+
+// sortedKeys returns the keys of m in a stable order
+func sortedKeys(m map[interface{}]interface{}) []interface{} {
+	var keys []interface{}
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.SliceStable(keys, func(i, j int) bool {
+		return lessValue(keys[i], keys[j])
+	})
+	return keys
+}
+
+// lessValue compares numbers numerically and everything else by its string form
+func lessValue(a, b interface{}) bool {
+	af, aok := toFloat(a)
+	bf, bok := toFloat(b)
+	if aok && bok {
+		return af < bf
+	}
+	return fmt.Sprintf("%v", a) < fmt.Sprintf("%v", b)
+}
+
+func toFloat(v interface{}) (float64, bool) {
+	switch n := v.(type) {
+	case int:
+		return float64(n), true
+	case int64:
+		return float64(n), true
+	case uint64:
+		return float64(n), true
+	case float64:
+		return n, true
+	}
+	return 0, false
+}
+
+func (s *kpatch) fnMap(args ...interface{}) (interface{}, error) {
+	list, eval, err := s.lambdaArgs("map(list, expr)", args)
+	if err != nil {
+		return nil, err
+	}
+
+	out := make([]interface{}, 0, len(list))
+	for _, item := range list {
+		val, err := eval(item)
+		if err != nil {
+			return nil, err
+		}
+		out = append(out, val)
+	}
+	return out, nil
+}
+
+func (s *kpatch) fnFilter(args ...interface{}) (interface{}, error) {
+	list, eval, err := s.lambdaArgs("filter(list, pred)", args)
+	if err != nil {
+		return nil, err
+	}
+
+	out := make([]interface{}, 0)
+	for _, item := range list {
+		val, err := eval(item)
+		if err != nil {
+			return nil, err
+		}
+		if val == true {
+			out = append(out, item)
+		}
+	}
+	return out, nil
+}
+
+func (s *kpatch) fnFind(args ...interface{}) (interface{}, error) {
+	list, eval, err := s.lambdaArgs("find(list, pred)", args)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, item := range list {
+		val, err := eval(item)
+		if err != nil {
+			return nil, err
+		}
+		if val == true {
+			return item, nil
+		}
+	}
+	return nil, nil
+}
+
+func (s *kpatch) fnAny(args ...interface{}) (interface{}, error) {
+	list, eval, err := s.lambdaArgs("any(list, pred)", args)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, item := range list {
+		val, err := eval(item)
+		if err != nil {
+			return nil, err
+		}
+		if val == true {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+func (s *kpatch) fnAll(args ...interface{}) (interface{}, error) {
+	list, eval, err := s.lambdaArgs("all(list, pred)", args)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, item := range list {
+		val, err := eval(item)
+		if err != nil {
+			return nil, err
+		}
+		if val != true {
+			return false, nil
+		}
+	}
+	return true, nil
+}
+
+func (s *kpatch) fnKeys(args ...interface{}) (interface{}, error) {
+	if len(args) != 1 {
+		return nil, merry.Errorf("keys(map) requires exactly one argument")
+	}
+	m, ok := mapArg(args[0])
+	if !ok {
+		return nil, merry.Errorf("keys(map) expects map to be a map")
+	}
+	return sortedKeys(m), nil
+}
+
+func (s *kpatch) fnValues(args ...interface{}) (interface{}, error) {
+	if len(args) != 1 {
+		return nil, merry.Errorf("values(map) requires exactly one argument")
+	}
+	m, ok := mapArg(args[0])
+	if !ok {
+		return nil, merry.Errorf("values(map) expects map to be a map")
+	}
+
+	out := make([]interface{}, 0, len(m))
+	for _, k := range sortedKeys(m) {
+		out = append(out, m[k])
+	}
+	return out, nil
+}
+
+func (s *kpatch) fnLen(args ...interface{}) (interface{}, error) {
+	if len(args) != 1 {
+		return nil, merry.Errorf("len(value) requires exactly one argument")
+	}
+	if args[0] == nil {
+		return 0, nil
+	}
+
+	v := reflect.ValueOf(args[0])
+	switch v.Kind() {
+	case reflect.String, reflect.Slice, reflect.Map:
+		return v.Len(), nil
+	}
+	return nil, merry.Errorf("len(value) expects value to be a string, slice or map")
+}
+
+func (s *kpatch) fnSortBy(args ...interface{}) (interface{}, error) {
+	list, eval, err := s.lambdaArgs("sort_by(list, expr)", args)
+	if err != nil {
+		return nil, err
+	}
+
+	sortKeys := make([]interface{}, len(list))
+	for i, item := range list {
+		sortKeys[i], err = eval(item)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	idx := make([]int, len(list))
+	for i := range idx {
+		idx[i] = i
+	}
+	sort.SliceStable(idx, func(i, j int) bool {
+		return lessValue(sortKeys[idx[i]], sortKeys[idx[j]])
+	})
+
+	out := make([]interface{}, 0, len(list))
+	for _, i := range idx {
+		out = append(out, list[i])
+	}
+	return out, nil
+}
+
+func (s *kpatch) fnUniq(args ...interface{}) (interface{}, error) {
+	if len(args) != 1 {
+		return nil, merry.Errorf("uniq(list) requires exactly one argument")
+	}
+	list, ok := listArg(args[0])
+	if !ok {
+		return nil, merry.Errorf("uniq(list) expects list to be a slice")
+	}
+
+	out := make([]interface{}, 0, len(list))
+	for _, item := range list {
+		seen := false
+		for _, o := range out {
+			if reflect.DeepEqual(o, item) {
+				seen = true
+				break
+			}
+		}
+		if !seen {
+			out = append(out, item)
+		}
+	}
+	return out, nil
+}
+
+func flatten(list []interface{}) []interface{} {
+	out := make([]interface{}, 0, len(list))
+	for _, item := range list {
+		if nested, ok := item.([]interface{}); ok {
+			out = append(out, flatten(nested)...)
+			continue
+		}
+		out = append(out, item)
+	}
+	return out
+}
+
+func (s *kpatch) fnFlatten(args ...interface{}) (interface{}, error) {
+	if len(args) != 1 {
+		return nil, merry.Errorf("flatten(list) requires exactly one argument")
+	}
+	list, ok := listArg(args[0])
+	if !ok {
+		return nil, merry.Errorf("flatten(list) expects list to be a slice")
+	}
+	return flatten(list), nil
+}
+
+func (s *kpatch) fnGroupBy(args ...interface{}) (interface{}, error) {
+	list, eval, err := s.lambdaArgs("group_by(list, expr)", args)
+	if err != nil {
+		return nil, err
+	}
+
+	out := make(map[interface{}]interface{})
+	for _, item := range list {
+		key, err := eval(item)
+		if err != nil {
+			return nil, err
+		}
+		if key == nil || !reflect.TypeOf(key).Comparable() {
+			key = fmt.Sprintf("%v", key)
+		}
+		group, _ := out[key].([]interface{})
+		out[key] = append(group, item)
+	}
+	return out, nil
+}
+
+func (s *kpatch) fnToEntries(args ...interface{}) (interface{}, error) {
+	if len(args) != 1 {
+		return nil, merry.Errorf("to_entries(map) requires exactly one argument")
+	}
+	m, ok := mapArg(args[0])
+	if !ok {
+		return nil, merry.Errorf("to_entries(map) expects map to be a map")
+	}
+
+	out := make([]interface{}, 0, len(m))
+	for _, k := range sortedKeys(m) {
+		out = append(out, map[interface{}]interface{}{"key": k, "value": m[k]})
+	}
+	return out, nil
+}
+
+// fnFromEntries accepts entries keyed by either "key" or "name" so that lists
+// such as container env can be converted directly
+func (s *kpatch) fnFromEntries(args ...interface{}) (interface{}, error) {
+	if len(args) != 1 {
+		return nil, merry.Errorf("from_entries(list) requires exactly one argument")
+	}
+	list, ok := listArg(args[0])
+	if !ok {
+		return nil, merry.Errorf("from_entries(list) expects list to be a slice")
+	}
+
+	out := make(map[interface{}]interface{})
+	for _, item := range list {
+		entry, ok := mapArg(item)
+		if !ok {
+			return nil, merry.Errorf("from_entries(list) expects entries to be maps")
+		}
+		key, ok := entry["key"]
+		if !ok {
+			key, ok = entry["name"]
+		}
+		if !ok {
+			return nil, merry.Errorf("from_entries(list) expects entries to have a key or name")
+		}
+		out[key] = entry["value"]
+	}
+	return out, nil
+}
@@ -0,0 +1,71 @@
+package kpatch
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"strings"
+
+	yaml "gopkg.in/yaml.v2"
+)
+
+func isDocumentStart(line string) bool {
+	return line == "---" || strings.HasPrefix(line, "--- ") || strings.HasPrefix(line, "---\t")
+}
+
+// leadingComments returns the comment lines at the top of every document in content, indexed
+// the same way as the documents read by a yaml.Decoder, e.g. the "# Source:" comments Helm adds.
+func leadingComments(content []byte) []string {
+	var comments []string
+	var current []string
+	// The decoder only returns text before the first separator if there is something in it
+	hasContent, inHeader, first := false, true, true
+
+	finish := func() {
+		if !first || hasContent {
+			comments = append(comments, strings.Join(current, ""))
+		}
+	}
+
+	scanner := bufio.NewScanner(bytes.NewReader(content))
+	scanner.Buffer(nil, len(content)+1)
+	for scanner.Scan() {
+		line := scanner.Text()
+		trimmed := strings.TrimSpace(line)
+
+		if isDocumentStart(line) {
+			finish()
+			current, hasContent, inHeader, first = nil, false, true, false
+			continue
+		}
+
+		if strings.HasPrefix(trimmed, "#") {
+			if inHeader {
+				current = append(current, line+"\n")
+			}
+			continue
+		}
+
+		if trimmed != "" {
+			hasContent, inHeader = true, false
+		}
+	}
+	finish()
+
+	return comments
+}
+
+// writeDocuments writes docs to w each with a separator and the comments they were read with
+func writeDocuments(docs []*document, w io.Writer) error {
+	for _, doc := range docs {
+		out, err := yaml.Marshal(doc.data)
+		if err != nil {
+			return fmt.Errorf("error encoding %s: %s", doc, err)
+		}
+		if _, err = fmt.Fprintf(w, "---\n%s%s", doc.comment, out); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,173 @@
+package kpatch
+
+import (
+	"bytes"
+	"encoding/base64"
+	"fmt"
+	"io/ioutil"
+	"strings"
+
+	"filippo.io/age"
+	"filippo.io/age/armor"
+	"github.com/ansel1/merry"
+	"github.com/spf13/afero"
+)
+
+// ageArmorHeader starts every ASCII armored age message
+const ageArmorHeader = "-----BEGIN AGE ENCRYPTED FILE-----"
+
+func isEncrypted(value string) bool {
+	return strings.HasPrefix(strings.TrimSpace(value), ageArmorHeader)
+}
+
+// getAgeIdentities loads the identities in an age key file as written by age-keygen
+func getAgeIdentities(keyFile string) ([]age.Identity, error) {
+	keyBytes, err := afero.ReadFile(Fs, keyFile)
+	if err != nil {
+		return nil, fmt.Errorf("error loading age key file '%s': %s", keyFile, err)
+	}
+
+	identities, err := age.ParseIdentities(bytes.NewReader(keyBytes))
+	if err != nil {
+		return nil, fmt.Errorf("error parsing age key file '%s': %s", keyFile, err)
+	}
+	return identities, nil
+}
+
+// ageEncrypt encrypts value to the recipients returning an ASCII armored message
+func ageEncrypt(value string, recipients []string) (string, error) {
+	var parsed []age.Recipient
+	for _, r := range recipients {
+		recipient, err := age.ParseX25519Recipient(r)
+		if err != nil {
+			return "", err
+		}
+		parsed = append(parsed, recipient)
+	}
+
+	var buf bytes.Buffer
+	armored := armor.NewWriter(&buf)
+	w, err := age.Encrypt(armored, parsed...)
+	if err != nil {
+		return "", err
+	}
+
+	if _, err = w.Write([]byte(value)); err != nil {
+		return "", err
+	}
+	if err = w.Close(); err != nil {
+		return "", err
+	}
+	if err = armored.Close(); err != nil {
+		return "", err
+	}
+	return buf.String(), nil
+}
+
+// ageDecrypt decrypts an ASCII armored message with the first identity that can
+func ageDecrypt(value string, identities []age.Identity) (string, error) {
+	r, err := age.Decrypt(armor.NewReader(strings.NewReader(strings.TrimSpace(value))), identities...)
+	if err != nil {
+		return "", err
+	}
+
+	out, err := ioutil.ReadAll(r)
+	return string(out), err
+}
+
+func (s *kpatch) fnEncrypt(args ...interface{}) (interface{}, error) {
+	if len(args) != 2 {
+		return nil, merry.Errorf("encrypt(value, recipient) requires exactly two arguments")
+	}
+
+	value, ok := args[0].(string)
+	if !ok {
+		return nil, merry.Errorf("encrypt(value, recipient) expects value to be a string")
+	}
+
+	var recipients []string
+	switch r := args[1].(type) {
+	case string:
+		recipients = []string{r}
+	case []interface{}:
+		for _, item := range r {
+			recipient, ok := item.(string)
+			if !ok {
+				return nil, merry.Errorf("encrypt(value, recipient) expects recipient to be a string or list of strings")
+			}
+			recipients = append(recipients, recipient)
+		}
+	default:
+		return nil, merry.Errorf("encrypt(value, recipient) expects recipient to be a string or list of strings")
+	}
+
+	out, err := ageEncrypt(value, recipients)
+	if err != nil {
+		return nil, merry.Errorf("encrypt(value, recipient) failed: %s", err)
+	}
+	return out, nil
+}
+
+func (s *kpatch) fnDecrypt(args ...interface{}) (interface{}, error) {
+	if len(args) != 1 {
+		return nil, merry.Errorf("decrypt(value) requires exactly one argument")
+	}
+
+	value, ok := args[0].(string)
+	if !ok {
+		return nil, merry.Errorf("decrypt(value) expects value to be a string")
+	}
+
+	if s.identities == nil {
+		return nil, merry.Errorf("decrypt(value) requires an age key file")
+	}
+
+	out, err := ageDecrypt(value, s.identities)
+	if err != nil {
+		return nil, merry.Errorf("decrypt(value) failed in %s: %s", s.docName(), err)
+	}
+	return out, nil
+}
+
+// decryptSecret decrypts the age encrypted values of a Secret's data and stringData in place.
+// Values in data stay base64 encoded.
+func decryptSecret(doc map[interface{}]interface{}, identities []age.Identity) error {
+	if doc["kind"] != "Secret" {
+		return nil
+	}
+
+	if _, ok := doc["sops"]; ok {
+		return fmt.Errorf("SOPS encrypted documents are not supported, decrypt them with sops first")
+	}
+
+	data, _ := doc["data"].(map[interface{}]interface{})
+	for key, value := range data {
+		encoded, _ := value.(string)
+		decoded, err := base64.StdEncoding.DecodeString(encoded)
+		if err != nil || !isEncrypted(string(decoded)) {
+			continue
+		}
+
+		plain, err := ageDecrypt(string(decoded), identities)
+		if err != nil {
+			return fmt.Errorf("error decrypting data key '%v': %s", key, err)
+		}
+		data[key] = b64encode(plain)
+	}
+
+	stringData, _ := doc["stringData"].(map[interface{}]interface{})
+	for key, value := range stringData {
+		encrypted, _ := value.(string)
+		if !isEncrypted(encrypted) {
+			continue
+		}
+
+		plain, err := ageDecrypt(encrypted, identities)
+		if err != nil {
+			return fmt.Errorf("error decrypting stringData key '%v': %s", key, err)
+		}
+		stringData[key] = plain
+	}
+
+	return nil
+}
@@ -0,0 +1,147 @@
+package kpatch
+
+import (
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/imdario/mergo"
+)
+
+const (
+	dedupeError = "error"
+	dedupeFirst = "first"
+	dedupeLast  = "last"
+	dedupeMerge = "merge"
+
+	// mergeReplace replaces lists when merging duplicates
+	mergeReplace = "replace"
+	// mergeAppend appends lists when merging duplicates
+	mergeAppend = "append"
+)
+
+// dedupeKey identifies a resource by API group as well as kind, namespace and name
+type dedupeKey struct {
+	group string
+	id    resourceID
+}
+
+func (k dedupeKey) String() string {
+	if k.group == "" {
+		return k.id.String()
+	}
+	return k.group + "/" + k.id.String()
+}
+
+func docDedupeKey(doc map[interface{}]interface{}) dedupeKey {
+	apiVersion, _ := doc["apiVersion"].(string)
+	group := ""
+	if i := strings.LastIndex(apiVersion, "/"); i >= 0 {
+		group = apiVersion[:i]
+	}
+	return dedupeKey{group: group, id: docID(doc)}
+}
+
+func (d *document) String() string {
+	return fmt.Sprintf("document %d of '%s'", d.index, d.source)
+}
+
+// deduper finds documents with the same identity and resolves them according to mode
+type deduper struct {
+	mode     string
+	strategy string
+	warnings io.Writer
+}
+
+func newDeduper(mode string, strategy string, warnings io.Writer) (*deduper, error) {
+	switch mode {
+	case dedupeError, dedupeFirst, dedupeLast, dedupeMerge:
+	default:
+		return nil, fmt.Errorf("unknown dedupe mode '%s': expected %s, %s, %s or %s", mode, dedupeError, dedupeFirst, dedupeLast, dedupeMerge)
+	}
+
+	switch strategy {
+	case "":
+		strategy = mergeReplace
+	case mergeReplace, mergeAppend:
+	default:
+		return nil, fmt.Errorf("unknown merge strategy '%s': expected %s or %s", strategy, mergeReplace, mergeAppend)
+	}
+
+	return &deduper{mode: mode, strategy: strategy, warnings: warnings}, nil
+}
+
+// dedupe returns docs with duplicates resolved. Each group of duplicates is reported to warnings
+// with where every copy came from unless mode is error in which case they are all returned in
+// the error.
+func (d *deduper) dedupe(docs []*document) ([]*document, error) {
+	var order []dedupeKey
+	copies := make(map[dedupeKey][]*document)
+	for _, doc := range docs {
+		key := docDedupeKey(doc.data)
+		if key.id.kind == "" || key.id.name == "" {
+			continue
+		}
+		if _, ok := copies[key]; !ok {
+			order = append(order, key)
+		}
+		copies[key] = append(copies[key], doc)
+	}
+
+	var reports []string
+	drop := make(map[*document]bool)
+	for _, key := range order {
+		dupes := copies[key]
+		if len(dupes) < 2 {
+			continue
+		}
+
+		var sources []string
+		for _, doc := range dupes {
+			sources = append(sources, doc.String())
+		}
+		reports = append(reports, fmt.Sprintf("%s is defined in %s", key, strings.Join(sources, ", ")))
+
+		switch d.mode {
+		case dedupeFirst:
+			for _, doc := range dupes[1:] {
+				drop[doc] = true
+			}
+		case dedupeLast:
+			for _, doc := range dupes[:len(dupes)-1] {
+				drop[doc] = true
+			}
+		case dedupeMerge:
+			opts := []func(*mergo.Config){mergo.WithOverride}
+			if d.strategy == mergeAppend {
+				opts = append(opts, mergo.WithAppendSlice)
+			}
+			for _, doc := range dupes[1:] {
+				if err := mergo.Map(&dupes[0].data, doc.data, opts...); err != nil {
+					return nil, fmt.Errorf("error merging %s from %s: %s", key, doc, err)
+				}
+				drop[doc] = true
+			}
+		}
+	}
+
+	if len(reports) == 0 {
+		return docs, nil
+	}
+
+	if d.mode == dedupeError {
+		return nil, fmt.Errorf("duplicate resources:\n  %s", strings.Join(reports, "\n  "))
+	}
+
+	for _, report := range reports {
+		warnf(d.warnings, "duplicate %s, using %s", report, d.mode)
+	}
+
+	var out []*document
+	for _, doc := range docs {
+		if !drop[doc] {
+			out = append(out, doc)
+		}
+	}
+	return out, nil
+}
@@ -0,0 +1,291 @@
+package kpatch
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"reflect"
+	"sort"
+
+	"github.com/ansel1/merry"
+)
+
+const (
+	diffText = "text"
+	diffJSON = "json"
+
+	changeAdded   = "added"
+	changeRemoved = "removed"
+	changeChanged = "changed"
+)
+
+// listKeys are the fields list entries are matched by, in order of preference, when every entry
+// has a different value for one of them, e.g. containers by name and ports by containerPort
+var listKeys = []string{"name", "mountPath", "containerPort", "port", "devicePath", "ip"}
+
+// difference is a change at a single path in a resource
+type difference struct {
+	Path   string      `json:"path"`
+	Change string      `json:"change"`
+	Old    interface{} `json:"old,omitempty"`
+	New    interface{} `json:"new,omitempty"`
+}
+
+// resourceDiff is a resource that was added, removed or changed
+type resourceDiff struct {
+	Resource    string       `json:"resource"`
+	Change      string       `json:"change"`
+	Differences []difference `json:"differences,omitempty"`
+}
+
+// loadDocuments returns the documents Run outputs for files with opts
+func loadDocuments(files []string, opts Options) ([]map[interface{}]interface{}, error) {
+	var out bytes.Buffer
+	if err := Run(files, opts, nopWriteCloser{&out}); err != nil {
+		return nil, err
+	}
+	return decodeDocuments(out.Bytes()), nil
+}
+
+// documentsByKey indexes the documents of file by resource identity. Documents without a kind
+// and name are matched by their position in the output instead, e.g. "document 2". Documents
+// with the same identity can't be matched and are an error.
+func documentsByKey(docs []map[interface{}]interface{}, file string) (map[string]map[interface{}]interface{}, error) {
+	out := make(map[string]map[interface{}]interface{})
+	for i, doc := range docs {
+		key := docDedupeKey(doc)
+		if key.id.kind == "" || key.id.name == "" {
+			out[fmt.Sprintf("document %d", i+1)] = doc
+			continue
+		}
+		if _, ok := out[key.String()]; ok {
+			return nil, fmt.Errorf("'%s' has more than one %s, use --dedupe to choose one", file, key)
+		}
+		out[key.String()] = doc
+	}
+	return out, nil
+}
+
+// uniqueKey reports whether every entry of list is a map with a different value for key
+func uniqueKey(list []interface{}, key string) bool {
+	seen := make(map[string]bool)
+	for _, item := range list {
+		m, ok := item.(map[interface{}]interface{})
+		if !ok || m[key] == nil {
+			return false
+		}
+		value := fmt.Sprint(m[key])
+		if seen[value] {
+			return false
+		}
+		seen[value] = true
+	}
+	return true
+}
+
+// listKey returns the field the entries of old and new are matched by or "" to match by index
+func listKey(old []interface{}, new []interface{}) string {
+	for _, key := range listKeys {
+		if uniqueKey(old, key) && uniqueKey(new, key) {
+			return key
+		}
+	}
+	return ""
+}
+
+// keyedEntries indexes the entries of list by key returning them with their keys in list order
+func keyedEntries(list []interface{}, key string) (map[string]interface{}, []string) {
+	entries := make(map[string]interface{})
+	var order []string
+	for _, item := range list {
+		value := fmt.Sprint(item.(map[interface{}]interface{})[key])
+		entries[value] = item
+		order = append(order, value)
+	}
+	return entries, order
+}
+
+// compareValues appends the differences between old and new below path to out
+func compareValues(path string, old interface{}, new interface{}, out *[]difference) {
+	switch {
+	case old == nil && new == nil:
+		return
+	case old == nil:
+		*out = append(*out, difference{Path: path, Change: changeAdded, New: new})
+		return
+	case new == nil:
+		*out = append(*out, difference{Path: path, Change: changeRemoved, Old: old})
+		return
+	}
+
+	oldMap, oldIsMap := old.(map[interface{}]interface{})
+	newMap, newIsMap := new.(map[interface{}]interface{})
+	if oldIsMap && newIsMap {
+		keys := sortedKeys(oldMap)
+		for _, k := range sortedKeys(newMap) {
+			if _, ok := oldMap[k]; !ok {
+				keys = append(keys, k)
+			}
+		}
+		sort.SliceStable(keys, func(i, j int) bool { return fmt.Sprint(keys[i]) < fmt.Sprint(keys[j]) })
+		for _, k := range keys {
+			compareValues(joinPath(path, fmt.Sprint(k)), oldMap[k], newMap[k], out)
+		}
+		return
+	}
+
+	oldList, oldIsList := old.([]interface{})
+	newList, newIsList := new.([]interface{})
+	if oldIsList && newIsList {
+		key := listKey(oldList, newList)
+		if key == "" {
+			for i := 0; i < len(oldList) || i < len(newList); i++ {
+				var o, n interface{}
+				if i < len(oldList) {
+					o = oldList[i]
+				}
+				if i < len(newList) {
+					n = newList[i]
+				}
+				compareValues(fmt.Sprintf("%s[%d]", path, i), o, n, out)
+			}
+			return
+		}
+
+		// Entries are compared in their old order followed by new ones so reordering a list
+		// isn't a change
+		oldEntries, order := keyedEntries(oldList, key)
+		newEntries, newOrder := keyedEntries(newList, key)
+		for _, value := range newOrder {
+			if _, ok := oldEntries[value]; !ok {
+				order = append(order, value)
+			}
+		}
+		for _, value := range order {
+			compareValues(fmt.Sprintf("%s[%s=%s]", path, key, value), oldEntries[value], newEntries[value], out)
+		}
+		return
+	}
+
+	if !reflect.DeepEqual(old, new) {
+		*out = append(*out, difference{Path: path, Change: changeChanged, Old: old, New: new})
+	}
+}
+
+// diffDocuments compares old and new by resource identity ordering the result by resource
+func diffDocuments(oldByKey map[string]map[interface{}]interface{}, newByKey map[string]map[interface{}]interface{}) []resourceDiff {
+
+	var out []resourceDiff
+	for key, doc := range oldByKey {
+		newDoc, ok := newByKey[key]
+		if !ok {
+			out = append(out, resourceDiff{Resource: key, Change: changeRemoved})
+			continue
+		}
+
+		var differences []difference
+		compareValues("", doc, newDoc, &differences)
+		if len(differences) > 0 {
+			out = append(out, resourceDiff{Resource: key, Change: changeChanged, Differences: differences})
+		}
+	}
+	for key := range newByKey {
+		if _, ok := oldByKey[key]; !ok {
+			out = append(out, resourceDiff{Resource: key, Change: changeAdded})
+		}
+	}
+
+	sort.Slice(out, func(i, j int) bool { return out[i].Resource < out[j].Resource })
+	return out
+}
+
+// formatValue formats v as JSON so strings and numbers can be told apart in text output
+func formatValue(v interface{}) string {
+	out, err := json.Marshal(toJSONValue(v))
+	if err != nil {
+		return fmt.Sprint(v)
+	}
+	return string(out)
+}
+
+// formatDifference formats a difference as a line of text, e.g. "~ spec.replicas: 1 -> 2"
+func formatDifference(d difference) string {
+	switch d.Change {
+	case changeAdded:
+		return fmt.Sprintf("+ %s: %s", d.Path, formatValue(d.New))
+	case changeRemoved:
+		return fmt.Sprintf("- %s: %s", d.Path, formatValue(d.Old))
+	default:
+		return fmt.Sprintf("~ %s: %s -> %s", d.Path, formatValue(d.Old), formatValue(d.New))
+	}
+}
+
+func writeDiffText(diffs []resourceDiff, output io.Writer) error {
+	symbols := map[string]string{changeAdded: "+", changeRemoved: "-", changeChanged: "~"}
+
+	var buf bytes.Buffer
+	for _, d := range diffs {
+		fmt.Fprintf(&buf, "%s %s\n", symbols[d.Change], d.Resource)
+		for _, diff := range d.Differences {
+			fmt.Fprintf(&buf, "    %s\n", formatDifference(diff))
+		}
+	}
+	_, err := output.Write(buf.Bytes())
+	return err
+}
+
+func writeDiffJSON(diffs []resourceDiff, output io.Writer) error {
+	if diffs == nil {
+		diffs = []resourceDiff{}
+	}
+	for i := range diffs {
+		for j := range diffs[i].Differences {
+			diff := &diffs[i].Differences[j]
+			diff.Old, diff.New = toJSONValue(diff.Old), toJSONValue(diff.New)
+		}
+	}
+
+	encoder := json.NewEncoder(output)
+	encoder.SetIndent("", "  ")
+	return encoder.Encode(diffs)
+}
+
+// Diff compares the documents in oldFile and newFile after applying opts to both, matching them
+// by resource identity. Only selected documents are compared. Changed resources list the paths
+// that differ with list entries matched by key where they have one, e.g. containers by name.
+// The diff is written to output as text or json and Diff reports whether there were changes.
+func Diff(oldFile string, newFile string, opts Options, format string, output io.Writer) (bool, error) {
+	switch format {
+	case "":
+		format = diffText
+	case diffText, diffJSON:
+	default:
+		err := fmt.Errorf("unknown diff format '%s': expected %s or %s", format, diffText, diffJSON)
+		return false, merry.Wrap(err).WithUserMessagef("%s", err)
+	}
+
+	opts.OnlySelected = true
+	var byKey [2]map[string]map[interface{}]interface{}
+	for i, file := range []string{oldFile, newFile} {
+		docs, err := loadDocuments([]string{file}, opts)
+		if err != nil {
+			return false, err
+		}
+		if byKey[i], err = documentsByKey(docs, file); err != nil {
+			return false, merry.Wrap(err).WithUserMessagef("%s", err)
+		}
+	}
+
+	var err error
+	diffs := diffDocuments(byKey[0], byKey[1])
+	if format == diffJSON {
+		err = writeDiffJSON(diffs, output)
+	} else {
+		err = writeDiffText(diffs, output)
+	}
+	if err != nil {
+		return false, merry.Wrap(err).WithUserMessagef("error writing diff: %s", err)
+	}
+	return len(diffs) > 0, nil
+}
@@ -0,0 +1,232 @@
+package kpatch
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"strconv"
+	"strings"
+
+	"github.com/ansel1/merry"
+	yaml "gopkg.in/yaml.v2"
+)
+
+// Annotations kustomize uses to map resources back to the files they came from. The internal
+// ones replaced the others in kustomize v4.
+var (
+	pathAnnotations  = []string{"internal.config.kubernetes.io/path", "config.kubernetes.io/path"}
+	indexAnnotations = []string{"internal.config.kubernetes.io/index", "config.kubernetes.io/index"}
+)
+
+func annotation(doc map[interface{}]interface{}, names []string) string {
+	annotations := mapAt(doc, "metadata", "annotations")
+	for _, name := range names {
+		if value, ok := annotations[name].(string); ok {
+			return value
+		}
+	}
+	return ""
+}
+
+// fnConfig reads the rules from a function config. A ConfigMap may give a selector, actions
+// one per line and params as its other keys. Any other kind has a rules file as its spec.
+func fnConfig(functionConfig map[interface{}]interface{}) (*postRenderConfig, error) {
+	if functionConfig == nil {
+		return nil, fmt.Errorf("functionConfig is required")
+	}
+
+	if functionConfig["kind"] == "ConfigMap" {
+		rule := postRenderRule{}
+		c := &postRenderConfig{Params: make(map[string]string)}
+
+		data := mapAt(functionConfig, "data")
+		for _, k := range sortedKeys(data) {
+			key, value := fmt.Sprint(k), fmt.Sprint(data[k])
+			switch key {
+			case "selector":
+				rule.Selector = value
+			case "actions":
+				for _, line := range strings.Split(value, "\n") {
+					if strings.TrimSpace(line) != "" {
+						rule.Actions = append(rule.Actions, line)
+					}
+				}
+			default:
+				c.Params[key] = value
+			}
+		}
+
+		c.Rules = []postRenderRule{rule}
+		return c, nil
+	}
+
+	spec, ok := functionConfig["spec"]
+	if !ok {
+		return nil, fmt.Errorf("functionConfig %v has no spec", functionConfig["kind"])
+	}
+	specBytes, err := yaml.Marshal(spec)
+	if err != nil {
+		return nil, err
+	}
+	return parsePostRenderConfig(specBytes, "functionConfig")
+}
+
+// fnResult is an entry in the results of a ResourceList
+type fnResult struct {
+	Message     string            `yaml:"message"`
+	Severity    string            `yaml:"severity"`
+	ResourceRef map[string]string `yaml:"resourceRef,omitempty"`
+	File        *fnFile           `yaml:"file,omitempty"`
+}
+
+// fnFile is the file and index in it a result's resource came from
+type fnFile struct {
+	Path  string `yaml:"path"`
+	Index int    `yaml:"index"`
+}
+
+func failureResult(f assertionFailure) fnResult {
+	id := docID(f.doc)
+	result := fnResult{
+		Message:  f.message,
+		Severity: "error",
+		ResourceRef: map[string]string{
+			"apiVersion": fmt.Sprint(f.doc["apiVersion"]),
+			"kind":       id.kind,
+			"name":       id.name,
+		},
+	}
+	if id.namespace != "" {
+		result.ResourceRef["namespace"] = id.namespace
+	}
+
+	if path := annotation(f.doc, pathAnnotations); path != "" {
+		result.File = &fnFile{Path: path}
+		// The index annotation is a string, a missing or invalid one means the first document
+		result.File.Index, _ = strconv.Atoi(annotation(f.doc, indexAnnotations))
+	}
+	return result
+}
+
+// fnItems turns the items of a ResourceList in to a YAML stream Run can read
+func fnItems(items []interface{}) ([]byte, error) {
+	var buf bytes.Buffer
+	for _, item := range items {
+		out, err := yaml.Marshal(item)
+		if err != nil {
+			return nil, err
+		}
+		buf.WriteString("---\n")
+		buf.Write(out)
+	}
+	return buf.Bytes(), nil
+}
+
+// fnApply applies the rules in functionConfig to items returning their YAML and any warnings
+func fnApply(items []interface{}, functionConfig map[interface{}]interface{}) ([]byte, []fnResult, error) {
+	c, err := fnConfig(functionConfig)
+	if err != nil {
+		return nil, nil, err
+	}
+	content, err := fnItems(items)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	var warnings bytes.Buffer
+	content, err = c.apply(content, false, &warnings)
+
+	var results []fnResult
+	scanner := bufio.NewScanner(&warnings)
+	for scanner.Scan() {
+		results = append(results, fnResult{Message: strings.TrimPrefix(scanner.Text(), "warning: "), Severity: "warning"})
+	}
+	return content, results, err
+}
+
+// Fn runs kpatch as a KRM function. It reads a ResourceList from input, applies the rules in its
+// functionConfig to the items and writes the ResourceList back to output with warnings and failed
+// assertions as results. Items are left as they were when the rules fail. Annotations, including
+// those kustomize uses to map items back to files, are kept.
+func Fn(input io.Reader, output io.Writer) error {
+	inputBytes, err := ioutil.ReadAll(input)
+	if err != nil {
+		return merry.Wrap(err).WithUserMessagef("error reading ResourceList: %s", err)
+	}
+
+	resourceList := make(map[interface{}]interface{})
+	if err = yaml.Unmarshal(inputBytes, &resourceList); err != nil {
+		return merry.Wrap(err).WithUserMessagef("error parsing ResourceList: %s", err)
+	}
+	if resourceList["kind"] != "ResourceList" {
+		return merry.Errorf("expected a ResourceList but got %v", resourceList["kind"]).WithUserMessagef("expected a ResourceList but got %v", resourceList["kind"])
+	}
+
+	items, _ := resourceList["items"].([]interface{})
+	functionConfig, _ := resourceList["functionConfig"].(map[interface{}]interface{})
+
+	out, results, err := fnApply(items, functionConfig)
+
+	var message string
+	if err != nil {
+		if message = merry.UserMessage(err); message == "" {
+			message = err.Error()
+		}
+
+		if failures, ok := merry.Value(err, assertionsKey).([]assertionFailure); ok {
+			for _, f := range failures {
+				results = append(results, failureResult(f))
+			}
+		} else {
+			results = append(results, fnResult{Message: message, Severity: "error"})
+		}
+	} else {
+		items = []interface{}{}
+		for _, doc := range decodeDocuments(out) {
+			items = append(items, doc)
+		}
+	}
+
+	result := yaml.MapSlice{
+		{Key: "apiVersion", Value: resourceList["apiVersion"]},
+		{Key: "kind", Value: "ResourceList"},
+		{Key: "items", Value: items},
+	}
+	if functionConfig != nil {
+		result = append(result, yaml.MapItem{Key: "functionConfig", Value: functionConfig})
+	}
+	if len(results) > 0 {
+		result = append(result, yaml.MapItem{Key: "results", Value: results})
+	}
+
+	resultBytes, writeErr := yaml.Marshal(result)
+	if writeErr == nil {
+		_, writeErr = output.Write(resultBytes)
+	}
+	if writeErr != nil {
+		return merry.Wrap(writeErr).WithUserMessagef("error writing ResourceList: %s", writeErr)
+	}
+
+	if err != nil {
+		return merry.Wrap(err).WithUserMessagef("%s", message)
+	}
+	return nil
+}
+
+// decodeDocuments returns the non empty documents in a YAML stream
+func decodeDocuments(content []byte) []map[interface{}]interface{} {
+	var docs []map[interface{}]interface{}
+	decoder := yaml.NewDecoder(bytes.NewReader(content))
+	for {
+		doc := make(map[interface{}]interface{})
+		if err := decoder.Decode(&doc); err != nil {
+			break
+		}
+		if len(doc) > 0 {
+			docs = append(docs, doc)
+		}
+	}
+	return docs
+}
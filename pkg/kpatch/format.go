@@ -0,0 +1,329 @@
+package kpatch
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/ansel1/merry"
+	"github.com/spf13/afero"
+	yaml "gopkg.in/yaml.v2"
+	yamlv3 "gopkg.in/yaml.v3"
+)
+
+// leadingKeys are written first, in this order, when FormatOptions.SortKeys is set
+var leadingKeys = []string{"apiVersion", "kind", "metadata", "spec"}
+
+// FormatOptions controls how Format writes YAML
+type FormatOptions struct {
+	// Indent is the number of spaces each level is indented by. It defaults to 2.
+	Indent int
+	// SortKeys puts apiVersion, kind, metadata and spec first in each document
+	SortKeys bool
+	// Write rewrites files in place instead of writing them to output
+	Write bool
+	// Check writes the names of files that aren't formatted to output instead of formatting
+	// them and fails if there are any
+	Check bool
+}
+
+type formatter struct {
+	indent   int
+	sortKeys bool
+	schemas  *schemaSet
+}
+
+func newFormatter(opts Options, format FormatOptions) (*formatter, error) {
+	f := &formatter{indent: format.Indent, sortKeys: format.SortKeys}
+	if f.indent == 0 {
+		f.indent = 2
+	}
+	if f.indent < 2 || f.indent > 9 {
+		return nil, fmt.Errorf("indent must be between 2 and 9 spaces")
+	}
+
+	var err error
+	f.schemas, err = loadSchemas(Options{KubeVersion: opts.KubeVersion, Schemas: opts.Schemas}, Stderr)
+	return f, err
+}
+
+// stringField reports whether def is a field that only accepts strings
+func stringField(def *schema) bool {
+	return def != nil && def.Type == "string" && !def.IntOrString && def.Format != "int-or-string" && def.Format != "quantity"
+}
+
+// readsAsString reports whether a YAML 1.1 (yaml.v2) and a YAML 1.2 (yaml.v3) parser both read
+// text written as a plain scalar as the string text
+func readsAsString(text string) bool {
+	var v1, v2 interface{}
+	if yaml.Unmarshal([]byte(text), &v1) != nil || yamlv3.Unmarshal([]byte(text), &v2) != nil {
+		return false
+	}
+	return v1 == text && v2 == text
+}
+
+// stringStyle returns the style a string is written in: plain unless it would be read as
+// something else, e.g. "yes", "1.10" or "0755", then double quoted
+func stringStyle(value string) yamlv3.Style {
+	if readsAsString(value) {
+		return 0
+	}
+	return yamlv3.DoubleQuotedStyle
+}
+
+// normalizeScalar sets the style of a scalar. Quoted strings are only quoted when they must be.
+// Plain values are quoted when def is a string field and otherwise written as yaml.v2, and so
+// Kubernetes, reads them when YAML 1.1 and 1.2 disagree, e.g. "yes" becomes true.
+func normalizeScalar(node *yamlv3.Node, def *schema) {
+	if node.Style&(yamlv3.TaggedStyle|yamlv3.LiteralStyle|yamlv3.FoldedStyle) != 0 || strings.Contains(node.Value, "\n") {
+		return
+	}
+	if node.Style&(yamlv3.SingleQuotedStyle|yamlv3.DoubleQuotedStyle) != 0 {
+		node.Style = stringStyle(node.Value)
+		return
+	}
+
+	var v1, v2 interface{}
+	if yaml.Unmarshal([]byte(node.Value), &v1) != nil || node.Decode(&v2) != nil {
+		return
+	}
+
+	switch {
+	case v1 == nil:
+	case stringField(def):
+		if !readsAsString(node.Value) {
+			node.Tag, node.Style = "!!str", yamlv3.DoubleQuotedStyle
+		}
+		return
+	case reflect.DeepEqual(v1, v2):
+		return
+	}
+
+	switch v := v1.(type) {
+	case nil:
+		if v2 != nil {
+			node.Tag, node.Value = "!!null", "null"
+		}
+	case bool:
+		node.Tag, node.Value = "!!bool", strconv.FormatBool(v)
+	case int, int64, uint64:
+		node.Tag, node.Value = "!!int", fmt.Sprint(v)
+	case float64:
+		node.Tag, node.Value = "!!float", strconv.FormatFloat(v, 'g', -1, 64)
+	case string:
+		node.Tag, node.Style = "!!str", stringStyle(v)
+	}
+}
+
+// normalize formats node, the value at keys in doc, and everything below it in block style
+func (f *formatter) normalize(node *yamlv3.Node, doc map[interface{}]interface{}, keys []string) {
+	switch node.Kind {
+	case yamlv3.MappingNode:
+		node.Style &^= yamlv3.FlowStyle
+		for i := 0; i+1 < len(node.Content); i += 2 {
+			key := node.Content[i]
+			if key.Style&(yamlv3.SingleQuotedStyle|yamlv3.DoubleQuotedStyle) != 0 {
+				key.Style = stringStyle(key.Value)
+			}
+			value := node.Content[i+1]
+			if value.Style&yamlv3.FlowStyle != 0 && key.LineComment == "" {
+				// A comment after a flow list would end up after the last entry of the block list
+				key.LineComment, value.LineComment = value.LineComment, ""
+			}
+			f.normalize(value, doc, append(keys[:len(keys):len(keys)], key.Value))
+		}
+	case yamlv3.SequenceNode:
+		node.Style &^= yamlv3.FlowStyle
+		for i, item := range node.Content {
+			f.normalize(item, doc, append(keys[:len(keys):len(keys)], strconv.Itoa(i)))
+		}
+	case yamlv3.ScalarNode:
+		normalizeScalar(node, f.schemas.fieldSchema(doc, keys))
+	}
+}
+
+// sortKeys moves the leadingKeys of a mapping to the front keeping the order of the rest
+func sortKeys(node *yamlv3.Node) {
+	if node.Kind != yamlv3.MappingNode {
+		return
+	}
+
+	rank := func(key *yamlv3.Node) int {
+		for i, leading := range leadingKeys {
+			if key.Value == leading {
+				return i
+			}
+		}
+		return len(leadingKeys)
+	}
+
+	var pairs [][2]*yamlv3.Node
+	for i := 0; i+1 < len(node.Content); i += 2 {
+		pairs = append(pairs, [2]*yamlv3.Node{node.Content[i], node.Content[i+1]})
+	}
+	if len(pairs) == 0 {
+		return
+	}
+
+	// A comment at the top of the document stays at the top
+	head := pairs[0][0].HeadComment
+	pairs[0][0].HeadComment = ""
+	sort.SliceStable(pairs, func(i, j int) bool { return rank(pairs[i][0]) < rank(pairs[j][0]) })
+	if first := pairs[0][0]; head != "" {
+		if first.HeadComment != "" {
+			head += "\n" + first.HeadComment
+		}
+		first.HeadComment = head
+	}
+
+	node.Content = node.Content[:0]
+	for _, pair := range pairs {
+		node.Content = append(node.Content, pair[0], pair[1])
+	}
+}
+
+// emptyDocument reports whether doc has no content or comments, e.g. between "---" "---"
+func emptyDocument(doc *yamlv3.Node) bool {
+	if doc.HeadComment != "" || doc.FootComment != "" {
+		return false
+	}
+	for _, node := range doc.Content {
+		if node.Tag != "!!null" || node.Value != "" || node.HeadComment != "" || node.LineComment != "" || node.FootComment != "" {
+			return false
+		}
+	}
+	return true
+}
+
+// format returns content in canonical form. Documents are separated by "---" without one at
+// the start and empty documents are dropped. Comments are kept.
+func (f *formatter) format(content []byte) ([]byte, error) {
+	var nodes []*yamlv3.Node
+	var docs []map[interface{}]interface{}
+
+	decoder := yamlv3.NewDecoder(bytes.NewReader(content))
+	for {
+		node := &yamlv3.Node{}
+		err := decoder.Decode(node)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		if emptyDocument(node) {
+			continue
+		}
+
+		// Schemas are looked up with the values yaml.v2 reads like everywhere else
+		out, err := yamlv3.Marshal(node)
+		if err != nil {
+			return nil, err
+		}
+		doc := make(map[interface{}]interface{})
+		if err = yaml.Unmarshal(out, &doc); err != nil {
+			// Documents that aren't maps, e.g. a list, have no schema and are formatted without one
+			doc = make(map[interface{}]interface{})
+		}
+
+		nodes = append(nodes, node)
+		docs = append(docs, doc)
+	}
+
+	// CRDs are added first so custom resources before them are formatted with their schema
+	for _, doc := range docs {
+		if err := f.schemas.addCRD(doc); err != nil {
+			return nil, err
+		}
+	}
+
+	var buf bytes.Buffer
+	encoder := yamlv3.NewEncoder(&buf)
+	encoder.SetIndent(f.indent)
+	for i, node := range nodes {
+		for _, content := range node.Content {
+			f.normalize(content, docs[i], nil)
+			if f.sortKeys {
+				sortKeys(content)
+			}
+		}
+		if err := encoder.Encode(node); err != nil {
+			return nil, err
+		}
+	}
+	if err := encoder.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// Format writes files ("-" or none for stdin) in a canonical YAML format to output: consistent
+// indentation, sequences indented under their key, block style, strings only quoted when they
+// must be and values YAML 1.1 and 1.2 parsers read differently written unambiguously. Plain
+// values in string fields of the Kubernetes or CRD schema are quoted as written so a label of
+// 1.10 stays "1.10". Files are rewritten in place with Write and only checked with Check. Only the
+// KubeVersion and Schemas of opts are used, to find string fields.
+func Format(files []string, opts Options, format FormatOptions, output io.Writer) error {
+	f, err := newFormatter(opts, format)
+	if err != nil {
+		return merry.Wrap(err).WithUserMessagef("%s", err)
+	}
+
+	if len(files) == 0 {
+		files = []string{"-"}
+	}
+
+	var unformatted []string
+	for i, file := range files {
+		input, err := inputReaderFn([]string{file})()
+		if err != nil {
+			return merry.Wrap(err).WithUserMessagef("error reading '%s': %s", file, err)
+		}
+		content, err := ioutil.ReadAll(input)
+		if err != nil {
+			return merry.Wrap(err).WithUserMessagef("error reading '%s': %s", file, err)
+		}
+
+		formatted, err := f.format(content)
+		if err != nil {
+			return merry.Wrap(err).WithUserMessagef("error formatting '%s': %s", file, err)
+		}
+
+		switch {
+		case format.Check:
+			if !bytes.Equal(content, formatted) {
+				unformatted = append(unformatted, file)
+				_, err = fmt.Fprintln(output, file)
+			}
+		case format.Write && file != "-":
+			if !bytes.Equal(content, formatted) {
+				stat, statErr := Fs.Stat(file)
+				if statErr != nil {
+					return merry.Wrap(statErr).WithUserMessagef("error writing '%s': %s", file, statErr)
+				}
+				err = afero.WriteFile(Fs, file, formatted, stat.Mode())
+			}
+		default:
+			if i > 0 && len(formatted) > 0 {
+				_, err = io.WriteString(output, "---\n")
+			}
+			if err == nil {
+				_, err = output.Write(formatted)
+			}
+		}
+		if err != nil {
+			return merry.Wrap(err).WithUserMessagef("error writing '%s': %s", file, err)
+		}
+	}
+
+	if len(unformatted) > 0 {
+		err := fmt.Errorf("%d of %d files aren't formatted, run kpatch fmt -w to format them", len(unformatted), len(files))
+		return merry.Wrap(err).WithUserMessagef("%s", err)
+	}
+	return nil
+}
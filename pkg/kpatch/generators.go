@@ -0,0 +1,307 @@
+package kpatch
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"path/filepath"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/ansel1/merry"
+	"github.com/spf13/afero"
+	yaml "gopkg.in/yaml.v2"
+)
+
+// generatedSource is the source reported for documents created by --configmap and --secret
+const generatedSource = "generated"
+
+// parseGenerator splits a name=path[,path...] generator flag
+func parseGenerator(spec string) (string, []string, error) {
+	parts := strings.SplitN(spec, "=", 2)
+	if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+		return "", nil, fmt.Errorf("error parsing generator '%s': expected name=path[,path...]", spec)
+	}
+	return parts[0], strings.Split(parts[1], ","), nil
+}
+
+// readGeneratorFiles reads the entries for a generated ConfigMap or Secret.
+// Directories contribute each regular file in them keyed by file name, .env files contribute
+// each KEY=VALUE line and any other file contributes its content keyed by its name.
+func readGeneratorFiles(paths []string) (map[string][]byte, error) {
+	out := make(map[string][]byte)
+	add := func(key string, value []byte, path string) error {
+		if _, ok := out[key]; ok {
+			return fmt.Errorf("key '%s' from '%s' is already defined", key, path)
+		}
+		out[key] = value
+		return nil
+	}
+
+	for _, path := range paths {
+		info, err := Fs.Stat(path)
+		if err != nil {
+			return nil, err
+		}
+
+		if info.IsDir() {
+			entries, err := afero.ReadDir(Fs, path)
+			if err != nil {
+				return nil, err
+			}
+			for _, entry := range entries {
+				if !entry.Mode().IsRegular() {
+					continue
+				}
+				file := filepath.Join(path, entry.Name())
+				content, err := afero.ReadFile(Fs, file)
+				if err != nil {
+					return nil, err
+				}
+				if err = add(entry.Name(), content, file); err != nil {
+					return nil, err
+				}
+			}
+			continue
+		}
+
+		content, err := afero.ReadFile(Fs, path)
+		if err != nil {
+			return nil, err
+		}
+
+		if filepath.Ext(path) != ".env" {
+			if err = add(filepath.Base(path), content, path); err != nil {
+				return nil, err
+			}
+			continue
+		}
+
+		env, err := parseEnvFile(content, path)
+		if err != nil {
+			return nil, err
+		}
+		for key, value := range env {
+			if err = add(key, []byte(value), path); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	return out, nil
+}
+
+// parseEnvFile parses KEY=VALUE lines removing matching quotes around VALUE. Blank lines and
+// lines starting with # are ignored. A key may only be given once.
+func parseEnvFile(content []byte, path string) (map[string]string, error) {
+	out := make(map[string]string)
+	scanner := bufio.NewScanner(bytes.NewReader(content))
+	line := 0
+	for scanner.Scan() {
+		line++
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" || strings.HasPrefix(text, "#") {
+			continue
+		}
+
+		parts := strings.SplitN(text, "=", 2)
+		if len(parts) != 2 || strings.TrimSpace(parts[0]) == "" {
+			return nil, fmt.Errorf("error parsing '%s' line %d: expected KEY=VALUE", path, line)
+		}
+		key := strings.TrimSpace(parts[0])
+		if _, ok := out[key]; ok {
+			return nil, fmt.Errorf("error parsing '%s' line %d: key '%s' is already defined", path, line, key)
+		}
+		out[key] = unquote(parts[1])
+	}
+	return out, scanner.Err()
+}
+
+// unquote removes matching single or double quotes around value
+func unquote(value string) string {
+	if len(value) >= 2 && (value[0] == '"' || value[0] == '\'') && value[len(value)-1] == value[0] {
+		return value[1 : len(value)-1]
+	}
+	return value
+}
+
+func generatedDoc(kind string, name string) map[interface{}]interface{} {
+	return map[interface{}]interface{}{
+		"apiVersion": "v1",
+		"kind":       kind,
+		"metadata": map[interface{}]interface{}{
+			"name": name,
+		},
+	}
+}
+
+// configMapFromFiles generates a ConfigMap. Content that is not valid UTF-8 goes in binaryData.
+func configMapFromFiles(name string, paths []string) (map[interface{}]interface{}, error) {
+	files, err := readGeneratorFiles(paths)
+	if err != nil {
+		return nil, fmt.Errorf("error generating ConfigMap '%s': %s", name, err)
+	}
+
+	doc := generatedDoc("ConfigMap", name)
+	data := make(map[interface{}]interface{})
+	binaryData := make(map[interface{}]interface{})
+	for key, content := range files {
+		if utf8.Valid(content) {
+			data[key] = string(content)
+		} else {
+			binaryData[key] = b64encode(string(content))
+		}
+	}
+
+	if len(data) > 0 {
+		doc["data"] = data
+	}
+	if len(binaryData) > 0 {
+		doc["binaryData"] = binaryData
+	}
+	return doc, nil
+}
+
+// secretFromFiles generates an Opaque Secret with base64 encoded data
+func secretFromFiles(name string, paths []string) (map[interface{}]interface{}, error) {
+	files, err := readGeneratorFiles(paths)
+	if err != nil {
+		return nil, fmt.Errorf("error generating Secret '%s': %s", name, err)
+	}
+
+	doc := generatedDoc("Secret", name)
+	doc["type"] = "Opaque"
+	data := make(map[interface{}]interface{})
+	for key, content := range files {
+		data[key] = b64encode(string(content))
+	}
+	doc["data"] = data
+	return doc, nil
+}
+
+// generateDocuments returns a YAML stream of the documents requested by --configmap and --secret
+func generateDocuments(configMaps []string, secrets []string) ([]byte, error) {
+	var docs []map[interface{}]interface{}
+	generators := []struct {
+		specs []string
+		fn    func(string, []string) (map[interface{}]interface{}, error)
+	}{
+		{configMaps, configMapFromFiles},
+		{secrets, secretFromFiles},
+	}
+
+	for _, g := range generators {
+		for _, spec := range g.specs {
+			name, paths, err := parseGenerator(spec)
+			if err != nil {
+				return nil, err
+			}
+			doc, err := g.fn(name, paths)
+			if err != nil {
+				return nil, err
+			}
+			docs = append(docs, doc)
+		}
+	}
+	return encodeDocuments(docs)
+}
+
+func encodeDocuments(docs []map[interface{}]interface{}) ([]byte, error) {
+	var buf bytes.Buffer
+	encoder := yaml.NewEncoder(&buf)
+	for _, doc := range docs {
+		if err := encoder.Encode(doc); err != nil {
+			return nil, err
+		}
+	}
+	encoder.Close()
+	return buf.Bytes(), nil
+}
+
+// generatedQueue holds the documents generated by actions until every input has been read
+// when they are read like another input. Each kind and name is only generated once so actions
+// that run on the documents they generated don't generate them forever.
+type generatedQueue struct {
+	docs []map[interface{}]interface{}
+	seen map[string]bool
+}
+
+func newGeneratedQueue() *generatedQueue {
+	return &generatedQueue{seen: make(map[string]bool)}
+}
+
+func (q *generatedQueue) add(doc map[interface{}]interface{}) {
+	key := fmt.Sprintf("%v/%v", doc["kind"], mapAt(doc, "metadata")["name"])
+	if !q.seen[key] {
+		q.seen[key] = true
+		q.docs = append(q.docs, doc)
+	}
+}
+
+// generatedInput returns a reader function that reads the documents queued in q once next is
+// exhausted, until no more are generated
+func generatedInput(next func() (io.Reader, error), q *generatedQueue) func() (io.Reader, error) {
+	return func() (io.Reader, error) {
+		input, err := next()
+		if input != nil || err != nil || len(q.docs) == 0 {
+			return input, err
+		}
+
+		content, err := encodeDocuments(q.docs)
+		q.docs = nil
+		if err != nil {
+			return nil, err
+		}
+		return bytes.NewReader(content), nil
+	}
+}
+
+// generatorArgs validates the (name, paths...) arguments of the *_from_files functions
+func generatorArgs(signature string, args []interface{}) (string, []string, error) {
+	if len(args) < 2 {
+		return "", nil, merry.Errorf("%s requires at least two arguments", signature)
+	}
+
+	name, ok := args[0].(string)
+	if !ok {
+		return "", nil, merry.Errorf("%s expects name to be a string", signature)
+	}
+
+	var paths []string
+	for _, arg := range args[1:] {
+		path, ok := arg.(string)
+		if !ok {
+			return "", nil, merry.Errorf("%s expects paths to be strings", signature)
+		}
+		paths = append(paths, path)
+	}
+	return name, paths, nil
+}
+
+func (s *kpatch) fnConfigMapFromFiles(args ...interface{}) (interface{}, error) {
+	name, paths, err := generatorArgs("configmap_from_files(name, paths...)", args)
+	if err != nil {
+		return nil, err
+	}
+	return s.generate(configMapFromFiles(name, paths))
+}
+
+func (s *kpatch) fnSecretFromFiles(args ...interface{}) (interface{}, error) {
+	name, paths, err := generatorArgs("secret_from_files(name, paths...)", args)
+	if err != nil {
+		return nil, err
+	}
+	return s.generate(secretFromFiles(name, paths))
+}
+
+// generate adds a document generated by an action to the stream
+func (s *kpatch) generate(doc map[interface{}]interface{}, err error) (interface{}, error) {
+	if err != nil {
+		return nil, err
+	}
+	if s.generated != nil {
+		s.generated.add(doc)
+	}
+	return doc, nil
+}
@@ -0,0 +1,148 @@
+package kpatch
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"sort"
+
+	yaml "gopkg.in/yaml.v2"
+)
+
+const (
+	// hashModeName appends the content hash to ConfigMap and Secret names
+	hashModeName = "name"
+	// hashModeAnnotation adds a checksum of referenced ConfigMaps and Secrets to pod templates
+	hashModeAnnotation = "annotation"
+
+	checksumAnnotation = "checksum/config"
+)
+
+// hashedKinds are the kinds whose content is hashed and the fields making up that content
+var hashedKinds = map[string][]string{
+	"ConfigMap": {"data", "binaryData"},
+	"Secret":    {"data", "stringData", "type"},
+}
+
+// contentHash returns a short hash of the content fields of a ConfigMap or Secret
+func contentHash(doc map[interface{}]interface{}) (string, error) {
+	content := make(map[interface{}]interface{})
+	for _, key := range hashedKinds[docID(doc).kind] {
+		content[key] = doc[key]
+	}
+
+	// yaml.Marshal sorts map keys so equal content always gives the same hash
+	b, err := yaml.Marshal(content)
+	if err != nil {
+		return "", err
+	}
+
+	sum := sha256.Sum256(b)
+	return hex.EncodeToString(sum[:])[:10], nil
+}
+
+type hashTransformer struct {
+	mode       string
+	references []nameReference
+}
+
+func newHashTransformer(mode string, references []nameReference) (*hashTransformer, error) {
+	if mode != hashModeName && mode != hashModeAnnotation {
+		return nil, fmt.Errorf("unknown hash mode '%s': expected %s or %s", mode, hashModeName, hashModeAnnotation)
+	}
+	return &hashTransformer{mode: mode, references: references}, nil
+}
+
+// hashable reports whether doc is a selected ConfigMap or Secret whose name can change
+func hashable(doc *document) bool {
+	id := docID(doc.data)
+	if _, ok := hashedKinds[id.kind]; !ok || !doc.selected || id.name == "" {
+		return false
+	}
+	// Token secrets are referenced by the service account controller, not by name
+	return doc.data["type"] != "kubernetes.io/service-account-token"
+}
+
+func (t *hashTransformer) transform(docs []*document) error {
+	hashes := make(map[resourceID]string)
+	for _, doc := range docs {
+		if !hashable(doc) {
+			continue
+		}
+
+		hash, err := contentHash(doc.data)
+		if err != nil {
+			return fmt.Errorf("error hashing %s: %s", docID(doc.data), err)
+		}
+		hashes[docID(doc.data)] = hash
+	}
+
+	if len(hashes) == 0 {
+		return nil
+	}
+
+	if t.mode == hashModeName {
+		renamed := make(map[resourceID]string)
+		for _, doc := range docs {
+			id := docID(doc.data)
+			if hash, ok := hashes[id]; ok {
+				renamed[id] = id.name + "-" + hash
+				doc.data["metadata"].(map[interface{}]interface{})["name"] = renamed[id]
+			}
+		}
+
+		for _, doc := range docs {
+			updateReferences(doc.data, t.references, renamed)
+		}
+		return nil
+	}
+
+	for _, doc := range docs {
+		annotatePodTemplate(doc.data, hashes, t.references)
+	}
+	return nil
+}
+
+// annotatePodTemplate sets the checksum annotation on the pod template of a workload to a hash
+// of every hashed document it refers to so that a change to any of them rolls the workload
+func annotatePodTemplate(doc map[interface{}]interface{}, hashes map[resourceID]string, references []nameReference) {
+	keys := podSpecKeys(doc["kind"])
+	if len(keys) < 2 {
+		// Bare pods can't be rolled
+		return
+	}
+
+	var referenced []string
+	eachReference(doc, references, func(target resourceID, parent map[interface{}]interface{}, key string) {
+		if hash, ok := hashes[target]; ok {
+			referenced = append(referenced, target.String()+"="+hash)
+		}
+	})
+
+	if len(referenced) == 0 {
+		return
+	}
+
+	sort.Strings(referenced)
+	sum := sha256.New()
+	for _, r := range referenced {
+		fmt.Fprintln(sum, r)
+	}
+
+	template := doc
+	for _, key := range keys[:len(keys)-1] {
+		template, _ = template[key].(map[interface{}]interface{})
+	}
+
+	metadata, ok := template["metadata"].(map[interface{}]interface{})
+	if !ok {
+		metadata = make(map[interface{}]interface{})
+		template["metadata"] = metadata
+	}
+	annotations, ok := metadata["annotations"].(map[interface{}]interface{})
+	if !ok {
+		annotations = make(map[interface{}]interface{})
+		metadata["annotations"] = annotations
+	}
+	annotations[checksumAnnotation] = hex.EncodeToString(sum.Sum(nil))
+}
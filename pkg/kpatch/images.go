@@ -0,0 +1,263 @@
+package kpatch
+
+import (
+	"fmt"
+	"io"
+	"path/filepath"
+	"strings"
+
+	"github.com/ansel1/merry"
+	"github.com/spf13/afero"
+	yaml "gopkg.in/yaml.v2"
+)
+
+// defaultRegistry is the registry used by image references that do not specify one
+const defaultRegistry = "docker.io"
+
+type imageRef struct {
+	Registry string
+	Path     string
+	Tag      string
+	Digest   string
+	implicit bool
+}
+
+// parseImage splits an image reference in to [registry/]path[:tag][@digest]
+func parseImage(image string) imageRef {
+	var ref imageRef
+
+	if i := strings.Index(image, "@"); i >= 0 {
+		ref.Digest = image[i+1:]
+		image = image[:i]
+	}
+
+	// A tag can only appear after the last / as registries may have a port
+	if i := strings.LastIndex(image, ":"); i > strings.LastIndex(image, "/") {
+		ref.Tag = image[i+1:]
+		image = image[:i]
+	}
+
+	parts := strings.SplitN(image, "/", 2)
+	if len(parts) == 2 && (strings.ContainsAny(parts[0], ".:") || parts[0] == "localhost") {
+		ref.Registry = parts[0]
+		ref.Path = parts[1]
+	} else {
+		ref.Registry = defaultRegistry
+		ref.Path = image
+		ref.implicit = true
+	}
+
+	return ref
+}
+
+// Name is the repository without tag or digest as it would be written in a manifest
+func (r imageRef) Name() string {
+	if r.implicit {
+		return r.Path
+	}
+	return r.Registry + "/" + r.Path
+}
+
+// lockKey is the fully qualified name:tag of ref used to look it up in a lockfile so that
+// nginx:1.25 and docker.io/library/nginx:1.25 are the same image
+func (r imageRef) lockKey() string {
+	path := r.Path
+	if r.Registry == defaultRegistry && !strings.Contains(path, "/") {
+		path = "library/" + path
+	}
+
+	key := r.Registry + "/" + path
+	if r.Tag != "" {
+		key += ":" + r.Tag
+	}
+	return key
+}
+
+func (r imageRef) String() string {
+	out := r.Name()
+	if r.Tag != "" {
+		out += ":" + r.Tag
+	}
+	if r.Digest != "" {
+		out += "@" + r.Digest
+	}
+	return out
+}
+
+type imageRule struct {
+	Registry    string `yaml:"registry"`
+	Name        string `yaml:"name"`
+	Tag         string `yaml:"tag"`
+	NewRegistry string `yaml:"newRegistry"`
+	NewName     string `yaml:"newName"`
+	NewTag      string `yaml:"newTag"`
+	Digest      string `yaml:"digest"`
+}
+
+// registryPath returns the rest of the path of ref when registry is a prefix of its registry
+// and path in whole path segments, e.g. registry.example.com/team of
+// registry.example.com/team/app
+func registryPath(registry string, ref imageRef) (string, bool) {
+	prefix := strings.TrimSuffix(registry, "/") + "/"
+	full := ref.Registry + "/" + ref.Path
+	if !strings.HasPrefix(full, prefix) {
+		return "", false
+	}
+	return full[len(prefix):], true
+}
+
+func (r imageRule) matches(ref imageRef) bool {
+	if _, ok := registryPath(r.Registry, ref); r.Registry != "" && !ok {
+		return false
+	}
+	if r.Name != "" && r.Name != ref.Name() {
+		return false
+	}
+	if r.Tag != "" && r.Tag != ref.Tag {
+		return false
+	}
+	return r.Registry != "" || r.Name != ""
+}
+
+func (r imageRule) apply(ref imageRef) imageRef {
+	if r.NewName != "" {
+		named := parseImage(r.NewName)
+		ref.Registry, ref.Path, ref.implicit = named.Registry, named.Path, named.implicit
+		ref.Digest = ""
+	}
+	if r.NewRegistry != "" {
+		// The part of the path matched by registry is replaced along with the registry
+		path := ref.Path
+		if rest, ok := registryPath(r.Registry, ref); r.Registry != "" && r.NewName == "" && ok {
+			path = rest
+		}
+		parts := strings.SplitN(strings.TrimSuffix(r.NewRegistry, "/"), "/", 2)
+		ref.Registry = parts[0]
+		ref.Path = path
+		if len(parts) == 2 {
+			ref.Path = parts[1] + "/" + path
+		}
+		ref.implicit = false
+	}
+	if r.NewTag != "" {
+		ref.Tag = r.NewTag
+		ref.Digest = ""
+	}
+	if r.Digest != "" {
+		ref.Digest = r.Digest
+	}
+	return ref
+}
+
+type imageConfig struct {
+	Images   []imageRule `yaml:"images"`
+	Lockfile string      `yaml:"lockfile"`
+	digests  map[string]string
+}
+
+func getImageConfig(input string) (*imageConfig, error) {
+	config := &imageConfig{}
+
+	configBytes, err := getInputBytes(input)
+	if err != nil {
+		return nil, fmt.Errorf("error loading images config '%s': %s", input, err)
+	}
+
+	err = yaml.UnmarshalStrict(configBytes, config)
+	if err != nil {
+		return nil, fmt.Errorf("error parsing images config '%s': %s", input, err)
+	}
+
+	if config.Lockfile != "" {
+		// The lockfile is next to the config unless the config is inline
+		if _, err := Fs.Stat(input); err == nil && !filepath.IsAbs(config.Lockfile) {
+			config.Lockfile = filepath.Join(filepath.Dir(input), config.Lockfile)
+		}
+
+		lockBytes, err := afero.ReadFile(Fs, config.Lockfile)
+		if err != nil {
+			return nil, fmt.Errorf("error loading image lockfile '%s': %s", config.Lockfile, err)
+		}
+
+		var digests map[string]string
+		err = yaml.Unmarshal(lockBytes, &digests)
+		if err != nil {
+			return nil, fmt.Errorf("error parsing image lockfile '%s': %s", config.Lockfile, err)
+		}
+
+		config.digests = make(map[string]string, len(digests))
+		for image, digest := range digests {
+			key := parseImage(image).lockKey()
+			if existing, ok := config.digests[key]; ok && existing != digest {
+				return nil, fmt.Errorf("image lockfile '%s' has more than one digest for '%s'", config.Lockfile, key)
+			}
+			config.digests[key] = digest
+		}
+	}
+
+	return config, nil
+}
+
+// rewrite applies the first matching rule to image and pins it to a digest if there is a lockfile
+func (c *imageConfig) rewrite(image string) (string, error) {
+	ref := parseImage(image)
+	for _, rule := range c.Images {
+		if rule.matches(ref) {
+			ref = rule.apply(ref)
+			break
+		}
+	}
+
+	if c.digests != nil && ref.Digest == "" {
+		digest, ok := c.digests[ref.lockKey()]
+		if !ok {
+			name := ref.Name()
+			if ref.Tag != "" {
+				name += ":" + ref.Tag
+			}
+			return "", merry.Errorf("image '%s' is not in lockfile '%s'", name, c.Lockfile)
+		}
+		ref.Digest = digest
+	}
+
+	return ref.String(), nil
+}
+
+// rewriteImages rewrites the image of every container in a workload document
+func (c *imageConfig) rewriteImages(doc map[interface{}]interface{}) error {
+	spec := podSpec(doc)
+	if spec == nil {
+		return nil
+	}
+
+	for _, container := range containers(spec, "") {
+		image, ok := container["image"].(string)
+		if !ok {
+			continue
+		}
+
+		rewritten, err := c.rewrite(image)
+		if err != nil {
+			return err
+		}
+		container["image"] = rewritten
+	}
+	return nil
+}
+
+// listImages writes a line for every container image reference in a workload document
+func listImages(doc map[interface{}]interface{}, output io.Writer) error {
+	spec := podSpec(doc)
+	if spec == nil {
+		return nil
+	}
+
+	metadata, _ := doc["metadata"].(map[interface{}]interface{})
+	for _, container := range containers(spec, "") {
+		_, err := fmt.Fprintf(output, "%v\t%v/%v\t%v\n", container["image"], doc["kind"], metadata["name"], container["name"])
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -1,10 +1,15 @@
 package kpatch
 
 import (
+	"context"
 	"encoding/base64"
 	"fmt"
+	"io"
 	"reflect"
+	"strings"
 
+	"filippo.io/age"
+	"github.com/PaesslerAG/gval"
 	"github.com/ansel1/merry"
 	"github.com/mikesimons/traverser"
 	yaml "gopkg.in/yaml.v2"
@@ -16,6 +21,20 @@ type kpatch struct {
 	drop           bool
 	doc            map[interface{}]interface{}
 	currentItem    interface{}
+	strict         bool
+	params         map[string]string
+	source         string
+	index          int
+	lang           gval.Language
+	identities     []age.Identity
+	schemas        *schemaSet
+	failures       *[]assertionFailure
+	trace          *tracer
+	log            io.Writer
+	// generated queues documents generated by actions to be read after the inputs
+	generated *generatedQueue
+	// assignPath is the path of the last key selected for assignment or nil if it isn't in doc
+	assignPath []string
 }
 
 func (s *kpatch) Reset() {
@@ -24,6 +43,127 @@ func (s *kpatch) Reset() {
 	s.drop = false
 	s.doc = make(map[interface{}]interface{})
 	s.currentItem = nil
+	s.assignPath = nil
+}
+
+// docName identifies the current document in error messages
+func (s *kpatch) docName() string {
+	return fmt.Sprintf("document %d of '%s'", s.index, s.source)
+}
+
+func (s *kpatch) selectVar(path gval.Evaluables) gval.Evaluable {
+	return func(c context.Context, v interface{}) (interface{}, error) {
+		var root interface{}
+		keys, _ := path.EvalStrings(c, v)
+		root = s.doc
+
+		name := keys
+		if keys[0] == "@" {
+			root = s.currentItem
+			keys = keys[1:]
+		}
+
+		if s.missingKeyMode == "set" {
+			s.assignPath = nil
+			if reflect.ValueOf(root) == reflect.ValueOf(s.doc) {
+				s.assignPath = keys
+			}
+		}
+
+		if len(keys) == 0 {
+			return root, nil
+		}
+
+		val, err := traverser.GetKey(&root, keys)
+
+		if err != nil && s.missingKeyMode == "set" {
+			err := traverser.SetKey(&root, keys, "")
+			if err != nil {
+				return nil, err
+			}
+			return traverser.GetKey(&root, keys)
+		}
+
+		if err != nil && s.strict {
+			return nil, merry.Errorf("key '%s' does not exist in %s", strings.Join(keys, "."), s.docName())
+		}
+
+		if s.trace != nil && s.missingKeyMode == "get" {
+			s.trace.read(name, val)
+		}
+		return val, nil
+	}
+}
+
+// pathArg accepts a path as either a dotted string or a slice of keys
+func pathArg(arg interface{}) ([]string, bool) {
+	switch path := arg.(type) {
+	case string:
+		return strings.Split(path, "."), true
+	case []interface{}:
+		var keys []string
+		for _, key := range path {
+			keys = append(keys, fmt.Sprintf("%v", key))
+		}
+		return keys, true
+	}
+	return nil, false
+}
+
+// lookupPath returns the value at keys in the document or, when keys start with "@", in the
+// current item like selectVar
+func (s *kpatch) lookupPath(keys []string) (interface{}, error) {
+	var root interface{} = s.doc
+	if len(keys) > 0 && keys[0] == "@" {
+		root = s.currentItem
+		keys = keys[1:]
+	}
+	if len(keys) == 0 {
+		return root, nil
+	}
+	return traverser.GetKey(&root, keys)
+}
+
+func (s *kpatch) fnHas(args ...interface{}) (interface{}, error) {
+	if len(args) != 1 {
+		return nil, merry.Errorf("has(path) requires exactly one argument")
+	}
+	keys, ok := pathArg(args[0])
+	if !ok {
+		return nil, merry.Errorf("has(path) expects path to be a string or slice")
+	}
+	_, err := s.lookupPath(keys)
+	return err == nil, nil
+}
+
+func (s *kpatch) fnGet(args ...interface{}) (interface{}, error) {
+	if len(args) != 2 {
+		return nil, merry.Errorf("get(path, default) requires exactly two arguments")
+	}
+	keys, ok := pathArg(args[0])
+	if !ok {
+		return nil, merry.Errorf("get(path, default) expects path to be a string or slice")
+	}
+	val, err := s.lookupPath(keys)
+	if err != nil || val == nil {
+		return args[1], nil
+	}
+	return val, nil
+}
+
+func (s *kpatch) fnParam(args ...interface{}) (interface{}, error) {
+	if len(args) != 1 {
+		return nil, merry.Errorf("param(name) requires exactly one argument")
+	}
+	name, ok := args[0].(string)
+	if !ok {
+		return nil, merry.Errorf("param(name) expects name to be a string")
+	}
+	val, ok := s.params[name]
+	if !ok {
+		return nil, merry.Errorf("param '%s' was not provided", name)
+	}
+	return val, nil
 }
 
 func (s *kpatch) fnUnset(args ...interface{}) (interface{}, error) {
@@ -31,7 +171,7 @@ func (s *kpatch) fnUnset(args ...interface{}) (interface{}, error) {
 		return nil, merry.Errorf("unset(var, ...) requires one or more argument to unset")
 	}
 	for _, arg := range args {
-		s.targets = append(s.targets, tTarget{opFn: traverser.Unset, target: reflect.ValueOf(arg)})
+		s.targets = append(s.targets, tTarget{opFn: traverser.Unset, target: reflect.ValueOf(arg), op: "unset"})
 	}
 	return nil, nil
 }
@@ -111,5 +251,9 @@ func (s *kpatch) fnB64Encode(args ...interface{}) (interface{}, error) {
 	if !ok {
 		return nil, merry.Errorf("b64encode(input) expects input to be a string")
 	}
-	return base64.StdEncoding.EncodeToString([]byte(input)), nil
+	return b64encode(input), nil
+}
+
+func b64encode(input string) string {
+	return base64.StdEncoding.EncodeToString([]byte(input))
 }
@@ -2,8 +2,11 @@ package kpatch
 
 import (
 	"bytes"
+	"encoding/json"
+	"fmt"
 	"io/ioutil"
 	"os"
+	"strconv"
 	"strings"
 	"testing"
 
@@ -16,11 +19,8 @@ import (
 )
 
 type RunParams struct {
-	Files    []string
-	Selector string
-	Merges   []string
-	Actions  []string
-	Params   []string
+	Files []string
+	Options
 }
 
 func DefaultRunParams() RunParams {
@@ -41,7 +41,7 @@ func dorun(fn func(rp *RunParams)) ([]byte, error) {
 	rp := DefaultRunParams()
 	fn(&rp)
 
-	e := Run(rp.Files, rp.Selector, rp.Merges, rp.Actions, rp.Params, f)
+	e := Run(rp.Files, rp.Options, f)
 	f.Close()
 
 	f, _ = fs.Open("output.yaml")
@@ -67,6 +67,29 @@ func decodeDocs(input []byte) []map[interface{}]interface{} {
 	return docs
 }
 
+// lookup returns the value at path in doc where list elements are addressed by index
+func lookup(doc interface{}, path ...string) interface{} {
+	for _, key := range path {
+		switch v := doc.(type) {
+		case map[interface{}]interface{}:
+			doc = v[key]
+		case []interface{}:
+			i, _ := strconv.Atoi(key)
+			if i >= len(v) {
+				return nil
+			}
+			doc = v[i]
+		default:
+			return nil
+		}
+	}
+	return doc
+}
+
+func containersOf(doc map[interface{}]interface{}) []map[interface{}]interface{} {
+	return containers(podSpec(doc), "")
+}
+
 var _ = Describe("Kpatch", func() {
 	Describe("deepCopy", func() {
 		It("should create a deep copy of a map[interface{}]interface{}", func() {
@@ -114,6 +137,61 @@ var _ = Describe("Kpatch", func() {
 		})
 	})
 
+	Describe("parseImage", func() {
+		It("should split registry, path, tag and digest", func() {
+			ref := parseImage("registry.example.com:5000/team/app:1.0@sha256:abcd")
+			Expect(ref.Registry).To(Equal("registry.example.com:5000"))
+			Expect(ref.Path).To(Equal("team/app"))
+			Expect(ref.Tag).To(Equal("1.0"))
+			Expect(ref.Digest).To(Equal("sha256:abcd"))
+			Expect(ref.String()).To(Equal("registry.example.com:5000/team/app:1.0@sha256:abcd"))
+		})
+
+		It("should default the registry without adding it to the name", func() {
+			ref := parseImage("library/nginx")
+			Expect(ref.Registry).To(Equal("docker.io"))
+			Expect(ref.Name()).To(Equal("library/nginx"))
+			Expect(ref.Tag).To(Equal(""))
+		})
+	})
+
+	Describe("imageConfig", func() {
+		It("should match registries by path prefix and replace the prefix", func() {
+			c := &imageConfig{Images: []imageRule{
+				{Registry: "registry.example.com/team", NewRegistry: "mirror.example.com/mirrored"},
+				{Registry: "registry.example.com", NewRegistry: "mirror.example.com"},
+			}}
+			Expect(c.rewrite("registry.example.com/team/app:1.0")).To(Equal("mirror.example.com/mirrored/app:1.0"))
+			Expect(c.rewrite("registry.example.com/teams/app:1.0")).To(Equal("mirror.example.com/teams/app:1.0"))
+			Expect(c.rewrite("registry.example.com/app")).To(Equal("mirror.example.com/app"))
+			Expect(c.rewrite("registry.example.company/app")).To(Equal("registry.example.company/app"))
+		})
+
+		It("should keep the path of newRegistry when matching by name", func() {
+			c := &imageConfig{Images: []imageRule{
+				{Name: "nginx", NewRegistry: "mirror.example.com/dockerhub"},
+			}}
+			Expect(c.rewrite("nginx:1.25")).To(Equal("mirror.example.com/dockerhub/nginx:1.25"))
+		})
+
+		It("should match lockfile entries with and without the default registry", func() {
+			Fs = afero.NewMemMapFs()
+			defer func() { Fs = afero.NewOsFs() }()
+			Expect(afero.WriteFile(Fs, "images.lock", []byte("docker.io/library/nginx:1.25: sha256:aaaa\nredis:7: sha256:bbbb\n"), 0644)).To(Succeed())
+
+			c, err := getImageConfig(`{ lockfile: images.lock }`)
+			Expect(err).To(BeNil())
+			Expect(c.rewrite("nginx:1.25")).To(Equal("nginx:1.25@sha256:aaaa"))
+			Expect(c.rewrite("docker.io/library/redis:7")).To(Equal("docker.io/library/redis:7@sha256:bbbb"))
+		})
+
+		It("should read the lockfile relative to the config file", func() {
+			c, err := getImageConfig("testdata/images/config.yaml")
+			Expect(err).To(BeNil())
+			Expect(c.rewrite("app:1.0")).To(Equal("app:1.0@sha256:cccc"))
+		})
+	})
+
 	Describe("Reset", func() {
 		It("should reset all internal state", func() {
 			k := &kpatch{
@@ -122,6 +200,7 @@ var _ = Describe("Kpatch", func() {
 				missingKeyMode: "xxx",
 				doc:            map[interface{}]interface{}{"XXX": "XXX"},
 				currentItem:    "one",
+				assignPath:     []string{"a"},
 			}
 
 			k.Reset()
@@ -131,6 +210,7 @@ var _ = Describe("Kpatch", func() {
 			Expect(k.missingKeyMode).To(Equal("get"))
 			Expect(k.doc).To(HaveLen(0))
 			Expect(k.currentItem).To(BeNil())
+			Expect(k.assignPath).To(BeNil())
 		})
 	})
 
@@ -173,369 +253,3000 @@ var _ = Describe("Kpatch", func() {
 			Expect(docs).To(HaveLen(4))
 		})
 
-		Describe("selector", func() {
-			It("should only match documents that match expression", func() {
+		Describe("images", func() {
+			It("should rewrite images by registry, name and tag", func() {
 				data, e := dorun(func(rp *RunParams) {
-					rp.Selector = `name =~ ".*document1"`
-					rp.Actions = []string{`drop`}
+					rp.Files = []string{"testdata/deployment.yaml"}
+					rp.Images = `{ images: [
+						{ registry: registry.example.com, newRegistry: mirror.example.com },
+						{ name: sidecar, newName: mirror.example.com/sidecar },
+						{ name: app, tag: "1.0", newTag: "1.1" }
+					] }`
 				})
 
 				Expect(e).To(BeNil())
 				docs := decodeDocs(data)
+				Expect(containersOf(docs[0])[0]["image"]).To(Equal("mirror.example.com/app:1.0"))
+				Expect(containersOf(docs[0])[1]["image"]).To(Equal("mirror.example.com/sidecar:2.0"))
+				Expect(containersOf(docs[1])[0]["image"]).To(Equal("app:1.1"))
+			})
 
-				Expect(docs).To(HaveLen(2))
-				Expect(docs[0]["name"]).To(Equal("input1document2"))
-				Expect(docs[1]["name"]).To(Equal("input2document2"))
+			It("should pin images to digests from the lockfile", func() {
+				data, e := dorun(func(rp *RunParams) {
+					rp.Files = []string{"testdata/deployment.yaml"}
+					rp.Selector = `kind == "Deployment"`
+					rp.Images = `{ images: [{ name: sidecar, newName: mirror.example.com/sidecar }], lockfile: testdata/images.lock }`
+				})
+
+				Expect(e).To(BeNil())
+				docs := decodeDocs(data)
+				Expect(containersOf(docs[0])[0]["image"]).To(Equal("registry.example.com/app:1.0@sha256:aaaa"))
+				Expect(containersOf(docs[0])[1]["image"]).To(Equal("mirror.example.com/sidecar:2.0@sha256:bbbb"))
 			})
 
-			It("should not allow assignments in selector", func() {
+			It("should error if an image is not in the lockfile", func() {
 				_, e := dorun(func(rp *RunParams) {
-					rp.Selector = `test = 123`
+					rp.Files = []string{"testdata/deployment.yaml"}
+					rp.Images = `{ lockfile: testdata/images.lock }`
 				})
 
 				Expect(e).NotTo(BeNil())
-				Expect(merry.UserMessage(e)).To(ContainSubstring("unexpected \"=\""))
+				Expect(merry.UserMessage(e)).To(ContainSubstring("image 'sidecar:2.0' is not in lockfile"))
 			})
 
-			// TODO: Expand to other mutating functions (e.g. merge)
-			It("should not allow mutating functions in selector", func() {
+			It("should error on unknown config keys", func() {
 				_, e := dorun(func(rp *RunParams) {
-					rp.Selector = `unset(name)`
+					rp.Images = `{ imgs: [] }`
 				})
 
 				Expect(e).NotTo(BeNil())
-				Expect(merry.UserMessage(e)).To(ContainSubstring("could not call 'unset'"))
+				Expect(merry.UserMessage(e)).To(ContainSubstring("error parsing images config"))
 			})
 
-			It("should match all documents if not specified", func() {
+			It("should list image references instead of documents", func() {
 				data, e := dorun(func(rp *RunParams) {
-					rp.Actions = []string{`drop`}
+					rp.Files = []string{"testdata/deployment.yaml"}
+					rp.ListImages = true
 				})
 
 				Expect(e).To(BeNil())
-				docs := decodeDocs(data)
-				Expect(docs).To(HaveLen(0))
+				Expect(string(data)).To(Equal(
+					"registry.example.com/app:1.0\tDeployment/web\tapp\n" +
+						"sidecar:2.0\tDeployment/web\tsidecar\n" +
+						"app:1.0\tPod/standalone\tapp\n",
+				))
 			})
 		})
 
-		Describe("Action language", func() {
-			Describe("drop", func() {
-				It("should drop matching documents", func() {
-					data, e := dorun(func(rp *RunParams) {
-						rp.Selector = `name == "input1document1"`
-						rp.Actions = []string{`drop`}
-					})
-
-					Expect(e).To(BeNil())
-					docs := decodeDocs(data)
-					names := make([]string, 0)
-					for _, doc := range docs {
-						names = append(names, doc["name"].(string))
-					}
+		Describe("namespace", func() {
+			var docs []map[interface{}]interface{}
 
-					Expect(names).To(HaveLen(3))
-					Expect(names).NotTo(ContainElement("input1document1"))
+			BeforeEach(func() {
+				data, e := dorun(func(rp *RunParams) {
+					rp.Files = []string{"testdata/namespace.yaml"}
+					rp.Namespace = "new"
 				})
+				Expect(e).To(BeNil())
+				docs = decodeDocs(data)
+				Expect(docs).To(HaveLen(10))
 			})
 
-			Describe("assign", func() {
-				It("should set field if action is assignment", func() {
-					data, e := dorun(func(rp *RunParams) {
-						rp.Actions = []string{`maptype = "hello"`}
-					})
-
-					Expect(e).To(BeNil())
-					docs := decodeDocs(data)
-
-					Expect(docs[0]["maptype"]).To(Equal("hello"))
-				})
-
-				It("should create key if key on left hand side does not exist", func() {
-					data, e := dorun(func(rp *RunParams) {
-						rp.Actions = []string{`newval = "hello"`}
-					})
+			It("should set the namespace of namespaced documents", func() {
+				Expect(lookup(docs[0], "metadata", "namespace")).To(Equal("new"))
+				Expect(lookup(docs[2], "metadata", "namespace")).To(Equal("new"))
+				Expect(lookup(docs[9], "metadata", "namespace")).To(Equal("new"))
+			})
 
-					Expect(e).To(BeNil())
-					docs := decodeDocs(data)
+			It("should remove the namespace from cluster scoped documents", func() {
+				Expect(docs[1]["metadata"]).NotTo(HaveKey("namespace"))
+				Expect(docs[3]["metadata"]).NotTo(HaveKey("namespace"))
+			})
 
-					Expect(docs[0]["newval"]).To(Equal("hello"))
-				})
+			It("should treat kinds of cluster scoped CRDs later in the stream as cluster scoped", func() {
+				Expect(docs[6]["metadata"]).NotTo(HaveKey("namespace"))
+			})
 
-				It("should assign nil if key on right hand side does not exist", func() {
-					data, e := dorun(func(rp *RunParams) {
-						rp.Actions = []string{`maptype = noexist`}
-					})
+			It("should update service account subjects referencing moved service accounts", func() {
+				Expect(lookup(docs[2], "subjects", "0", "namespace")).To(Equal("new"))
+				Expect(lookup(docs[2], "subjects", "1", "namespace")).To(Equal("kube-system"))
+				Expect(lookup(docs[2], "subjects", "2", "namespace")).To(BeNil())
+				Expect(lookup(docs[3], "subjects", "1", "namespace")).To(Equal("new"))
+			})
 
-					Expect(e).To(BeNil())
-					docs := decodeDocs(data)
+			It("should leave references to documents that weren't moved", func() {
+				Expect(lookup(docs[3], "subjects", "0", "namespace")).To(Equal("default"))
+				Expect(lookup(docs[3], "subjects", "2", "namespace")).To(Equal("other"))
+			})
 
-					Expect(docs[0]["maptype"]).To(BeNil())
-				})
+			It("should update webhook and APIService service references", func() {
+				Expect(lookup(docs[4], "webhooks", "0", "clientConfig", "service", "namespace")).To(Equal("new"))
+				Expect(lookup(docs[5], "spec", "service", "namespace")).To(Equal("new"))
 			})
 
-			Describe("unset", func() {
-				It("should unset field", func() {
-					data, e := dorun(func(rp *RunParams) {
-						rp.Actions = []string{`unset(name)`}
-					})
+			It("should only update references to selected documents", func() {
+				data, e := dorun(func(rp *RunParams) {
+					rp.Files = []string{"testdata/namespace.yaml"}
+					rp.Selector = `kind != "CustomResourceDefinition" && metadata.name != "app-api"`
+					rp.Namespace = "new"
+				})
+				Expect(e).To(BeNil())
+				docs := decodeDocs(data)
 
-					docs := decodeDocs(data)
+				Expect(lookup(docs[5], "spec", "service", "namespace")).To(Equal("late"))
+				Expect(lookup(docs[8], "metadata", "namespace")).To(Equal("late"))
+				Expect(docs[6]["metadata"]).NotTo(HaveKey("namespace"))
+			})
+		})
 
-					Expect(e).To(BeNil())
-					Expect(docs[0]["name"]).To(BeNil())
+		Describe("name prefix / suffix", func() {
+			It("should rename selected documents and update references to them", func() {
+				data, e := dorun(func(rp *RunParams) {
+					rp.Files = []string{"testdata/names.yaml"}
+					rp.Selector = `kind != "Deployment"`
+					rp.NamePrefix = "pre-"
+					rp.NameSuffix = "-suf"
 				})
 
-				It("should unset multiple fields", func() {
-					data, e := dorun(func(rp *RunParams) {
-						rp.Actions = []string{`unset(name, maptype)`}
-					})
+				Expect(e).To(BeNil())
+				docs := decodeDocs(data)
+				Expect(docs).To(HaveLen(8))
 
-					docs := decodeDocs(data)
+				for i := 0; i < 6; i++ {
+					Expect(lookup(docs[i], "metadata", "name")).To(HavePrefix("pre-"))
+				}
+				Expect(lookup(docs[6], "metadata", "name")).To(Equal("web"))
 
-					Expect(e).To(BeNil())
-					Expect(docs[0]["name"]).To(BeNil())
-					Expect(docs[0]["maptype"]).To(BeNil())
-				})
+				Expect(lookup(docs[4], "roleRef", "name")).To(Equal("pre-web-suf"))
+				Expect(lookup(docs[4], "subjects", "0", "name")).To(Equal("pre-web-suf"))
+				Expect(lookup(docs[4], "subjects", "1", "name")).To(Equal("web"))
+				Expect(lookup(docs[5], "spec", "rules", "0", "http", "paths", "0", "backend", "service", "name")).To(Equal("pre-web-suf"))
 
-				It("should unset array elements", func() {
-					data, e := dorun(func(rp *RunParams) {
-						rp.Actions = []string{`list | if(@ > 1, @) | unset(@)`}
-					})
+				spec := podSpec(docs[6])
+				Expect(spec["serviceAccountName"]).To(Equal("pre-web-suf"))
+				Expect(lookup(spec, "volumes", "0", "configMap", "name")).To(Equal("pre-web-config-suf"))
+				Expect(lookup(spec, "containers", "0", "envFrom", "0", "configMapRef", "name")).To(Equal("pre-web-config-suf"))
 
-					docs := decodeDocs(data)
+				Expect(lookup(docs[7], "spec", "configMapName")).To(Equal("web-config"))
+			})
 
-					Expect(e).To(BeNil())
-					Expect(docs[1]["list"]).To(HaveLen(1))
+			It("should only rename documents of the given kinds", func() {
+				data, e := dorun(func(rp *RunParams) {
+					rp.Files = []string{"testdata/names.yaml"}
+					rp.NameSuffix = "-v2"
+					rp.NameKinds = []string{"ConfigMap"}
 				})
 
-				It("should not do anything if key does not exist", func() {
-					before, e := dorun(func(rp *RunParams) {})
-					Expect(e).To(BeNil())
-
-					after, e := dorun(func(rp *RunParams) {
-						rp.Actions = []string{`unset(n)`}
-					})
+				Expect(e).To(BeNil())
+				docs := decodeDocs(data)
+				Expect(lookup(docs[0], "metadata", "name")).To(Equal("web"))
+				Expect(lookup(docs[1], "metadata", "name")).To(Equal("web-config-v2"))
+				Expect(lookup(podSpec(docs[6]), "volumes", "0", "configMap", "name")).To(Equal("web-config-v2"))
+			})
 
-					Expect(e).To(BeNil())
-					Expect(before).To(Equal(after))
+			It("should update references from an extra references file", func() {
+				data, e := dorun(func(rp *RunParams) {
+					rp.Files = []string{"testdata/names.yaml"}
+					rp.NameSuffix = "-v2"
+					rp.NameKinds = []string{"ConfigMap"}
+					rp.NameReferences = `[{ kind: ConfigMap, fieldSpecs: [{ kind: Widget, path: spec.configMapName }] }]`
 				})
 
-				It("should error if argument count < 1", func() {
-					_, e := dorun(func(rp *RunParams) {
-						rp.Actions = []string{`unset()`}
-					})
+				Expect(e).To(BeNil())
+				docs := decodeDocs(data)
+				Expect(lookup(docs[7], "spec", "configMapName")).To(Equal("web-config-v2"))
+			})
 
-					Expect(e).NotTo(BeNil())
-					Expect(merry.UserMessage(e)).To(ContainSubstring("unset(var, ...) requires one or more argument to unset"))
+			It("should update references from an extra references file to hashed ConfigMaps", func() {
+				data, e := dorun(func(rp *RunParams) {
+					rp.Files = []string{"testdata/names.yaml"}
+					rp.Selector = `kind == "ConfigMap"`
+					rp.HashConfigMaps = "name"
+					rp.NameReferences = `[{ kind: ConfigMap, fieldSpecs: [{ kind: Widget, path: spec.configMapName }] }]`
 				})
-			})
 
-			Describe("@ variable", func() {
-				It("should return root outside of pipeline", func() {
-					before, e := dorun(func(rp *RunParams) {})
-					Expect(e).To(BeNil())
+				Expect(e).To(BeNil())
+				docs := decodeDocs(data)
+				Expect(lookup(docs[7], "spec", "configMapName")).To(Equal(lookup(docs[1], "metadata", "name")))
+				Expect(lookup(docs[7], "spec", "configMapName")).To(MatchRegexp("^web-config-[0-9a-f]{10}$"))
+			})
+		})
 
-					after, e := dorun(func(rp *RunParams) {
-						rp.Actions = []string{`tmp = @`}
-					})
+		Describe("generators", func() {
+			BeforeEach(func() {
+				Stdin = strings.NewReader("")
+			})
 
-					docsBefore := decodeDocs(before)
-					docs := decodeDocs(after)
+			AfterEach(func() {
+				Stdin = os.Stdin
+			})
 
-					Expect(e).To(BeNil())
-					Expect(docs[0]["tmp"]).NotTo(BeNil())
-					Expect(docs[0]["tmp"]).To(Equal(docsBefore[0]))
+			It("should generate a ConfigMap from a directory", func() {
+				data, e := dorun(func(rp *RunParams) {
+					rp.Files = nil
+					rp.ConfigMaps = []string{"app-config=testdata/config"}
 				})
 
-				It("should return current item inside pipeline", func() {
-					data, e := dorun(func(rp *RunParams) {
-						rp.Selector = `name == "input1document2"`
-						rp.Actions = []string{`list | @ = "X"`}
-					})
+				Expect(e).To(BeNil())
+				docs := decodeDocs(data)
+				Expect(len(docs)).To(Equal(1))
+				Expect(docs[0]["kind"]).To(Equal("ConfigMap"))
+				Expect(lookup(docs[0], "metadata", "name")).To(Equal("app-config"))
+				Expect(lookup(docs[0], "data", "app.properties")).To(Equal("port=8080\nhost=localhost\n"))
+				Expect(lookup(docs[0], "data", "log-level")).To(Equal("info\n"))
+				Expect(lookup(docs[0], "binaryData", "blob.bin")).To(Equal("AAH//g=="))
+			})
 
-					docs := decodeDocs(data)
+			It("should generate a Secret from an env file", func() {
+				data, e := dorun(func(rp *RunParams) {
+					rp.Files = nil
+					rp.Secrets = []string{"creds=testdata/secret.env"}
+				})
 
-					Expect(e).To(BeNil())
-					Expect(docs[1]["list"]).To(HaveLen(3))
+				Expect(e).To(BeNil())
+				docs := decodeDocs(data)
+				Expect(docs[0]["kind"]).To(Equal("Secret"))
+				Expect(docs[0]["type"]).To(Equal("Opaque"))
+				Expect(lookup(docs[0], "data", "USERNAME")).To(Equal("YWRtaW4="))
+				Expect(lookup(docs[0], "data", "PASSWORD")).To(Equal("czNjcj10"))
+			})
 
-					var items []string
-					for _, i := range docs[1]["list"].([]interface{}) {
-						items = append(items, i.(string))
-					}
-					Expect(strings.Join(items, ".")).To(Equal("X.X.X"))
+			It("should remove matching quotes from env file values", func() {
+				data, e := dorun(func(rp *RunParams) {
+					rp.Files = nil
+					rp.ConfigMaps = []string{"env=testdata/quoted.env"}
 				})
+
+				Expect(e).To(BeNil())
+				docs := decodeDocs(data)
+				Expect(lookup(docs[0], "data", "GREETING")).To(Equal("hello world"))
+				Expect(lookup(docs[0], "data", "NAME")).To(Equal("kpatch"))
+				Expect(lookup(docs[0], "data", "UNMATCHED")).To(Equal(`"open`))
 			})
 
-			Describe("v", func() {
-				It("should return var at path by args", func() {
-					data, e := dorun(func(rp *RunParams) {
-						rp.Selector = `name == "input1document1"`
-						rp.Actions = []string{`test = v(["maptype", "k1", "k1"])`}
-					})
+			It("should error on keys repeated in an env file", func() {
+				_, e := dorun(func(rp *RunParams) {
+					rp.Files = nil
+					rp.ConfigMaps = []string{"env=testdata/duplicate.env"}
+				})
 
-					docs := decodeDocs(data)
+				Expect(e).NotTo(BeNil())
+				Expect(merry.UserMessage(e)).To(ContainSubstring("line 2: key 'KEY' is already defined"))
+			})
 
-					Expect(e).To(BeNil())
-					Expect(docs[0]["test"]).To(Equal("l2value"))
+			It("should select and patch generated documents with the inputs", func() {
+				data, e := dorun(func(rp *RunParams) {
+					rp.ConfigMaps = []string{"app-config=testdata/config/log-level"}
+					rp.Selector = `kind == "ConfigMap"`
+					rp.Actions = []string{`metadata.labels = {"generated": "true"}`}
 				})
 
-				It("should return error if arg is not a slice", func() {
-					_, e := dorun(func(rp *RunParams) {
-						rp.Selector = `name == "input1document1"`
-						rp.Actions = []string{`test = v("test")`}
-					})
+				Expect(e).To(BeNil())
+				docs := decodeDocs(data)
+				generated := docs[len(docs)-1]
+				Expect(lookup(generated, "metadata", "name")).To(Equal("app-config"))
+				Expect(lookup(generated, "metadata", "labels", "generated")).To(Equal("true"))
+			})
 
-					Expect(e).NotTo(BeNil())
-					Expect(merry.UserMessage(e)).To(ContainSubstring("v(path) expects path to be a slice"))
+			It("should error on duplicate keys", func() {
+				_, e := dorun(func(rp *RunParams) {
+					rp.Files = nil
+					rp.ConfigMaps = []string{"app-config=testdata/config,testdata/config/log-level"}
 				})
 
-				It("should return error if path invalid", func() {
-					_, e := dorun(func(rp *RunParams) {
-						rp.Selector = `name == "input1document1"`
-						rp.Actions = []string{`v(["test"])`}
-					})
+				Expect(e).NotTo(BeNil())
+				Expect(merry.UserMessage(e)).To(ContainSubstring("key 'log-level'"))
+			})
 
-					Expect(e).NotTo(BeNil())
-					Expect(merry.UserMessage(e)).To(ContainSubstring("key does not exist"))
+			It("should read stdin when there are no files", func() {
+				Stdin = strings.NewReader("kind: Service\nmetadata:\n  name: web\n")
+				data, e := dorun(func(rp *RunParams) {
+					rp.Files = nil
+					rp.ConfigMaps = []string{"app-config=testdata/config/log-level"}
 				})
 
-				It("should return error if argument count != 1", func() {
-					_, e := dorun(func(rp *RunParams) {
-						rp.Selector = `name == "input1document1"`
-						rp.Actions = []string{`v(["test"], "other")`}
-					})
+				Expect(e).To(BeNil())
+				docs := decodeDocs(data)
+				Expect(docs).To(HaveLen(2))
+				Expect(docs[0]["kind"]).To(Equal("Service"))
+				Expect(docs[1]["kind"]).To(Equal("ConfigMap"))
+			})
 
-					Expect(e).NotTo(BeNil())
-					Expect(merry.UserMessage(e)).To(ContainSubstring("requires exactly one argument"))
+			It("should add ConfigMaps generated by an expression to the stream once", func() {
+				data, e := dorun(func(rp *RunParams) {
+					rp.Files = []string{"testdata/hash.yaml"}
+					rp.Actions = []string{`configmap_from_files("env-config", "testdata/secret.env")`}
 				})
+
+				Expect(e).To(BeNil())
+				docs := decodeDocs(data)
+				generated := docs[len(docs)-1]
+				Expect(lookup(generated, "metadata", "name")).To(Equal("env-config"))
+				Expect(lookup(generated, "data", "USERNAME")).To(Equal("admin"))
+				Expect(lookup(docs[len(docs)-2], "metadata", "name")).NotTo(Equal("env-config"))
+				Expect(lookup(docs[0], "data", "USERNAME")).To(BeNil())
 			})
 
-			Describe("merge", func() {
+			It("should select and patch ConfigMaps generated by an expression", func() {
+				data, e := dorun(func(rp *RunParams) {
+					rp.Files = []string{"testdata/hash.yaml"}
+					rp.Actions = []string{
+						`kind == "Deployment" ? secret_from_files("creds", "testdata/secret.env") : nil`,
+						`metadata.labels.seen = "true"`,
+					}
+				})
+
+				Expect(e).To(BeNil())
+				docs := decodeDocs(data)
+				generated := docs[len(docs)-1]
+				Expect(generated["kind"]).To(Equal("Secret"))
+				Expect(lookup(generated, "metadata", "labels", "seen")).To(Equal("true"))
+			})
+		})
+
+		Describe("secrets", func() {
+			It("should decode secret data for selectors and actions and encode it on output", func() {
+				data, e := dorun(func(rp *RunParams) {
+					rp.Files = []string{"testdata/secrets.yaml"}
+					rp.SecretsDecoded = true
+					rp.Selector = `kind == "Secret" && stringData.username == "admin"`
+					rp.Actions = []string{`stringData.password = "changed"`}
+				})
+
+				Expect(e).To(BeNil())
+				docs := decodeDocs(data)
+				Expect(docs[0]["stringData"]).To(BeNil())
+				Expect(lookup(docs[0], "data", "username")).To(Equal("YWRtaW4="))
+				Expect(lookup(docs[0], "data", "password")).To(Equal("Y2hhbmdlZA=="))
+				Expect(lookup(docs[0], "data", "cert")).To(Equal("AAH//g=="))
+				Expect(lookup(docs[0], "data", "token")).To(Equal("YWJj"))
+				Expect(lookup(docs[1], "data", "username")).To(Equal("YWRtaW4="))
+			})
+
+			It("should leave binary values in data while decoded", func() {
+				data, e := dorun(func(rp *RunParams) {
+					rp.Files = []string{"testdata/secrets.yaml"}
+					rp.SecretsDecoded = true
+					rp.Selector = `kind == "Secret"`
+					rp.Actions = []string{`metadata.annotations = {"keys": join(keys(data), ",")}`}
+				})
+
+				Expect(e).To(BeNil())
+				Expect(lookup(decodeDocs(data)[0], "metadata", "annotations", "keys")).To(Equal("cert"))
+			})
+
+			It("should error on invalid base64", func() {
+				_, e := dorun(func(rp *RunParams) {
+					rp.Files = []string{"testdata/secret-invalid.yaml"}
+					rp.SecretsDecoded = true
+				})
+
+				Expect(e).NotTo(BeNil())
+				Expect(merry.UserMessage(e)).To(ContainSubstring("error decoding data key 'password'"))
+			})
+
+			It("should normalise stringData in to data", func() {
+				data, e := dorun(func(rp *RunParams) {
+					rp.Files = []string{"testdata/secrets.yaml"}
+					rp.NormalizeSecrets = true
+				})
+
+				Expect(e).To(BeNil())
+				docs := decodeDocs(data)
+				Expect(docs[0]["stringData"]).To(BeNil())
+				Expect(lookup(docs[0], "data", "token")).To(Equal("YWJj"))
+				Expect(lookup(docs[0], "data", "password")).To(Equal("cGFzc3dvcmQ="))
+			})
+		})
+
+		Describe("encryption", func() {
+			const recipient = "age16kpaegde8x3s59ry5gkqr526sxes6h27kc8smr42dlqrl97csgfqw5yvez"
+
+			It("should decrypt secret values", func() {
+				data, e := dorun(func(rp *RunParams) {
+					rp.Files = []string{"testdata/encrypted.yaml"}
+					rp.AgeKeyFile = "testdata/age.key"
+					rp.DecryptSecrets = true
+				})
+
+				Expect(e).To(BeNil())
+				docs := decodeDocs(data)
+				Expect(lookup(docs[0], "data", "password")).To(Equal("cGFzc3dvcmQ="))
+				Expect(lookup(docs[0], "data", "plain")).To(Equal("cGxhaW4="))
+				Expect(lookup(docs[0], "stringData", "token")).To(Equal("token"))
+			})
+
+			It("should decrypt, patch and re-encrypt in one run", func() {
+				data, e := dorun(func(rp *RunParams) {
+					rp.Files = []string{"testdata/encrypted.yaml"}
+					rp.AgeKeyFile = "testdata/age.key"
+					rp.Actions = []string{
+						`stringData.token = encrypt(decrypt(stringData.token) + "-rotated", "` + recipient + `")`,
+					}
+				})
+
+				Expect(e).To(BeNil())
+				token := lookup(decodeDocs(data)[0], "stringData", "token").(string)
+				Expect(token).To(HavePrefix("-----BEGIN AGE ENCRYPTED FILE-----"))
+
+				identities, err := getAgeIdentities("testdata/age.key")
+				Expect(err).To(BeNil())
+				plain, err := ageDecrypt(token, identities)
+				Expect(err).To(BeNil())
+				Expect(plain).To(Equal("token-rotated"))
+			})
+
+			It("should require a key file to decrypt secrets", func() {
+				_, e := dorun(func(rp *RunParams) {
+					rp.Files = []string{"testdata/encrypted.yaml"}
+					rp.DecryptSecrets = true
+				})
+
+				Expect(e).NotTo(BeNil())
+				Expect(merry.UserMessage(e)).To(ContainSubstring("requires an age key file"))
+			})
+
+			It("should error when decrypt() has no key file", func() {
+				_, e := dorun(func(rp *RunParams) {
+					rp.Files = []string{"testdata/encrypted.yaml"}
+					rp.Actions = []string{`stringData.token = decrypt(stringData.token)`}
+				})
+
+				Expect(e).NotTo(BeNil())
+				Expect(merry.UserMessage(e)).To(ContainSubstring("decrypt(value) requires an age key file"))
+			})
+
+			It("should error on an invalid recipient", func() {
+				_, e := dorun(func(rp *RunParams) {
+					rp.Files = []string{"testdata/encrypted.yaml"}
+					rp.Actions = []string{`stringData.token = encrypt("value", "nope")`}
+				})
+
+				Expect(e).NotTo(BeNil())
+				Expect(merry.UserMessage(e)).To(ContainSubstring("encrypt(value, recipient) failed"))
+			})
+		})
+
+		Describe("sort", func() {
+			ids := func(data []byte) []string {
+				var out []string
+				for _, doc := range decodeDocs(data) {
+					out = append(out, fmt.Sprintf("%s/%s", doc["kind"], lookup(doc, "metadata", "name")))
+				}
+				return out
+			}
+
+			It("should keep input order by default", func() {
+				data, e := dorun(func(rp *RunParams) {
+					rp.Files = []string{"testdata/unsorted.yaml"}
+				})
+
+				Expect(e).To(BeNil())
+				Expect(ids(data)[0]).To(Equal("ValidatingWebhookConfiguration/webhook"))
+			})
+
+			It("should sort in install order keeping input order within a kind", func() {
+				data, e := dorun(func(rp *RunParams) {
+					rp.Files = []string{"testdata/unsorted.yaml"}
+					rp.Sort = "install"
+				})
+
+				Expect(e).To(BeNil())
+				Expect(ids(data)).To(Equal([]string{
+					"Namespace/app",
+					"CustomResourceDefinition/widgets.example.com",
+					"Service/web",
+					"Deployment/web",
+					"Deployment/api",
+					"Widget/widget",
+					"ValidatingWebhookConfiguration/webhook",
+				}))
+			})
+
+			It("should use Helm's install order for built in kinds", func() {
+				s, err := newDocumentSorter("install", "")
+				Expect(err).To(BeNil())
+
+				var docs []*document
+				for _, kind := range []string{"Job", "HorizontalPodAutoscaler", "StatefulSet", "Ingress", "Deployment", "Pod", "DaemonSet", "NetworkPolicy", "Role"} {
+					docs = append(docs, &document{data: map[interface{}]interface{}{"kind": kind}})
+				}
+				s.sort(docs)
+
+				var kinds []interface{}
+				for _, doc := range docs {
+					kinds = append(kinds, doc.data["kind"])
+				}
+				Expect(kinds).To(Equal([]interface{}{"NetworkPolicy", "Role", "DaemonSet", "Pod", "Deployment", "HorizontalPodAutoscaler", "StatefulSet", "Job", "Ingress"}))
+			})
+
+			It("should sort in uninstall order", func() {
+				data, e := dorun(func(rp *RunParams) {
+					rp.Files = []string{"testdata/unsorted.yaml"}
+					rp.Sort = "uninstall"
+				})
+
+				Expect(e).To(BeNil())
+				Expect(ids(data)).To(Equal([]string{
+					"ValidatingWebhookConfiguration/webhook",
+					"Widget/widget",
+					"Deployment/web",
+					"Deployment/api",
+					"Service/web",
+					"CustomResourceDefinition/widgets.example.com",
+					"Namespace/app",
+				}))
+			})
+
+			It("should sort by kind and name", func() {
+				data, e := dorun(func(rp *RunParams) {
+					rp.Files = []string{"testdata/unsorted.yaml"}
+					rp.Sort = "name"
+				})
+
+				Expect(e).To(BeNil())
+				Expect(ids(data)[:3]).To(Equal([]string{
+					"CustomResourceDefinition/widgets.example.com",
+					"Deployment/api",
+					"Deployment/web",
+				}))
+			})
+
+			It("should use a custom order", func() {
+				data, e := dorun(func(rp *RunParams) {
+					rp.Files = []string{"testdata/unsorted.yaml"}
+					rp.Sort = "install"
+					rp.SortOrder = `["Widget", "*", "Namespace"]`
+				})
+
+				Expect(e).To(BeNil())
+				out := ids(data)
+				Expect(out[0]).To(Equal("Widget/widget"))
+				Expect(out[1]).To(Equal("ValidatingWebhookConfiguration/webhook"))
+				Expect(out[len(out)-1]).To(Equal("Namespace/app"))
+			})
+
+			It("should error on an unknown sort", func() {
+				_, e := dorun(func(rp *RunParams) {
+					rp.Sort = "random"
+				})
+
+				Expect(e).NotTo(BeNil())
+				Expect(merry.UserMessage(e)).To(ContainSubstring("unknown sort 'random'"))
+			})
+		})
+
+		Describe("dedupe", func() {
+			var stderr *bytes.Buffer
+
+			BeforeEach(func() {
+				stderr = &bytes.Buffer{}
+				Stderr = stderr
+			})
+
+			AfterEach(func() {
+				Stderr = os.Stderr
+			})
+
+			deployments := func(data []byte) []map[interface{}]interface{} {
+				var out []map[interface{}]interface{}
+				for _, doc := range decodeDocs(data) {
+					if doc["kind"] == "Deployment" && lookup(doc, "metadata", "namespace") == "app" {
+						out = append(out, doc)
+					}
+				}
+				return out
+			}
+
+			It("should keep duplicates when not set", func() {
+				data, e := dorun(func(rp *RunParams) {
+					rp.Files = []string{"testdata/dupes1.yaml", "testdata/dupes2.yaml"}
+				})
+
+				Expect(e).To(BeNil())
+				Expect(len(deployments(data))).To(Equal(2))
+			})
+
+			It("should error with the source of every copy", func() {
+				_, e := dorun(func(rp *RunParams) {
+					rp.Files = []string{"testdata/dupes1.yaml", "testdata/dupes2.yaml"}
+					rp.Dedupe = "error"
+				})
+
+				Expect(e).NotTo(BeNil())
+				Expect(merry.UserMessage(e)).To(ContainSubstring("apps/Deployment/app/web is defined in document 1 of 'testdata/dupes1.yaml', document 2 of 'testdata/dupes2.yaml'"))
+				Expect(merry.UserMessage(e)).NotTo(ContainSubstring("Service"))
+			})
+
+			It("should keep the first copy", func() {
+				data, e := dorun(func(rp *RunParams) {
+					rp.Files = []string{"testdata/dupes1.yaml", "testdata/dupes2.yaml"}
+					rp.Dedupe = "first"
+				})
+
+				Expect(e).To(BeNil())
+				docs := deployments(data)
+				Expect(len(docs)).To(Equal(1))
+				Expect(lookup(docs[0], "spec", "replicas")).To(Equal(1))
+				Expect(len(decodeDocs(data))).To(Equal(4))
+				Expect(stderr.String()).To(ContainSubstring("warning: duplicate apps/Deployment/app/web is defined in"))
+			})
+
+			It("should keep the last copy", func() {
+				data, e := dorun(func(rp *RunParams) {
+					rp.Files = []string{"testdata/dupes1.yaml", "testdata/dupes2.yaml"}
+					rp.Dedupe = "last"
+				})
+
+				Expect(e).To(BeNil())
+				docs := deployments(data)
+				Expect(len(docs)).To(Equal(1))
+				Expect(lookup(docs[0], "spec", "replicas")).To(Equal(3))
+			})
+
+			It("should merge copies replacing lists", func() {
+				data, e := dorun(func(rp *RunParams) {
+					rp.Files = []string{"testdata/dupes1.yaml", "testdata/dupes2.yaml"}
+					rp.Dedupe = "merge"
+				})
+
+				Expect(e).To(BeNil())
+				docs := deployments(data)
+				Expect(len(docs)).To(Equal(1))
+				Expect(lookup(docs[0], "spec", "replicas")).To(Equal(3))
+				Expect(lookup(docs[0], "metadata", "labels", "source")).To(Equal("one"))
+				Expect(lookup(docs[0], "metadata", "annotations", "source")).To(Equal("two"))
+				Expect(len(containersOf(docs[0]))).To(Equal(1))
+			})
+
+			It("should merge copies appending lists", func() {
+				data, e := dorun(func(rp *RunParams) {
+					rp.Files = []string{"testdata/dupes1.yaml", "testdata/dupes2.yaml"}
+					rp.Dedupe = "merge"
+					rp.DedupeStrategy = "append"
+				})
+
+				Expect(e).To(BeNil())
+				Expect(len(containersOf(deployments(data)[0]))).To(Equal(2))
+			})
+
+			It("should error on an unknown mode", func() {
+				_, e := dorun(func(rp *RunParams) {
+					rp.Dedupe = "some"
+				})
+
+				Expect(e).NotTo(BeNil())
+				Expect(merry.UserMessage(e)).To(ContainSubstring("unknown dedupe mode 'some'"))
+			})
+		})
+
+		Describe("migrate apis", func() {
+			var stderr *bytes.Buffer
+
+			BeforeEach(func() {
+				stderr = &bytes.Buffer{}
+				Stderr = stderr
+			})
+
+			AfterEach(func() {
+				Stderr = os.Stderr
+			})
+
+			It("should convert workloads and add the required selector", func() {
+				data, e := dorun(func(rp *RunParams) {
+					rp.Files = []string{"testdata/deprecated.yaml"}
+					rp.MigrateAPIs = "1.16"
+				})
+
+				Expect(e).To(BeNil())
+				docs := decodeDocs(data)
+				Expect(docs[0]["apiVersion"]).To(Equal("apps/v1"))
+				Expect(lookup(docs[0], "spec", "selector", "matchLabels", "app")).To(Equal("web"))
+				Expect(lookup(docs[0], "spec", "rollbackTo")).To(BeNil())
+				Expect(stderr.String()).To(ContainSubstring("spec.rollbackTo is not supported"))
+				Expect(docs[2]["apiVersion"]).To(Equal("policy/v1beta1"))
+
+				// Not removed until later versions
+				Expect(docs[1]["apiVersion"]).To(Equal("extensions/v1beta1"))
+				Expect(docs[3]["apiVersion"]).To(Equal("batch/v1beta1"))
+			})
+
+			It("should warn about defaults that changed for fields that aren't set", func() {
+				data, e := dorun(func(rp *RunParams) {
+					rp.Files = []string{"testdata/deprecated.yaml", "testdata/daemonset.yaml"}
+					rp.MigrateAPIs = "1.16"
+				})
+
+				Expect(e).To(BeNil())
+				docs := decodeDocs(data)
+				Expect(docs[6]["apiVersion"]).To(Equal("apps/v1"))
+				Expect(docs[7]["apiVersion"]).To(Equal("apps/v1"))
+
+				warnings := stderr.String()
+				Expect(warnings).To(ContainSubstring("document 1 of 'testdata/daemonset.yaml': converted extensions/v1beta1 DaemonSet to apps/v1 but spec.updateStrategy.type now defaults to RollingUpdate instead of OnDelete"))
+				Expect(warnings).NotTo(ContainSubstring("document 2 of 'testdata/daemonset.yaml'"))
+				Expect(warnings).To(ContainSubstring("spec.revisionHistoryLimit now defaults to 10"))
+				Expect(warnings).To(ContainSubstring("spec.progressDeadlineSeconds now defaults to 600"))
+				Expect(warnings).To(ContainSubstring("maxUnavailable and maxSurge now default to 25%"))
+			})
+
+			It("should convert ingress backends", func() {
+				data, e := dorun(func(rp *RunParams) {
+					rp.Files = []string{"testdata/deprecated.yaml"}
+					rp.MigrateAPIs = "v1.22.3"
+				})
+
+				Expect(e).To(BeNil())
+				ingress := decodeDocs(data)[1]
+				Expect(ingress["apiVersion"]).To(Equal("networking.k8s.io/v1"))
+				Expect(lookup(ingress, "spec", "backend")).To(BeNil())
+				Expect(lookup(ingress, "spec", "defaultBackend", "service", "name")).To(Equal("default"))
+				Expect(lookup(ingress, "spec", "defaultBackend", "service", "port", "number")).To(Equal(80))
+
+				path := []string{"spec", "rules", "0", "http", "paths", "0"}
+				Expect(lookup(ingress, append(path, "backend", "service", "name")...)).To(Equal("web"))
+				Expect(lookup(ingress, append(path, "backend", "service", "port", "name")...)).To(Equal("http"))
+				Expect(lookup(ingress, append(path, "backend", "serviceName")...)).To(BeNil())
+				Expect(lookup(ingress, append(path, "pathType")...)).To(Equal("ImplementationSpecific"))
+			})
+
+			It("should keep webhook defaults and warn about side effects", func() {
+				data, e := dorun(func(rp *RunParams) {
+					rp.Files = []string{"testdata/deprecated.yaml"}
+					rp.MigrateAPIs = "1.22"
+				})
+
+				Expect(e).To(BeNil())
+				webhook := decodeDocs(data)[4]
+				Expect(webhook["apiVersion"]).To(Equal("admissionregistration.k8s.io/v1"))
+				Expect(lookup(webhook, "webhooks", "0", "failurePolicy")).To(Equal("Ignore"))
+				Expect(lookup(webhook, "webhooks", "0", "admissionReviewVersions", "0")).To(Equal("v1beta1"))
+				Expect(stderr.String()).To(ContainSubstring("webhook 'validate.example.com' must set sideEffects"))
+			})
+
+			It("should warn about APIs that can't be converted", func() {
+				data, e := dorun(func(rp *RunParams) {
+					rp.Files = []string{"testdata/deprecated.yaml"}
+					rp.MigrateAPIs = "1.25"
+				})
+
+				Expect(e).To(BeNil())
+				docs := decodeDocs(data)
+				Expect(docs[2]["apiVersion"]).To(Equal("policy/v1beta1"))
+				Expect(docs[3]["apiVersion"]).To(Equal("batch/v1"))
+				Expect(stderr.String()).To(ContainSubstring("document 3 of 'testdata/deprecated.yaml': policy/v1beta1 PodSecurityPolicy was removed in 1.25 and can't be converted automatically"))
+			})
+
+			It("should leave current APIs alone", func() {
+				data, e := dorun(func(rp *RunParams) {
+					rp.Files = []string{"testdata/deprecated.yaml"}
+					rp.MigrateAPIs = "1.30"
+				})
+
+				Expect(e).To(BeNil())
+				Expect(decodeDocs(data)[5]["apiVersion"]).To(Equal("apps/v1"))
+			})
+
+			It("should error on an invalid version", func() {
+				_, e := dorun(func(rp *RunParams) {
+					rp.MigrateAPIs = "latest"
+				})
+
+				Expect(e).NotTo(BeNil())
+				Expect(merry.UserMessage(e)).To(ContainSubstring("invalid Kubernetes version 'latest'"))
+			})
+		})
+
+		Describe("deprecations report", func() {
+			It("should list deprecated APIs with their replacement as a table", func() {
+				data, e := dorun(func(rp *RunParams) {
+					rp.Files = []string{"testdata/deprecated.yaml"}
+					rp.Report = "deprecations"
+					rp.KubeVersion = "1.21"
+				})
+
+				Expect(merry.UserMessage(e)).To(Equal("2 resources use APIs removed in Kubernetes 1.21"))
+				lines := strings.Split(strings.TrimSpace(string(data)), "\n")
+				Expect(lines[0]).To(HavePrefix("KIND"))
+				Expect(len(lines)).To(Equal(6))
+				Expect(lines[2]).To(MatchRegexp(`^Ingress\s+web\s+extensions/v1beta1\s+networking.k8s.io/v1\s+1.14\s+1.22\s+document 2 of 'testdata/deprecated.yaml'$`))
+				Expect(string(data)).To(ContainSubstring("1.16 (removed)"))
+				Expect(string(data)).NotTo(ContainSubstring("current"))
+			})
+
+			It("should write JSON and fail when removed APIs are used", func() {
+				data, e := dorun(func(rp *RunParams) {
+					rp.Files = []string{"testdata/deprecated.yaml"}
+					rp.Report = "deprecations"
+					rp.ReportFormat = "json"
+					rp.KubeVersion = "1.25"
+					rp.Actions = []string{`apiVersion = "apps/v1"`}
+				})
+
+				Expect(e).NotTo(BeNil())
+				Expect(merry.UserMessage(e)).To(Equal("5 resources use APIs removed in Kubernetes 1.25"))
+
+				var found []map[string]interface{}
+				Expect(json.Unmarshal(data, &found)).To(BeNil())
+				Expect(len(found)).To(Equal(5))
+				Expect(found[0]["kind"]).To(Equal("Deployment"))
+				Expect(found[0]["apiVersion"]).To(Equal("extensions/v1beta1"))
+				Expect(found[2]["replacement"]).To(Equal("none"))
+				Expect(found[3]["replacement"]).To(Equal("batch/v1"))
+				Expect(found[3]["removed"]).To(Equal(true))
+			})
+
+			It("should only report selected documents", func() {
+				data, e := dorun(func(rp *RunParams) {
+					rp.Files = []string{"testdata/deprecated.yaml"}
+					rp.Selector = `kind == "CronJob"`
+					rp.Report = "deprecations"
+					rp.ReportFormat = "json"
+					rp.KubeVersion = "1.21"
+				})
+
+				Expect(e).To(BeNil())
+				var found []map[string]interface{}
+				Expect(json.Unmarshal(data, &found)).To(BeNil())
+				Expect(len(found)).To(Equal(1))
+				Expect(found[0]["removed"]).To(Equal(false))
+			})
+
+			It("should require a Kubernetes version", func() {
+				_, e := dorun(func(rp *RunParams) {
+					rp.Report = "deprecations"
+				})
+
+				Expect(e).NotTo(BeNil())
+				Expect(merry.UserMessage(e)).To(ContainSubstring("requires a Kubernetes version"))
+			})
+		})
+
+		Describe("validate", func() {
+			var stderr *bytes.Buffer
+
+			BeforeEach(func() {
+				stderr = &bytes.Buffer{}
+				Stderr = stderr
+			})
+
+			AfterEach(func() {
+				Stderr = os.Stderr
+			})
+
+			It("should pass valid documents", func() {
+				data, e := dorun(func(rp *RunParams) {
+					rp.Files = []string{"testdata/validate.yaml"}
+					rp.Schemas = []string{"testdata/crd.yaml"}
+					rp.Validate = true
+				})
+
+				Expect(e).To(BeNil())
+				Expect(len(decodeDocs(data))).To(Equal(3))
+				Expect(stderr.String()).To(ContainSubstring("no schema for example.com/v1 Gadget"))
+			})
+
+			It("should report the document and path of unknown fields and wrong types", func() {
+				_, e := dorun(func(rp *RunParams) {
+					rp.Files = []string{"testdata/validate.yaml"}
+					rp.Selector = `kind == "Deployment"`
+					rp.Actions = []string{
+						`spec.replica = 3`,
+						`spec.template.spec.containers[0].ports[0].containerPort = "http"`,
+					}
+					rp.Validate = true
+				})
+
+				Expect(e).NotTo(BeNil())
+				msg := merry.UserMessage(e)
+				Expect(msg).To(ContainSubstring("Deployment/web (document 1 of 'testdata/validate.yaml'): spec.replica: unknown field"))
+				Expect(msg).To(ContainSubstring("spec.template.spec.containers[0].ports[0].containerPort: expected an integer but got string"))
+			})
+
+			It("should use CRDs from the input stream", func() {
+				_, e := dorun(func(rp *RunParams) {
+					rp.Files = []string{"testdata/crd.yaml", "testdata/validate.yaml"}
+					rp.Selector = `kind == "Widget"`
+					rp.Actions = []string{`spec.color = "green"`, `unset(spec.size)`}
+					rp.Validate = true
+				})
+
+				Expect(e).NotTo(BeNil())
+				msg := merry.UserMessage(e)
+				Expect(msg).To(ContainSubstring("Widget/widget (document 2 of 'testdata/validate.yaml'): spec.color: value 'green' is not one of [red blue]"))
+				Expect(msg).To(ContainSubstring("spec.size: required field is missing"))
+			})
+
+			It("should error on a version without a bundled schema", func() {
+				_, e := dorun(func(rp *RunParams) {
+					rp.Validate = true
+					rp.KubeVersion = "1.5"
+				})
+
+				Expect(e).NotTo(BeNil())
+				Expect(merry.UserMessage(e)).To(ContainSubstring("no bundled schema for Kubernetes 1.5"))
+			})
+		})
+
+		Describe("typed assignment", func() {
+			It("should convert assigned values to the schema type", func() {
+				data, e := dorun(func(rp *RunParams) {
+					rp.Files = []string{"testdata/validate.yaml"}
+					rp.Selector = `kind == "Deployment"`
+					rp.Actions = []string{
+						`spec.replicas = "3"`,
+						`metadata.labels.build = 42`,
+						`metadata.labels.release = true`,
+						`spec.template.spec.containers[0].ports[0].containerPort = "9090"`,
+						`metadata.annotations = {"replicas": 2}`,
+					}
+					rp.Typed = true
+				})
+
+				Expect(e).To(BeNil())
+				doc := decodeDocs(data)[0]
+				Expect(lookup(doc, "spec", "replicas")).To(Equal(3))
+				Expect(lookup(doc, "metadata", "labels", "build")).To(Equal("42"))
+				Expect(lookup(doc, "metadata", "labels", "release")).To(Equal("true"))
+				Expect(lookup(doc, "metadata", "annotations", "replicas")).To(Equal("2"))
+				Expect(lookup(doc, "spec", "template", "spec", "containers", "0", "ports", "0", "containerPort")).To(Equal(9090))
+				Expect(string(data)).To(ContainSubstring(`build: "42"`))
+			})
+
+			It("should error on numbers that may not be what was written in string fields", func() {
+				_, e := dorun(func(rp *RunParams) {
+					rp.Files = []string{"testdata/validate.yaml"}
+					rp.Selector = `kind == "Deployment"`
+					rp.Actions = []string{`metadata.labels.version = 1.10`}
+					rp.Typed = true
+				})
+
+				Expect(e).NotTo(BeNil())
+				Expect(merry.UserMessage(e)).To(ContainSubstring("can't assign 1.1 to metadata.labels.version in document 1 of 'testdata/validate.yaml'"))
+				Expect(merry.UserMessage(e)).To(ContainSubstring("quote it"))
+			})
+
+			It("should error on values that can't be converted", func() {
+				_, e := dorun(func(rp *RunParams) {
+					rp.Files = []string{"testdata/validate.yaml"}
+					rp.Selector = `kind == "Deployment"`
+					rp.Actions = []string{`spec.replicas = "three"`}
+					rp.Typed = true
+				})
+
+				Expect(e).NotTo(BeNil())
+				Expect(merry.UserMessage(e)).To(ContainSubstring("'three' is not an integer"))
+			})
+
+			It("should use CRDs from the input stream", func() {
+				data, e := dorun(func(rp *RunParams) {
+					rp.Files = []string{"testdata/crd.yaml", "testdata/validate.yaml"}
+					rp.Selector = `kind == "Widget"`
+					rp.Actions = []string{`spec.size = "5"`, `spec.extra.count = "5"`}
+					rp.Typed = true
+				})
+
+				Expect(e).To(BeNil())
+				doc := decodeDocs(data)[2]
+				Expect(lookup(doc, "spec", "size")).To(Equal(5))
+				Expect(lookup(doc, "spec", "extra", "count")).To(Equal("5"))
+			})
+
+			It("should warn and use the latest bundled schema for a version without one", func() {
+				stderr := &bytes.Buffer{}
+				Stderr = stderr
+				defer func() { Stderr = os.Stderr }()
+
+				data, e := dorun(func(rp *RunParams) {
+					rp.Files = []string{"testdata/validate.yaml"}
+					rp.Selector = `kind == "Deployment"`
+					rp.Actions = []string{`spec.replicas = "3"`}
+					rp.KubeVersion = "1.5"
+					rp.Typed = true
+				})
+
+				Expect(e).To(BeNil())
+				Expect(lookup(decodeDocs(data)[0], "spec", "replicas")).To(Equal(3))
+				Expect(stderr.String()).To(ContainSubstring("warning: no bundled schema for Kubernetes 1.5"))
+			})
+
+			It("should leave values as they are unless typed", func() {
+				data, e := dorun(func(rp *RunParams) {
+					rp.Files = []string{"testdata/validate.yaml"}
+					rp.Selector = `kind == "Deployment"`
+					rp.Actions = []string{`spec.replicas = "3"`, `metadata.labels.version = 1.10`}
+				})
+
+				Expect(e).To(BeNil())
+				Expect(lookup(decodeDocs(data)[0], "spec", "replicas")).To(Equal("3"))
+				Expect(lookup(decodeDocs(data)[0], "metadata", "labels", "version")).To(Equal(1.1))
+			})
+		})
+
+		Describe("output dir", func() {
+			BeforeEach(func() {
+				// Read testdata from disk but keep everything written in memory
+				Fs = afero.NewCopyOnWriteFs(afero.NewReadOnlyFs(afero.NewOsFs()), afero.NewMemMapFs())
+			})
+
+			AfterEach(func() {
+				Fs = afero.NewOsFs()
+			})
+
+			readOut := func(path string) string {
+				content, err := afero.ReadFile(Fs, path)
+				Expect(err).To(BeNil())
+				return string(content)
+			}
+
+			It("should write each document to a file from the layout", func() {
+				data, e := dorun(func(rp *RunParams) {
+					rp.Files = []string{"testdata/unsorted.yaml"}
+					rp.OutputDir = "out/"
+					rp.Layout = "{{namespace}}/{{kind}}-{{name}}.yaml"
+					rp.Kustomization = true
+				})
+
+				Expect(e).To(BeNil())
+				Expect(string(data)).To(Equal(""))
+				Expect(readOut("out/app/Deployment-web.yaml")).To(ContainSubstring("name: web"))
+				Expect(readOut("out/Namespace-app.yaml")).To(ContainSubstring("kind: Namespace"))
+				Expect(readOut("out/kustomization.yaml")).To(Equal(strings.Join([]string{
+					"apiVersion: kustomize.config.k8s.io/v1beta1",
+					"kind: Kustomization",
+					"resources:",
+					"- ValidatingWebhookConfiguration-webhook.yaml",
+					"- Widget-widget.yaml",
+					"- app/Deployment-web.yaml",
+					"- app/Service-web.yaml",
+					"- CustomResourceDefinition-widgets.example.com.yaml",
+					"- app/Deployment-api.yaml",
+					"- Namespace-app.yaml",
+					"",
+				}, "\n")))
+			})
+
+			It("should append documents with the same path", func() {
+				_, e := dorun(func(rp *RunParams) {
+					rp.Files = []string{"testdata/unsorted.yaml"}
+					rp.OutputDir = "out"
+					rp.Layout = "{{namespace}}/{{group}}.yaml"
+				})
+
+				Expect(e).To(BeNil())
+				docs := decodeDocs([]byte(readOut("out/app/apps.yaml")))
+				Expect(len(docs)).To(Equal(2))
+				Expect(lookup(docs[1], "metadata", "name")).To(Equal("api"))
+			})
+
+			It("should error on documents with the same path", func() {
+				_, e := dorun(func(rp *RunParams) {
+					rp.Files = []string{"testdata/dupes1.yaml", "testdata/dupes2.yaml"}
+					rp.OutputDir = "out"
+					rp.OnCollision = "error"
+				})
+
+				Expect(e).NotTo(BeNil())
+				Expect(merry.UserMessage(e)).To(ContainSubstring("document 1 of 'testdata/dupes1.yaml' and document 2 of 'testdata/dupes2.yaml' are both written to 'app/Deployment-web.yaml'"))
+			})
+
+			It("should error on paths outside the output dir", func() {
+				_, e := dorun(func(rp *RunParams) {
+					rp.Files = []string{"testdata/dupes1.yaml"}
+					rp.OutputDir = "out"
+					rp.Layout = "{{name}}/{{kind}}.yaml"
+					rp.Actions = []string{`metadata.name = ".."`}
+				})
+
+				Expect(e).NotTo(BeNil())
+				Expect(merry.UserMessage(e)).To(ContainSubstring("gives document 1 of 'testdata/dupes1.yaml' an invalid path '../Deployment.yaml'"))
+
+				_, e = dorun(func(rp *RunParams) {
+					rp.Files = []string{"testdata/dupes1.yaml"}
+					rp.OutputDir = "out"
+					rp.Layout = "../{{kind}}.yaml"
+				})
+
+				Expect(e).NotTo(BeNil())
+				Expect(merry.UserMessage(e)).To(ContainSubstring("an invalid path '../Deployment.yaml'"))
+				_, err := Fs.Stat("Deployment.yaml")
+				Expect(os.IsNotExist(err)).To(BeTrue())
+			})
+
+			It("should remove stale files when cleaning", func() {
+				_ = Fs.MkdirAll("out/old", 0755)
+				_ = Fs.MkdirAll("out/app", 0755)
+				_ = afero.WriteFile(Fs, "out/old/Deployment-gone.yaml", []byte("kind: Deployment"), 0644)
+				_ = afero.WriteFile(Fs, "out/app/Service-gone.yml", []byte("kind: Service"), 0644)
+				_ = afero.WriteFile(Fs, "out/README.md", []byte("keep me"), 0644)
+
+				_, e := dorun(func(rp *RunParams) {
+					rp.Files = []string{"testdata/dupes1.yaml"}
+					rp.OutputDir = "out"
+					rp.Clean = true
+				})
+
+				Expect(e).To(BeNil())
+				for _, path := range []string{"out/old", "out/app/Service-gone.yml"} {
+					_, err := Fs.Stat(path)
+					Expect(os.IsNotExist(err)).To(BeTrue(), path)
+				}
+				Expect(readOut("out/README.md")).To(Equal("keep me"))
+				Expect(readOut("out/app/Service-web.yaml")).To(ContainSubstring("kind: Service"))
+			})
+
+			It("should error on unknown layout fields", func() {
+				_, e := dorun(func(rp *RunParams) {
+					rp.OutputDir = "out"
+					rp.Layout = "{{cluster}}/{{name}}.yaml"
+				})
+
+				Expect(e).NotTo(BeNil())
+				Expect(merry.UserMessage(e)).To(ContainSubstring("unknown layout field 'cluster'"))
+			})
+		})
+
+		Describe("post-render", func() {
+			postRender := func(config string) (string, error) {
+				input, _ := ioutil.ReadFile("testdata/helm.yaml")
+				var out bytes.Buffer
+				err := PostRender(config, bytes.NewReader(input), nopWriteCloser{&out})
+				return out.String(), err
+			}
+
+			It("should apply each rule in turn keeping Helm's source comments", func() {
+				out, e := postRender("testdata/post-render.yaml")
+
+				Expect(e).To(BeNil())
+				Expect(out).To(HavePrefix("---\n# Source: app/templates/serviceaccount.yaml\napiVersion: v1\n"))
+				Expect(out).To(ContainSubstring("---\n# Source: app/templates/deployment.yaml\napiVersion: apps/v1\n"))
+				Expect(out).NotTo(ContainSubstring("tests/test.yaml"))
+
+				docs := decodeDocs([]byte(out))
+				Expect(len(docs)).To(Equal(2))
+				Expect(lookup(docs[1], "metadata", "name")).To(Equal("prod-app"))
+				Expect(lookup(docs[1], "metadata", "labels", "team")).To(Equal("platform"))
+				Expect(lookup(docs[1], "spec", "replicas")).To(Equal(3))
+				Expect(lookup(docs[1], "spec", "template", "spec", "serviceAccountName")).To(Equal("prod-app"))
+			})
+
+			It("should report which rule failed", func() {
+				_, e := postRender(`{rules: [{namespace: prod}, {actions: ["spec.replicas ="]}]}`)
+
+				Expect(e).NotTo(BeNil())
+				Expect(merry.UserMessage(e)).To(HavePrefix("rule 2: action expression error"))
+			})
+
+			It("should error on unknown config fields", func() {
+				_, e := postRender(`{rules: [{selectr: "true"}]}`)
+
+				Expect(e).NotTo(BeNil())
+				Expect(merry.UserMessage(e)).To(ContainSubstring("field selectr not found"))
+			})
+		})
+
+		Describe("fn", func() {
+			fn := func(edit func(string) string) (map[interface{}]interface{}, error) {
+				input, _ := ioutil.ReadFile("testdata/resourcelist.yaml")
+				var out bytes.Buffer
+				err := Fn(strings.NewReader(edit(string(input))), &out)
+				return decodeDocs(out.Bytes())[0], err
+			}
+			same := func(s string) string { return s }
+
+			It("should apply the rules in functionConfig to the items", func() {
+				list, e := fn(same)
+
+				Expect(e).To(BeNil())
+				Expect(list["kind"]).To(Equal("ResourceList"))
+				Expect(list["results"]).To(BeNil())
+				Expect(lookup(list, "items", "0", "spec", "replicas")).To(Equal(3))
+				Expect(lookup(list, "items", "1", "metadata", "annotations", "internal.config.kubernetes.io/path")).To(Equal("app/web.yaml"))
+				Expect(lookup(list, "functionConfig", "kind")).To(Equal("KPatch"))
+			})
+
+			It("should return failed assertions as results and leave the items unchanged", func() {
+				list, e := fn(func(s string) string {
+					return strings.Replace(s, `== "app"`, `== "prod"`, 1)
+				})
+
+				Expect(e).NotTo(BeNil())
+				Expect(lookup(list, "items", "0", "spec", "replicas")).To(Equal(1))
+				Expect(lookup(list, "results", "1")).To(Equal(map[interface{}]interface{}{
+					"message":     "must be in the app namespace",
+					"severity":    "error",
+					"resourceRef": map[interface{}]interface{}{"apiVersion": "v1", "kind": "Service", "name": "web", "namespace": "app"},
+					"file":        map[interface{}]interface{}{"path": "app/web.yaml", "index": 1},
+				}))
+			})
+
+			It("should return warnings as results", func() {
+				list, e := fn(func(s string) string {
+					return strings.Replace(s, "apiVersion: v1\n    kind: Service", "apiVersion: apps/v1\n    kind: Deployment", 1) + "      - dedupe: first\n"
+				})
+
+				Expect(e).To(BeNil())
+				Expect(len(list["items"].([]interface{}))).To(Equal(1))
+				Expect(lookup(list, "results", "0", "severity")).To(Equal("warning"))
+				Expect(lookup(list, "results", "0", "message")).To(ContainSubstring("duplicate apps/Deployment/app/web"))
+			})
+
+			It("should take a selector, actions and params from a ConfigMap", func() {
+				list, e := fn(func(s string) string {
+					return s[:strings.Index(s, "functionConfig:")] + strings.Join([]string{
+						"functionConfig:",
+						"  apiVersion: v1",
+						"  kind: ConfigMap",
+						"  data:",
+						`    selector: kind == "Service"`,
+						"    team: platform",
+						"    actions: |",
+						`      metadata.labels.team = param("team")`,
+						`      spec.ports[0].port = 8080`,
+						"",
+					}, "\n")
+				})
+
+				Expect(e).To(BeNil())
+				Expect(lookup(list, "items", "1", "metadata", "labels", "team")).To(Equal("platform"))
+				Expect(lookup(list, "items", "1", "spec", "ports", "0", "port")).To(Equal(8080))
+				Expect(lookup(list, "items", "0", "metadata", "labels")).To(BeNil())
+			})
+		})
+
+		Describe("query", func() {
+			It("should write the result for each selected document after actions", func() {
+				data, e := dorun(func(rp *RunParams) {
+					rp.Files = []string{"testdata/unsorted.yaml"}
+					rp.Selector = `kind == "Deployment"`
+					rp.Actions = []string{`metadata.name = "prod-" + metadata.name`}
+					rp.Query = `metadata.name`
+				})
+
+				Expect(e).To(BeNil())
+				Expect(string(data)).To(Equal("prod-web\nprod-api\n"))
+			})
+
+			It("should write maps and lists as YAML documents", func() {
+				data, e := dorun(func(rp *RunParams) {
+					rp.Files = []string{"testdata/unsorted.yaml"}
+					rp.Selector = `kind == "Service"`
+					rp.Query = `metadata`
+				})
+
+				Expect(e).To(BeNil())
+				Expect(string(data)).To(Equal("---\nname: web\nnamespace: app\n"))
+			})
+		})
+
+		Describe("diff", func() {
+			It("should list added, removed and changed resources", func() {
+				var out bytes.Buffer
+				changed, e := Diff("testdata/dupes1.yaml", "testdata/dupes2.yaml", Options{}, "", &out)
+
+				Expect(e).To(BeNil())
+				Expect(changed).To(BeTrue())
+				Expect(out.String()).To(Equal(strings.Join([]string{
+					"+ ConfigMap/app/web",
+					"- Service/app/web",
+					"~ apps/Deployment/app/web",
+					`    + metadata.annotations: {"source":"two"}`,
+					`    - metadata.labels: {"source":"one"}`,
+					"    ~ spec.replicas: 1 -> 3",
+					`    - spec.template.spec.containers[name=app]: {"image":"app:1.0","name":"app"}`,
+					`    + spec.template.spec.containers[name=sidecar]: {"image":"sidecar:2.0","name":"sidecar"}`,
+					"+ apps/Deployment/other/web",
+					"",
+				}, "\n")))
+			})
+
+			It("should report no changes for the same resources", func() {
+				var out bytes.Buffer
+				changed, e := Diff("testdata/dupes1.yaml", "testdata/dupes1.yaml", Options{}, "", &out)
+
+				Expect(e).To(BeNil())
+				Expect(changed).To(BeFalse())
+				Expect(out.String()).To(Equal(""))
+			})
+
+			It("should list changed fields matching list entries by key", func() {
+				var out bytes.Buffer
+				changed, e := Diff("testdata/diff-old.yaml", "testdata/diff-new.yaml", Options{}, "text", &out)
+
+				Expect(e).To(BeNil())
+				Expect(changed).To(BeTrue())
+				Expect(out.String()).To(Equal(strings.Join([]string{
+					"- ConfigMap/app/removed",
+					"+ Secret/app/added",
+					"~ apps/Deployment/app/web",
+					`    - metadata.labels.release: "old"`,
+					`    + metadata.labels.team: "platform"`,
+					"    ~ spec.replicas: 1 -> 3",
+					`    ~ spec.template.spec.containers[name=app].image: "app:1.0" -> "app:1.1"`,
+					`    ~ spec.template.spec.tolerations[0].effect: "NoSchedule" -> "NoExecute"`,
+					"",
+				}, "\n")))
+			})
+
+			It("should only compare selected documents", func() {
+				var out bytes.Buffer
+				changed, e := Diff("testdata/diff-old.yaml", "testdata/diff-new.yaml", Options{Selector: `kind == "Service"`}, "text", &out)
+
+				Expect(e).To(BeNil())
+				Expect(changed).To(BeFalse())
+				Expect(out.String()).To(Equal(""))
+			})
+
+			It("should write json", func() {
+				var out bytes.Buffer
+				_, e := Diff("testdata/diff-old.yaml", "testdata/diff-new.yaml", Options{Selector: `kind == "Deployment"`}, "json", &out)
+				Expect(e).To(BeNil())
+
+				var diffs []map[string]interface{}
+				Expect(json.Unmarshal(out.Bytes(), &diffs)).To(Succeed())
+				Expect(diffs).To(HaveLen(1))
+				Expect(diffs[0]["resource"]).To(Equal("apps/Deployment/app/web"))
+				Expect(diffs[0]["differences"]).To(ContainElement(map[string]interface{}{
+					"path": "spec.replicas", "change": "changed", "old": float64(1), "new": float64(3),
+				}))
+			})
+
+			It("should reject unknown formats", func() {
+				_, e := Diff("testdata/diff-old.yaml", "testdata/diff-new.yaml", Options{}, "xml", ioutil.Discard)
+				Expect(e).NotTo(BeNil())
+			})
+
+			Context("with files in memory", func() {
+				BeforeEach(func() {
+					Fs = afero.NewMemMapFs()
+				})
+
+				AfterEach(func() {
+					Fs = afero.NewOsFs()
+				})
+
+				It("should bracket keys containing dots", func() {
+					_ = afero.WriteFile(Fs, "old.yaml", []byte("kind: Service\nmetadata:\n  name: web\n  annotations:\n    example.com/team: a\n"), 0644)
+					_ = afero.WriteFile(Fs, "new.yaml", []byte("kind: Service\nmetadata:\n  name: web\n  annotations:\n    example.com/team: b\n"), 0644)
+
+					var out bytes.Buffer
+					_, e := Diff("old.yaml", "new.yaml", Options{}, "", &out)
+
+					Expect(e).To(BeNil())
+					Expect(out.String()).To(ContainSubstring(`~ metadata.annotations["example.com/team"]: "a" -> "b"`))
+				})
+
+				It("should match documents without a kind and name by position", func() {
+					_ = afero.WriteFile(Fs, "old.yaml", []byte("kind: Service\nmetadata:\n  name: web\n---\nvalue: 1\n"), 0644)
+					_ = afero.WriteFile(Fs, "new.yaml", []byte("kind: Service\nmetadata:\n  name: web\n---\nvalue: 2\n"), 0644)
+
+					var out bytes.Buffer
+					_, e := Diff("old.yaml", "new.yaml", Options{}, "", &out)
+
+					Expect(e).To(BeNil())
+					Expect(out.String()).To(Equal("~ document 2\n    ~ value: 1 -> 2\n"))
+				})
+
+				It("should error on documents with the same identity", func() {
+					_ = afero.WriteFile(Fs, "old.yaml", []byte("kind: Service\nmetadata:\n  name: web\n---\nkind: Service\nmetadata:\n  name: web\n"), 0644)
+					_ = afero.WriteFile(Fs, "new.yaml", []byte("kind: Service\nmetadata:\n  name: web\n"), 0644)
+
+					_, e := Diff("old.yaml", "new.yaml", Options{}, "", ioutil.Discard)
+
+					Expect(e).NotTo(BeNil())
+					Expect(merry.UserMessage(e)).To(Equal("'old.yaml' has more than one Service/web, use --dedupe to choose one"))
+				})
+			})
+		})
+
+		Describe("fmt", func() {
+			formatted := strings.Join([]string{
+				"# The web deployment",
+				"kind: Deployment",
+				"apiVersion: apps/v1",
+				"metadata:",
+				"  name: web",
+				"  labels:",
+				"    app: web",
+				`    version: "1.10"`,
+				"spec:",
+				"  replicas: 3",
+				"  template:",
+				"    spec:",
+				"      containers:",
+				"        - name: app",
+				"          image: app:1.0",
+				"          args: # listen port",
+				"            - --port",
+				`            - "8080"`,
+				"          env:",
+				"            - name: DEBUG",
+				`              value: "yes"`,
+				"      volumes:",
+				"        - name: config",
+				"          configMap:",
+				"            defaultMode: 0644",
+				"            name: cfg",
+				"---",
+				"apiVersion: x.example.com/v1",
+				"kind: Widget",
+				"metadata:",
+				"  name: cfg",
+				"spec:",
+				"  enabled: true",
+				"",
+			}, "\n")
+
+			BeforeEach(func() {
+				Fs = afero.NewCopyOnWriteFs(afero.NewReadOnlyFs(afero.NewOsFs()), afero.NewMemMapFs())
+			})
+
+			AfterEach(func() {
+				Fs = afero.NewOsFs()
+			})
+
+			It("should normalize indentation, quoting and separators", func() {
+				var out bytes.Buffer
+				e := Format([]string{"testdata/unformatted.yaml"}, Options{}, FormatOptions{}, &out)
+
+				Expect(e).To(BeNil())
+				Expect(out.String()).To(Equal(formatted))
+			})
+
+			It("should put apiVersion, kind, metadata and spec first", func() {
+				var out bytes.Buffer
+				e := Format([]string{"testdata/unformatted.yaml"}, Options{}, FormatOptions{SortKeys: true}, &out)
+
+				Expect(e).To(BeNil())
+				Expect(out.String()).To(HavePrefix("# The web deployment\napiVersion: apps/v1\nkind: Deployment\n"))
+			})
+
+			It("should rewrite files in place and then pass --check", func() {
+				var out bytes.Buffer
+				e := Format([]string{"testdata/unformatted.yaml"}, Options{}, FormatOptions{Check: true}, &out)
+				Expect(e).NotTo(BeNil())
+				Expect(out.String()).To(Equal("testdata/unformatted.yaml\n"))
+
+				out.Reset()
+				Expect(Format([]string{"testdata/unformatted.yaml"}, Options{}, FormatOptions{Write: true}, &out)).To(Succeed())
+				Expect(out.String()).To(Equal(""))
+				content, err := afero.ReadFile(Fs, "testdata/unformatted.yaml")
+				Expect(err).To(BeNil())
+				Expect(string(content)).To(Equal(formatted))
+
+				Expect(Format([]string{"testdata/unformatted.yaml"}, Options{}, FormatOptions{Check: true}, &out)).To(Succeed())
+				Expect(out.String()).To(Equal(""))
+			})
+
+			It("should reject indents yaml can't write", func() {
+				e := Format([]string{"testdata/unformatted.yaml"}, Options{}, FormatOptions{Indent: 1}, ioutil.Discard)
+				Expect(e).NotTo(BeNil())
+			})
+		})
+
+		Describe("trace", func() {
+			var stderr *bytes.Buffer
+
+			BeforeEach(func() {
+				stderr = &bytes.Buffer{}
+				Stderr = stderr
+				Fs = afero.NewCopyOnWriteFs(afero.NewReadOnlyFs(afero.NewOsFs()), afero.NewMemMapFs())
+			})
+
+			AfterEach(func() {
+				Stderr = os.Stderr
+				Fs = afero.NewOsFs()
+			})
+
+			It("should explain which part of the selector didn't match", func() {
+				_, e := dorun(func(rp *RunParams) {
+					rp.Files = []string{"testdata/diff-old.yaml"}
+					rp.Selector = `kind == "Deployment" && (metadata.labels.tier == "web" || metadata.name == "api")`
+					rp.Trace = true
+				})
+
+				Expect(e).To(BeNil())
+				Expect(stderr.String()).To(HavePrefix(strings.Join([]string{
+					"document 1 of 'testdata/diff-old.yaml' Deployment/app/web",
+					`  selector kind == "Deployment" && (metadata.labels.tier == "web" || metadata.name == "api") => false`,
+					`    kind == "Deployment" => true`,
+					`      kind: "Deployment"`,
+					`    (metadata.labels.tier == "web" || metadata.name == "api") => false`,
+					`      metadata.labels.tier == "web" => false`,
+					`        metadata.labels.tier: null`,
+					`      metadata.name == "api" => false`,
+					`        metadata.name: "web"`,
+					"document 2 of 'testdata/diff-old.yaml' Service/app/web",
+				}, "\n")))
+			})
+
+			It("should only explain the parts of the selector that were evaluated", func() {
+				_, e := dorun(func(rp *RunParams) {
+					rp.Files = []string{"testdata/diff-old.yaml"}
+					rp.Selector = `kind == "Service" && metadata.name == "web" && spec.replicas == 1`
+					rp.Trace = true
+				})
+
+				Expect(e).To(BeNil())
+				Expect(stderr.String()).To(HavePrefix(strings.Join([]string{
+					"document 1 of 'testdata/diff-old.yaml' Deployment/app/web",
+					`  selector kind == "Service" && metadata.name == "web" && spec.replicas == 1 => false`,
+					`    kind == "Service" => false`,
+					`      kind: "Deployment"`,
+					`    metadata.name == "web" => not evaluated`,
+					`    spec.replicas == 1 => not evaluated`,
+					"document 2 of 'testdata/diff-old.yaml' Service/app/web",
+				}, "\n")))
+			})
+
+			It("should only split the selector on && and || it was evaluated with", func() {
+				_, e := dorun(func(rp *RunParams) {
+					rp.Files = []string{"testdata/diff-old.yaml"}
+					rp.Selector = `kind == "Deployment" ? metadata.name == "web" && spec.replicas == 3 : false`
+					rp.Trace = true
+				})
+
+				Expect(e).To(BeNil())
+				Expect(stderr.String()).To(HavePrefix(strings.Join([]string{
+					"document 1 of 'testdata/diff-old.yaml' Deployment/app/web",
+					`  selector kind == "Deployment" ? metadata.name == "web" && spec.replicas == 3 : false => false`,
+					`    kind: "Deployment"`,
+					`    metadata.name: "web"`,
+					`    spec.replicas: 1`,
+					"document 2 of 'testdata/diff-old.yaml' Service/app/web",
+				}, "\n")))
+			})
+
+			It("should list the changes actions make", func() {
+				_, e := dorun(func(rp *RunParams) {
+					rp.Files = []string{"testdata/diff-old.yaml"}
+					rp.Selector = `kind == "Deployment"`
+					rp.Actions = []string{`spec.replicas = spec.replicas + 1`, `unset(metadata.labels.release)`}
+					rp.Trace = true
+				})
+
+				Expect(e).To(BeNil())
+				Expect(stderr.String()).To(ContainSubstring(strings.Join([]string{
+					"  action spec.replicas = spec.replicas + 1",
+					"    spec.replicas: 1",
+					"    set spec.replicas: 1 -> 2",
+					"  action unset(metadata.labels.release)",
+					`    metadata.labels.release: "old"`,
+					`    unset metadata.labels.release: "old"`,
+				}, "\n")))
+			})
+
+			It("should print to stderr rather than the output", func() {
+				data, e := dorun(func(rp *RunParams) {
+					rp.Files = []string{"testdata/diff-old.yaml"}
+					rp.Selector = `kind == "Service"`
+					rp.Actions = []string{`print("service", metadata.name)`}
+				})
+
+				Expect(e).To(BeNil())
+				Expect(decodeDocs(data)).To(HaveLen(3))
+				Expect(stderr.String()).To(Equal("service web\n"))
+			})
+
+			It("should print and trace to a log file", func() {
+				_, e := dorun(func(rp *RunParams) {
+					rp.Files = []string{"testdata/diff-old.yaml"}
+					rp.Selector = `kind == "Service"`
+					rp.Actions = []string{`print("service", metadata.name)`}
+					rp.Trace = true
+					rp.Log = "kpatch.log"
+				})
+
+				Expect(e).To(BeNil())
+				Expect(stderr.String()).To(Equal(""))
+				content, err := afero.ReadFile(Fs, "kpatch.log")
+				Expect(err).To(BeNil())
+				Expect(string(content)).To(ContainSubstring("service web\n  action print"))
+			})
+		})
+
+		Describe("repl", func() {
+			var output *bytes.Buffer
+
+			repl := func(opts Options, lines ...string) error {
+				return Repl([]string{"testdata/diff-old.yaml"}, opts, strings.NewReader(strings.Join(lines, "\n")+"\n"), output)
+			}
+
+			BeforeEach(func() {
+				output = &bytes.Buffer{}
+				Fs = afero.NewCopyOnWriteFs(afero.NewReadOnlyFs(afero.NewOsFs()), afero.NewMemMapFs())
+			})
+
+			AfterEach(func() {
+				Fs = afero.NewOsFs()
+			})
+
+			It("should not read documents from stdin", func() {
+				e := Repl([]string{"-"}, Options{}, strings.NewReader(""), output)
+
+				Expect(e).NotTo(BeNil())
+				Expect(merry.UserMessage(e)).To(ContainSubstring("can't read documents from stdin"))
+			})
+
+			It("should apply actions to selected documents and show the changes", func() {
+				e := repl(Options{},
+					`:select kind == "Deployment" && spec.replicas == 1`,
+					`spec.replicas = 3`,
+					`:eval spec.replicas * 2`,
+					`:ls`,
+				)
+
+				Expect(e).To(BeNil())
+				Expect(output.String()).To(ContainSubstring(strings.Join([]string{
+					`  selector kind == "Deployment" && spec.replicas == 1 => true`,
+					`    kind == "Deployment" => true`,
+					`      kind: "Deployment"`,
+					`    spec.replicas == 1 => true`,
+					`      spec.replicas: 1`,
+					`~ spec.replicas: 1 -> 3`,
+					`changed 1 of 1 selected documents`,
+					`6`,
+					`>  1: Deployment/app/web (document 1 of 'testdata/diff-old.yaml')`,
+					`   2: Service/app/web (document 2 of 'testdata/diff-old.yaml')`,
+				}, "\n")))
+			})
+
+			It("should undo actions", func() {
+				e := repl(Options{Selector: `kind == "Service"`},
+					`metadata.labels.app = "web"`,
+					`drop()`,
+					`:undo`,
+					`:undo`,
+					`:diff`,
+					`:rules`,
+				)
+
+				Expect(e).To(BeNil())
+				Expect(output.String()).To(ContainSubstring("dropped Service/app/web\n"))
+				Expect(output.String()).To(ContainSubstring("undone\nundone\nno changes\nno actions yet\n"))
+			})
+
+			It("should restore the documents when an action fails", func() {
+				e := repl(Options{Selector: `kind == "Deployment"`, Strict: true}, `spec.replicas = 2`, `metadata.name = missing.key`, `:diff`)
+
+				Expect(e).To(BeNil())
+				Expect(output.String()).To(ContainSubstring("error: action expression error: "))
+				Expect(output.String()).To(HaveSuffix("~ spec.replicas: 1 -> 2\n"))
+			})
+
+			It("should save the actions as rules that post-render applies the same way", func() {
+				e := repl(Options{},
+					`:select kind == "Deployment" && spec.replicas == 1`,
+					`spec.replicas = 3`,
+					`metadata.labels.scaled = "yes"`,
+					`:select kind == "Deployment"`,
+					`metadata.labels.tier = "web"`,
+					`metadata.labels.team = "a"`,
+					`:save rules.yaml`,
+					`:quit`,
+					`:show`,
+				)
+
+				Expect(e).To(BeNil())
+				Expect(output.String()).To(HaveSuffix("saved 3 rules to 'rules.yaml'\n"))
+
+				content, err := afero.ReadFile(Fs, "rules.yaml")
+				Expect(err).To(BeNil())
+				config, err := parsePostRenderConfig(content, "rules.yaml")
+				Expect(err).To(BeNil())
+				Expect(config.Rules).To(HaveLen(3))
+				Expect(config.Rules[0].Actions).To(Equal([]string{`spec.replicas = 3`}))
+				Expect(config.Rules[1].Selector).To(Equal(config.Rules[0].Selector))
+				Expect(config.Rules[2].Actions).To(Equal([]string{`metadata.labels.tier = "web"`, `metadata.labels.team = "a"`}))
+
+				input, err := afero.ReadFile(Fs, "testdata/diff-old.yaml")
+				Expect(err).To(BeNil())
+				out, err := config.apply(input, false, Stderr)
+				Expect(err).To(BeNil())
+				docs := decodeDocs(out)
+				Expect(lookup(docs[0], "spec", "replicas")).To(Equal(3))
+				Expect(lookup(docs[0], "metadata", "labels", "scaled")).To(BeNil())
+				Expect(lookup(docs[0], "metadata", "labels", "team")).To(Equal("a"))
+			})
+		})
+
+		Describe("check", func() {
+			It("should fail on assertions without writing anything", func() {
+				e := Check([]string{"testdata/dupes1.yaml"}, Options{Actions: []string{`assert(kind != "Service", "no services")`}})
+
+				Expect(e).NotTo(BeNil())
+				Expect(merry.UserMessage(e)).To(ContainSubstring("Service/app/web (document 2 of 'testdata/dupes1.yaml'): no services"))
+			})
+		})
+
+		Describe("leadingComments", func() {
+			It("should index comments the same way as the documents are decoded", func() {
+				Expect(leadingComments([]byte("# top\n---\na: 1\n"))).To(Equal([]string{""}))
+				Expect(leadingComments([]byte("# one\na: 1\n# not leading\n---\n---\n# three\n\n# more\nb: 2\n"))).To(Equal([]string{"# one\n", "", "# three\n# more\n"}))
+			})
+		})
+
+		Describe("hash configmaps", func() {
+			It("should suffix ConfigMap and Secret names with a content hash and update references", func() {
+				data, e := dorun(func(rp *RunParams) {
+					rp.Files = []string{"testdata/hash.yaml"}
+					rp.HashConfigMaps = "name"
+				})
+
+				Expect(e).To(BeNil())
+				docs := decodeDocs(data)
+				configName := lookup(docs[0], "metadata", "name").(string)
+				secretName := lookup(docs[1], "metadata", "name").(string)
+				Expect(configName).To(MatchRegexp("^config-[0-9a-f]{10}$"))
+				Expect(secretName).To(MatchRegexp("^secret-[0-9a-f]{10}$"))
+
+				spec := podSpec(docs[2])
+				Expect(lookup(spec, "volumes", "0", "configMap", "name")).To(Equal(configName))
+				Expect(lookup(spec, "containers", "0", "env", "0", "valueFrom", "secretKeyRef", "name")).To(Equal(secretName))
+			})
+
+			It("should change the hash when the content changes", func() {
+				before, e := dorun(func(rp *RunParams) {
+					rp.Files = []string{"testdata/hash.yaml"}
+					rp.HashConfigMaps = "name"
+				})
+				Expect(e).To(BeNil())
+
+				after, e := dorun(func(rp *RunParams) {
+					rp.Files = []string{"testdata/hash.yaml"}
+					rp.Selector = `kind == "ConfigMap"`
+					rp.Actions = []string{`data.key = "changed"`}
+					rp.HashConfigMaps = "name"
+				})
+				Expect(e).To(BeNil())
+
+				Expect(lookup(decodeDocs(before)[0], "metadata", "name")).NotTo(Equal(lookup(decodeDocs(after)[0], "metadata", "name")))
+			})
+
+			It("should add a checksum annotation to pod templates in annotation mode", func() {
+				data, e := dorun(func(rp *RunParams) {
+					rp.Files = []string{"testdata/hash.yaml"}
+					rp.HashConfigMaps = "annotation"
+				})
+
+				Expect(e).To(BeNil())
+				docs := decodeDocs(data)
+				Expect(lookup(docs[0], "metadata", "name")).To(Equal("config"))
+				Expect(lookup(docs[2], "spec", "template", "metadata", "annotations", "checksum/config")).To(MatchRegexp("^[0-9a-f]{64}$"))
+				Expect(lookup(docs[3], "spec", "template", "metadata")).To(BeNil())
+			})
+
+			It("should error on an unknown mode", func() {
+				_, e := dorun(func(rp *RunParams) {
+					rp.HashConfigMaps = "other"
+				})
+
+				Expect(e).NotTo(BeNil())
+				Expect(merry.UserMessage(e)).To(ContainSubstring("unknown hash mode 'other'"))
+			})
+		})
+
+		Describe("selector", func() {
+			It("should only match documents that match expression", func() {
+				data, e := dorun(func(rp *RunParams) {
+					rp.Selector = `name =~ ".*document1"`
+					rp.Actions = []string{`drop`}
+				})
+
+				Expect(e).To(BeNil())
+				docs := decodeDocs(data)
+
+				Expect(docs).To(HaveLen(2))
+				Expect(docs[0]["name"]).To(Equal("input1document2"))
+				Expect(docs[1]["name"]).To(Equal("input2document2"))
+			})
+
+			It("should not allow assignments in selector", func() {
+				_, e := dorun(func(rp *RunParams) {
+					rp.Selector = `test = 123`
+				})
+
+				Expect(e).NotTo(BeNil())
+				Expect(merry.UserMessage(e)).To(ContainSubstring("unexpected \"=\""))
+			})
+
+			// TODO: Expand to other mutating functions (e.g. merge)
+			It("should not allow mutating functions in selector", func() {
+				_, e := dorun(func(rp *RunParams) {
+					rp.Selector = `unset(name)`
+				})
+
+				Expect(e).NotTo(BeNil())
+				Expect(merry.UserMessage(e)).To(ContainSubstring("could not call 'unset'"))
+			})
+
+			It("should match all documents if not specified", func() {
+				data, e := dorun(func(rp *RunParams) {
+					rp.Actions = []string{`drop`}
+				})
+
+				Expect(e).To(BeNil())
+				docs := decodeDocs(data)
+				Expect(docs).To(HaveLen(0))
+			})
+		})
+
+		Describe("Action language", func() {
+			Describe("drop", func() {
+				It("should drop matching documents", func() {
+					data, e := dorun(func(rp *RunParams) {
+						rp.Selector = `name == "input1document1"`
+						rp.Actions = []string{`drop`}
+					})
+
+					Expect(e).To(BeNil())
+					docs := decodeDocs(data)
+					names := make([]string, 0)
+					for _, doc := range docs {
+						names = append(names, doc["name"].(string))
+					}
+
+					Expect(names).To(HaveLen(3))
+					Expect(names).NotTo(ContainElement("input1document1"))
+				})
+			})
+
+			Describe("assert", func() {
+				It("should fail listing every document where the condition doesn't hold", func() {
+					data, e := dorun(func(rp *RunParams) {
+						rp.Actions = []string{`assert(name != "input1document2" && name != "input2document1", "name is reserved")`}
+					})
+
+					Expect(e).NotTo(BeNil())
+					Expect(string(data)).To(Equal(""))
+					msg := merry.UserMessage(e)
+					Expect(msg).To(HavePrefix("assertions failed:\n"))
+					Expect(msg).To(ContainSubstring("(document 2 of 'testdata/input1.yaml'): name is reserved\n"))
+					Expect(msg).To(HaveSuffix("(document 1 of 'testdata/input2.yaml'): name is reserved"))
+				})
+
+				It("should pass when the condition holds", func() {
+					_, e := dorun(func(rp *RunParams) {
+						rp.Actions = []string{`assert(has("name"), "name is required")`}
+					})
+
+					Expect(e).To(BeNil())
+				})
+
+				It("should error if the message isn't a string", func() {
+					_, e := dorun(func(rp *RunParams) {
+						rp.Actions = []string{`assert(true, 1)`}
+					})
+
+					Expect(e).NotTo(BeNil())
+					Expect(merry.UserMessage(e)).To(ContainSubstring("expects message to be a string"))
+				})
+			})
+
+			Describe("assign", func() {
+				It("should set field if action is assignment", func() {
+					data, e := dorun(func(rp *RunParams) {
+						rp.Actions = []string{`maptype = "hello"`}
+					})
+
+					Expect(e).To(BeNil())
+					docs := decodeDocs(data)
+
+					Expect(docs[0]["maptype"]).To(Equal("hello"))
+				})
+
+				It("should create key if key on left hand side does not exist", func() {
+					data, e := dorun(func(rp *RunParams) {
+						rp.Actions = []string{`newval = "hello"`}
+					})
+
+					Expect(e).To(BeNil())
+					docs := decodeDocs(data)
+
+					Expect(docs[0]["newval"]).To(Equal("hello"))
+				})
+
+				It("should assign nil if key on right hand side does not exist", func() {
+					data, e := dorun(func(rp *RunParams) {
+						rp.Actions = []string{`maptype = noexist`}
+					})
+
+					Expect(e).To(BeNil())
+					docs := decodeDocs(data)
+
+					Expect(docs[0]["maptype"]).To(BeNil())
+				})
+			})
+
+			Describe("unset", func() {
+				It("should unset field", func() {
+					data, e := dorun(func(rp *RunParams) {
+						rp.Actions = []string{`unset(name)`}
+					})
+
+					docs := decodeDocs(data)
+
+					Expect(e).To(BeNil())
+					Expect(docs[0]["name"]).To(BeNil())
+				})
+
+				It("should unset multiple fields", func() {
+					data, e := dorun(func(rp *RunParams) {
+						rp.Actions = []string{`unset(name, maptype)`}
+					})
+
+					docs := decodeDocs(data)
+
+					Expect(e).To(BeNil())
+					Expect(docs[0]["name"]).To(BeNil())
+					Expect(docs[0]["maptype"]).To(BeNil())
+				})
+
+				It("should unset array elements", func() {
+					data, e := dorun(func(rp *RunParams) {
+						rp.Actions = []string{`list | if(@ > 1, @) | unset(@)`}
+					})
+
+					docs := decodeDocs(data)
+
+					Expect(e).To(BeNil())
+					Expect(docs[1]["list"]).To(HaveLen(1))
+				})
+
+				It("should not do anything if key does not exist", func() {
+					before, e := dorun(func(rp *RunParams) {})
+					Expect(e).To(BeNil())
+
+					after, e := dorun(func(rp *RunParams) {
+						rp.Actions = []string{`unset(n)`}
+					})
+
+					Expect(e).To(BeNil())
+					Expect(before).To(Equal(after))
+				})
+
+				It("should error if argument count < 1", func() {
+					_, e := dorun(func(rp *RunParams) {
+						rp.Actions = []string{`unset()`}
+					})
+
+					Expect(e).NotTo(BeNil())
+					Expect(merry.UserMessage(e)).To(ContainSubstring("unset(var, ...) requires one or more argument to unset"))
+				})
+			})
+
+			Describe("@ variable", func() {
+				It("should return root outside of pipeline", func() {
+					before, e := dorun(func(rp *RunParams) {})
+					Expect(e).To(BeNil())
+
+					after, e := dorun(func(rp *RunParams) {
+						rp.Actions = []string{`tmp = @`}
+					})
+
+					docsBefore := decodeDocs(before)
+					docs := decodeDocs(after)
+
+					Expect(e).To(BeNil())
+					Expect(docs[0]["tmp"]).NotTo(BeNil())
+					Expect(docs[0]["tmp"]).To(Equal(docsBefore[0]))
+				})
+
+				It("should return current item inside pipeline", func() {
+					data, e := dorun(func(rp *RunParams) {
+						rp.Selector = `name == "input1document2"`
+						rp.Actions = []string{`list | @ = "X"`}
+					})
+
+					docs := decodeDocs(data)
+
+					Expect(e).To(BeNil())
+					Expect(docs[1]["list"]).To(HaveLen(3))
+
+					var items []string
+					for _, i := range docs[1]["list"].([]interface{}) {
+						items = append(items, i.(string))
+					}
+					Expect(strings.Join(items, ".")).To(Equal("X.X.X"))
+				})
+			})
+
+			Describe("v", func() {
+				It("should return var at path by args", func() {
+					data, e := dorun(func(rp *RunParams) {
+						rp.Selector = `name == "input1document1"`
+						rp.Actions = []string{`test = v(["maptype", "k1", "k1"])`}
+					})
+
+					docs := decodeDocs(data)
+
+					Expect(e).To(BeNil())
+					Expect(docs[0]["test"]).To(Equal("l2value"))
+				})
+
+				It("should return error if arg is not a slice", func() {
+					_, e := dorun(func(rp *RunParams) {
+						rp.Selector = `name == "input1document1"`
+						rp.Actions = []string{`test = v("test")`}
+					})
+
+					Expect(e).NotTo(BeNil())
+					Expect(merry.UserMessage(e)).To(ContainSubstring("v(path) expects path to be a slice"))
+				})
+
+				It("should return error if path invalid", func() {
+					_, e := dorun(func(rp *RunParams) {
+						rp.Selector = `name == "input1document1"`
+						rp.Actions = []string{`v(["test"])`}
+					})
+
+					Expect(e).NotTo(BeNil())
+					Expect(merry.UserMessage(e)).To(ContainSubstring("key does not exist"))
+				})
+
+				It("should return error if argument count != 1", func() {
+					_, e := dorun(func(rp *RunParams) {
+						rp.Selector = `name == "input1document1"`
+						rp.Actions = []string{`v(["test"], "other")`}
+					})
+
+					Expect(e).NotTo(BeNil())
+					Expect(merry.UserMessage(e)).To(ContainSubstring("requires exactly one argument"))
+				})
+			})
+
+			Describe("strict", func() {
+				It("should error naming the path and document when selector reads a missing key", func() {
+					_, e := dorun(func(rp *RunParams) {
+						rp.Strict = true
+						rp.Selector = `metdata.name == "x"`
+					})
+
+					Expect(e).NotTo(BeNil())
+					Expect(merry.UserMessage(e)).To(ContainSubstring("key 'metdata.name' does not exist in document 1 of 'testdata/input1.yaml'"))
+				})
+
+				It("should error when action reads a missing key", func() {
+					_, e := dorun(func(rp *RunParams) {
+						rp.Strict = true
+						rp.Actions = []string{`maptype = noexist`}
+					})
+
+					Expect(e).NotTo(BeNil())
+					Expect(merry.UserMessage(e)).To(ContainSubstring("key 'noexist' does not exist"))
+				})
+
+				It("should still allow assignment to missing keys", func() {
+					data, e := dorun(func(rp *RunParams) {
+						rp.Strict = true
+						rp.Actions = []string{`newval = "hello"`}
+					})
+
+					Expect(e).To(BeNil())
+					docs := decodeDocs(data)
+					Expect(docs[0]["newval"]).To(Equal("hello"))
+				})
+			})
+
+			Describe("has", func() {
+				It("should return whether the path exists", func() {
+					data, e := dorun(func(rp *RunParams) {
+						rp.Strict = true
+						rp.Selector = `has("maptype.k1")`
+						rp.Actions = []string{`drop()`}
+					})
+
+					Expect(e).To(BeNil())
+					docs := decodeDocs(data)
+					Expect(docs).To(HaveLen(3))
+					for _, doc := range docs {
+						Expect(doc["name"]).NotTo(Equal("input1document1"))
+					}
+				})
+
+				It("should accept a slice path", func() {
+					data, e := dorun(func(rp *RunParams) {
+						rp.Actions = []string{`test = has(["maptype", "k1", "k1"])`}
+					})
+
+					Expect(e).To(BeNil())
+					docs := decodeDocs(data)
+					Expect(docs[0]["test"]).To(BeTrue())
+					Expect(docs[1]["test"]).To(BeFalse())
+				})
+
+				It("should look up paths starting with @ in the current item", func() {
+					data, e := dorun(func(rp *RunParams) {
+						rp.Actions = []string{`test = filter([maptype, {}], "has(\"@.k1\")")`}
+					})
+
+					Expect(e).To(BeNil())
+					docs := decodeDocs(data)
+					Expect(docs[0]["test"]).To(HaveLen(1))
+				})
+			})
+
+			Describe("get", func() {
+				It("should return the value at path or the default", func() {
+					data, e := dorun(func(rp *RunParams) {
+						rp.Strict = true
+						rp.Actions = []string{`test = get("maptype.k1.k1", "default")`}
+					})
+
+					Expect(e).To(BeNil())
+					docs := decodeDocs(data)
+					Expect(docs[0]["test"]).To(Equal("l2value"))
+					Expect(docs[1]["test"]).To(Equal("default"))
+				})
+
+				It("should look up paths starting with @ in the current item", func() {
+					data, e := dorun(func(rp *RunParams) {
+						rp.Actions = []string{`test = map([maptype], "get([\"@\", \"k1\", \"k1\"], \"default\")")`}
+					})
+
+					Expect(e).To(BeNil())
+					docs := decodeDocs(data)
+					Expect(docs[0]["test"]).To(Equal([]interface{}{"l2value"}))
+					Expect(docs[1]["test"]).To(Equal([]interface{}{"default"}))
+				})
+
+				It("should error if argument count != 2", func() {
+					_, e := dorun(func(rp *RunParams) {
+						rp.Actions = []string{`test = get("name")`}
+					})
+
+					Expect(e).NotTo(BeNil())
+					Expect(merry.UserMessage(e)).To(ContainSubstring("requires exactly two arguments"))
+				})
+			})
+
+			Describe("param", func() {
+				It("should return the named param", func() {
+					data, e := dorun(func(rp *RunParams) {
+						rp.Params = []string{"env=prod"}
+						rp.Actions = []string{`test = param("env")`}
+					})
+
+					Expect(e).To(BeNil())
+					docs := decodeDocs(data)
+					Expect(docs[0]["test"]).To(Equal("prod"))
+				})
+
+				It("should error if param was not provided", func() {
+					_, e := dorun(func(rp *RunParams) {
+						rp.Actions = []string{`test = param("env")`}
+					})
+
+					Expect(e).NotTo(BeNil())
+					Expect(merry.UserMessage(e)).To(ContainSubstring("param 'env' was not provided"))
+				})
+			})
+
+			Describe("merge", func() {
 				PIt("should deep merge two documents")
 				PIt("should error if types are not maps")
 				PIt("should error if argument count < 2")
 			})
 
-			Describe("yaml_parse", func() {
-				It("should parse yaml string provided", func() {
+			Describe("yaml_parse", func() {
+				It("should parse yaml string provided", func() {
+					data, e := dorun(func(rp *RunParams) {
+						rp.Actions = []string{`test = yaml_parse("{ key: val }")`}
+					})
+
+					Expect(e).To(BeNil())
+
+					docs := decodeDocs(data)
+					Expect(docs[0]["test"]).NotTo(BeNil())
+					test := docs[0]["test"].(map[interface{}]interface{})
+					Expect(test["key"]).To(Equal("val"))
+				})
+
+				It("should load yaml from filesystem if file exists", func() {
+					data, e := dorun(func(rp *RunParams) {
+						rp.Actions = []string{`test = yaml_parse("testdata/yaml.yaml")`}
+					})
+
+					Expect(e).To(BeNil())
+
+					docs := decodeDocs(data)
+					Expect(docs[0]["test"]).NotTo(BeNil())
+					test := docs[0]["test"].(map[interface{}]interface{})
+					Expect(test["test"]).To(Equal(1234))
+				})
+
+				It("should error on a parse error", func() {
+					_, e := dorun(func(rp *RunParams) {
+						rp.Actions = []string{`test = yaml_parse("{{{ x")`}
+					})
+
+					Expect(e).NotTo(BeNil())
+					Expect(merry.UserMessage(e)).To(ContainSubstring("yaml: line 1: did not find expected"))
+				})
+
+				It("should error if argument is not a string", func() {
+					_, e := dorun(func(rp *RunParams) {
+						rp.Actions = []string{`yaml_parse([])`}
+					})
+
+					Expect(e).NotTo(BeNil())
+					Expect(merry.UserMessage(e)).To(ContainSubstring("expects input to be a string"))
+				})
+
+				It("should error if argument count != 1", func() {
+					_, e := dorun(func(rp *RunParams) {
+						rp.Actions = []string{`yaml_parse()`}
+					})
+
+					Expect(e).NotTo(BeNil())
+					Expect(merry.UserMessage(e)).To(ContainSubstring("requires exactly one argument"))
+				})
+			})
+
+			Describe("yaml_dump", func() {
+				PIt("should return variable as yaml string provided")
+				PIt("should error if input can't be marshalled")
+				PIt("should error if argument count != 1")
+			})
+
+			Describe("b64encode", func() {
+				It("should base64 encode input", func() {
+					data, e := dorun(func(rp *RunParams) {
+						rp.Actions = []string{`test = b64encode("test")`}
+					})
+
+					Expect(e).To(BeNil())
+
+					docs := decodeDocs(data)
+					Expect(docs[0]["test"]).To(Equal("dGVzdA=="))
+				})
+
+				It("should error if argument count != 1", func() {
+					_, e := dorun(func(rp *RunParams) {
+						rp.Actions = []string{`test = b64encode()`}
+					})
+
+					Expect(e).NotTo(BeNil())
+					Expect(merry.UserMessage(e)).To(ContainSubstring("requires exactly one argument"))
+				})
+			})
+
+			Describe("b64decode", func() {
+				It("should base64 decode input", func() {
+					data, e := dorun(func(rp *RunParams) {
+						rp.Actions = []string{`test = b64decode("dGVzdA==")`}
+					})
+
+					Expect(e).To(BeNil())
+
+					docs := decodeDocs(data)
+					Expect(docs[0]["test"]).To(Equal("test"))
+				})
+
+				It("should error on problem with decode", func() {
+					_, e := dorun(func(rp *RunParams) {
+						rp.Actions = []string{`test = b64decode("XXXXXXX")`}
+					})
+
+					Expect(e).NotTo(BeNil())
+					Expect(merry.UserMessage(e)).To(ContainSubstring("illegal base64 data"))
+				})
+
+				It("should error if argument count != 1", func() {
+					_, e := dorun(func(rp *RunParams) {
+						rp.Actions = []string{`test = b64decode()`}
+					})
+
+					Expect(e).NotTo(BeNil())
+					Expect(merry.UserMessage(e)).To(ContainSubstring("requires exactly one argument"))
+				})
+
+				It("should error if first argument is not a string", func() {
+					_, e := dorun(func(rp *RunParams) {
+						rp.Actions = []string{`test = b64decode([])`}
+					})
+
+					Expect(e).NotTo(BeNil())
+					Expect(merry.UserMessage(e)).To(ContainSubstring("expects input to be a string"))
+				})
+			})
+
+			Describe("upper", func() {
+				It("should upper case input", func() {
+					data, e := dorun(func(rp *RunParams) {
+						rp.Actions = []string{`test = upper("Hello")`}
+					})
+
+					Expect(e).To(BeNil())
+
+					docs := decodeDocs(data)
+					Expect(docs[0]["test"]).To(Equal("HELLO"))
+				})
+
+				It("should error if argument is not a string", func() {
+					_, e := dorun(func(rp *RunParams) {
+						rp.Actions = []string{`test = upper(1)`}
+					})
+
+					Expect(e).NotTo(BeNil())
+					Expect(merry.UserMessage(e)).To(ContainSubstring("upper(input) expects arguments to be strings"))
+				})
+			})
+
+			Describe("lower", func() {
+				It("should lower case input", func() {
+					data, e := dorun(func(rp *RunParams) {
+						rp.Actions = []string{`test = lower("Hello")`}
+					})
+
+					Expect(e).To(BeNil())
+
+					docs := decodeDocs(data)
+					Expect(docs[0]["test"]).To(Equal("hello"))
+				})
+			})
+
+			Describe("trim", func() {
+				It("should strip leading and trailing whitespace", func() {
+					data, e := dorun(func(rp *RunParams) {
+						rp.Actions = []string{`test = trim("  hello \n")`}
+					})
+
+					Expect(e).To(BeNil())
+
+					docs := decodeDocs(data)
+					Expect(docs[0]["test"]).To(Equal("hello"))
+				})
+			})
+
+			Describe("replace", func() {
+				It("should replace all occurrences", func() {
+					data, e := dorun(func(rp *RunParams) {
+						rp.Actions = []string{`test = replace("a-b-c", "-", ".")`}
+					})
+
+					Expect(e).To(BeNil())
+
+					docs := decodeDocs(data)
+					Expect(docs[0]["test"]).To(Equal("a.b.c"))
+				})
+
+				It("should error if argument count != 3", func() {
+					_, e := dorun(func(rp *RunParams) {
+						rp.Actions = []string{`test = replace("a", "b")`}
+					})
+
+					Expect(e).NotTo(BeNil())
+					Expect(merry.UserMessage(e)).To(ContainSubstring("requires exactly 3 arguments"))
+				})
+			})
+
+			Describe("regex_replace", func() {
+				It("should replace matches with expanded replacement", func() {
+					data, e := dorun(func(rp *RunParams) {
+						rp.Actions = []string{`test = regex_replace("repo/image:1.2", ":(.*)$", "@$1")`}
+					})
+
+					Expect(e).To(BeNil())
+
+					docs := decodeDocs(data)
+					Expect(docs[0]["test"]).To(Equal("repo/image@1.2"))
+				})
+
+				It("should error on an invalid pattern", func() {
+					_, e := dorun(func(rp *RunParams) {
+						rp.Actions = []string{`test = regex_replace("a", "(", "b")`}
+					})
+
+					Expect(e).NotTo(BeNil())
+					Expect(merry.UserMessage(e)).To(ContainSubstring("invalid pattern"))
+				})
+			})
+
+			Describe("regex_match", func() {
+				It("should return the match and capture groups", func() {
+					data, e := dorun(func(rp *RunParams) {
+						rp.Actions = []string{`test = regex_match(name, "^(input[0-9])(.*)$")`}
+					})
+
+					Expect(e).To(BeNil())
+
+					docs := decodeDocs(data)
+					Expect(docs[0]["test"]).To(Equal([]interface{}{"input1document1", "input1", "document1"}))
+				})
+
+				It("should return nil if there is no match", func() {
+					data, e := dorun(func(rp *RunParams) {
+						rp.Actions = []string{`test = regex_match(name, "^nomatch$")`}
+					})
+
+					Expect(e).To(BeNil())
+
+					docs := decodeDocs(data)
+					Expect(docs[0]["test"]).To(BeNil())
+				})
+			})
+
+			Describe("split", func() {
+				It("should split input into a list", func() {
+					data, e := dorun(func(rp *RunParams) {
+						rp.Actions = []string{`test = split("a,b,c", ",")`}
+					})
+
+					Expect(e).To(BeNil())
+
+					docs := decodeDocs(data)
+					Expect(docs[0]["test"]).To(Equal([]interface{}{"a", "b", "c"}))
+				})
+			})
+
+			Describe("join", func() {
+				It("should join list elements with separator", func() {
+					data, e := dorun(func(rp *RunParams) {
+						rp.Actions = []string{`test = join(["a", 1, "c"], "-")`}
+					})
+
+					Expect(e).To(BeNil())
+
+					docs := decodeDocs(data)
+					Expect(docs[0]["test"]).To(Equal("a-1-c"))
+				})
+			})
+
+			Describe("has_prefix", func() {
+				It("should return whether input has prefix", func() {
+					data, e := dorun(func(rp *RunParams) {
+						rp.Actions = []string{`test = has_prefix(name, "input1")`}
+					})
+
+					Expect(e).To(BeNil())
+
+					docs := decodeDocs(data)
+					Expect(docs[0]["test"]).To(BeTrue())
+				})
+			})
+
+			Describe("has_suffix", func() {
+				It("should return whether input has suffix", func() {
+					data, e := dorun(func(rp *RunParams) {
+						rp.Actions = []string{`test = has_suffix(name, "document2")`}
+					})
+
+					Expect(e).To(BeNil())
+
+					docs := decodeDocs(data)
+					Expect(docs[0]["test"]).To(BeFalse())
+				})
+			})
+
+			Describe("trunc", func() {
+				It("should truncate to 63 characters by default", func() {
+					data, e := dorun(func(rp *RunParams) {
+						rp.Actions = []string{`test = trunc(printf("%s%s%s%s%s", name, name, name, name, name))`}
+					})
+
+					Expect(e).To(BeNil())
+
+					docs := decodeDocs(data)
+					Expect(docs[0]["test"]).To(HaveLen(63))
+				})
+
+				It("should truncate to length and strip trailing separators", func() {
+					data, e := dorun(func(rp *RunParams) {
+						rp.Actions = []string{`test = trunc("my-app-name", 7)`}
+					})
+
+					Expect(e).To(BeNil())
+
+					docs := decodeDocs(data)
+					Expect(docs[0]["test"]).To(Equal("my-app"))
+				})
+
+				It("should not change input shorter than length", func() {
+					data, e := dorun(func(rp *RunParams) {
+						rp.Actions = []string{`test = trunc("short", 10)`}
+					})
+
+					Expect(e).To(BeNil())
+
+					docs := decodeDocs(data)
+					Expect(docs[0]["test"]).To(Equal("short"))
+				})
+
+				It("should count characters rather than bytes", func() {
+					data, e := dorun(func(rp *RunParams) {
+						rp.Actions = []string{`test = trunc("héllo-wörld", 4)`}
+					})
+
+					Expect(e).To(BeNil())
+
+					docs := decodeDocs(data)
+					Expect(docs[0]["test"]).To(Equal("héll"))
+				})
+
+				It("should error if length is less than 1", func() {
+					_, e := dorun(func(rp *RunParams) {
+						rp.Actions = []string{`test = trunc("short", 0)`}
+					})
+
+					Expect(e).NotTo(BeNil())
+					Expect(merry.UserMessage(e)).To(ContainSubstring("expects length to be a positive number"))
+				})
+			})
+
+			Describe("printf", func() {
+				It("should format arguments", func() {
+					data, e := dorun(func(rp *RunParams) {
+						rp.Actions = []string{`test = printf("%s-%d", name, 3)`}
+					})
+
+					Expect(e).To(BeNil())
+
+					docs := decodeDocs(data)
+					Expect(docs[0]["test"]).To(Equal("input1document1-3"))
+				})
+
+				It("should leave numbers given to float verbs as floats", func() {
+					data, e := dorun(func(rp *RunParams) {
+						rp.Actions = []string{`test = printf("%.2f %d%% %*d %v", 3, 50, 4, 7, 1.5)`}
+					})
+
+					Expect(e).To(BeNil())
+
+					docs := decodeDocs(data)
+					Expect(docs[0]["test"]).To(Equal("3.00 50%    7 1.5"))
+				})
+			})
+
+			Describe("sha256", func() {
+				It("should return the hex sha256 of input", func() {
+					data, e := dorun(func(rp *RunParams) {
+						rp.Actions = []string{`test = sha256("test")`}
+					})
+
+					Expect(e).To(BeNil())
+
+					docs := decodeDocs(data)
+					Expect(docs[0]["test"]).To(Equal("9f86d081884c7d659a2feaa0c55ad015a3bf4f1b2b0b822cd15d6c15b0f00a08"))
+				})
+			})
+
+			Describe("map", func() {
+				It("should evaluate expr for each element", func() {
+					data, e := dorun(func(rp *RunParams) {
+						rp.Selector = `name == "input1document1"`
+						rp.Actions = []string{`test = map(maptype.k2, "@ * 2")`}
+					})
+
+					Expect(e).To(BeNil())
+
+					docs := decodeDocs(data)
+					Expect(docs[0]["test"]).To(Equal([]interface{}{2, 4, 6}))
+				})
+
+				It("should propagate errors from expr", func() {
+					_, e := dorun(func(rp *RunParams) {
+						rp.Strict = true
+						rp.Selector = `name == "input1document1"`
+						rp.Actions = []string{`test = map(maptype.k2, "@.missing")`}
+					})
+
+					Expect(e).NotTo(BeNil())
+					Expect(merry.UserMessage(e)).To(ContainSubstring("map(list, expr) error evaluating expr"))
+				})
+
+				It("should error if list is not a slice", func() {
+					_, e := dorun(func(rp *RunParams) {
+						rp.Actions = []string{`test = map("x", "@")`}
+					})
+
+					Expect(e).NotTo(BeNil())
+					Expect(merry.UserMessage(e)).To(ContainSubstring("expects list to be a slice"))
+				})
+			})
+
+			Describe("filter", func() {
+				It("should return elements matching pred", func() {
 					data, e := dorun(func(rp *RunParams) {
-						rp.Actions = []string{`test = yaml_parse("{ key: val }")`}
+						rp.Selector = `name == "input1document1"`
+						rp.Actions = []string{`test = filter(maptype.k2, "@ > 1")`}
 					})
 
 					Expect(e).To(BeNil())
 
 					docs := decodeDocs(data)
-					Expect(docs[0]["test"]).NotTo(BeNil())
-					test := docs[0]["test"].(map[interface{}]interface{})
-					Expect(test["key"]).To(Equal("val"))
+					Expect(docs[0]["test"]).To(Equal([]interface{}{2, 3}))
 				})
+			})
 
-				It("should load yaml from filesystem if file exists", func() {
+			Describe("find", func() {
+				It("should return the first element matching pred", func() {
 					data, e := dorun(func(rp *RunParams) {
-						rp.Actions = []string{`test = yaml_parse("testdata/yaml.yaml")`}
+						rp.Selector = `name == "input1document1"`
+						rp.Actions = []string{`test = find(maptype.k2, "@ > 1")`}
 					})
 
 					Expect(e).To(BeNil())
 
 					docs := decodeDocs(data)
-					Expect(docs[0]["test"]).NotTo(BeNil())
-					test := docs[0]["test"].(map[interface{}]interface{})
-					Expect(test["test"]).To(Equal(1234))
+					Expect(docs[0]["test"]).To(Equal(2))
 				})
+			})
 
-				It("should error on a parse error", func() {
-					_, e := dorun(func(rp *RunParams) {
-						rp.Actions = []string{`test = yaml_parse("{{{ x")`}
+			Describe("any", func() {
+				It("should return whether any element matches pred", func() {
+					data, e := dorun(func(rp *RunParams) {
+						rp.Selector = `name == "input1document1"`
+						rp.Actions = []string{`test = any(maptype.k2, "@ > 2")`}
 					})
 
-					Expect(e).NotTo(BeNil())
-					Expect(merry.UserMessage(e)).To(ContainSubstring("yaml: line 1: did not find expected"))
+					Expect(e).To(BeNil())
+
+					docs := decodeDocs(data)
+					Expect(docs[0]["test"]).To(BeTrue())
 				})
+			})
 
-				It("should error if argument is not a string", func() {
-					_, e := dorun(func(rp *RunParams) {
-						rp.Actions = []string{`yaml_parse([])`}
+			Describe("all", func() {
+				It("should return whether all elements match pred", func() {
+					data, e := dorun(func(rp *RunParams) {
+						rp.Selector = `name == "input1document1"`
+						rp.Actions = []string{`test = all(maptype.k2, "@ > 2")`}
 					})
 
-					Expect(e).NotTo(BeNil())
-					Expect(merry.UserMessage(e)).To(ContainSubstring("expects input to be a string"))
+					Expect(e).To(BeNil())
+
+					docs := decodeDocs(data)
+					Expect(docs[0]["test"]).To(BeFalse())
 				})
+			})
 
-				It("should error if argument count != 1", func() {
-					_, e := dorun(func(rp *RunParams) {
-						rp.Actions = []string{`yaml_parse()`}
+			Describe("keys", func() {
+				It("should return sorted map keys", func() {
+					data, e := dorun(func(rp *RunParams) {
+						rp.Selector = `name == "input1document1"`
+						rp.Actions = []string{`test = keys(maptype)`}
 					})
 
-					Expect(e).NotTo(BeNil())
-					Expect(merry.UserMessage(e)).To(ContainSubstring("requires exactly one argument"))
+					Expect(e).To(BeNil())
+
+					docs := decodeDocs(data)
+					Expect(docs[0]["test"]).To(Equal([]interface{}{"k1", "k2"}))
 				})
 			})
 
-			Describe("yaml_dump", func() {
-				PIt("should return variable as yaml string provided")
-				PIt("should error if input can't be marshalled")
-				PIt("should error if argument count != 1")
+			Describe("values", func() {
+				It("should return map values in key order", func() {
+					data, e := dorun(func(rp *RunParams) {
+						rp.Selector = `name == "input1document1"`
+						rp.Actions = []string{`test = values(maptype.k1)`}
+					})
+
+					Expect(e).To(BeNil())
+
+					docs := decodeDocs(data)
+					Expect(docs[0]["test"]).To(Equal([]interface{}{"l2value"}))
+				})
 			})
 
-			Describe("b64encode", func() {
-				It("should base64 encode input", func() {
+			Describe("len", func() {
+				It("should return the length of strings, slices and maps", func() {
 					data, e := dorun(func(rp *RunParams) {
-						rp.Actions = []string{`test = b64encode("test")`}
+						rp.Selector = `name == "input1document1"`
+						rp.Actions = []string{`test = [len(name), len(maptype.k2), len(maptype)]`}
 					})
 
 					Expect(e).To(BeNil())
 
 					docs := decodeDocs(data)
-					Expect(docs[0]["test"]).To(Equal("dGVzdA=="))
+					Expect(docs[0]["test"]).To(Equal([]interface{}{15, 3, 2}))
 				})
+			})
 
-				It("should error if argument count != 1", func() {
-					_, e := dorun(func(rp *RunParams) {
-						rp.Actions = []string{`test = b64encode()`}
+			Describe("sort_by", func() {
+				It("should sort elements by expr", func() {
+					data, e := dorun(func(rp *RunParams) {
+						rp.Selector = `name == "input1document1"`
+						rp.Actions = []string{`test = sort_by(maptype.k2, "-@")`}
 					})
 
-					Expect(e).NotTo(BeNil())
-					Expect(merry.UserMessage(e)).To(ContainSubstring("requires exactly one argument"))
+					Expect(e).To(BeNil())
+
+					docs := decodeDocs(data)
+					Expect(docs[0]["test"]).To(Equal([]interface{}{3, 2, 1}))
 				})
 			})
 
-			Describe("b64decode", func() {
-				It("should base64 decode input", func() {
+			Describe("uniq", func() {
+				It("should remove duplicate elements", func() {
 					data, e := dorun(func(rp *RunParams) {
-						rp.Actions = []string{`test = b64decode("dGVzdA==")`}
+						rp.Selector = `name == "input1document1"`
+						rp.Actions = []string{`test = uniq([1, 2, 1, "a", "a"])`}
 					})
 
 					Expect(e).To(BeNil())
 
 					docs := decodeDocs(data)
-					Expect(docs[0]["test"]).To(Equal("test"))
+					Expect(docs[0]["test"]).To(Equal([]interface{}{1, 2, "a"}))
 				})
+			})
 
-				It("should error on problem with decode", func() {
-					_, e := dorun(func(rp *RunParams) {
-						rp.Actions = []string{`test = b64decode("XXXXXXX")`}
+			Describe("flatten", func() {
+				It("should flatten nested lists", func() {
+					data, e := dorun(func(rp *RunParams) {
+						rp.Selector = `name == "input1document1"`
+						rp.Actions = []string{`test = flatten([1, [2, [3]], maptype.k2])`}
 					})
 
-					Expect(e).NotTo(BeNil())
-					Expect(merry.UserMessage(e)).To(ContainSubstring("illegal base64 data"))
+					Expect(e).To(BeNil())
+
+					docs := decodeDocs(data)
+					Expect(docs[0]["test"]).To(Equal([]interface{}{1, 2, 3, 1, 2, 3}))
 				})
+			})
 
-				It("should error if argument count != 1", func() {
+			Describe("group_by", func() {
+				It("should group elements by expr", func() {
+					data, e := dorun(func(rp *RunParams) {
+						rp.Selector = `name == "input1document1"`
+						rp.Actions = []string{`test = group_by(maptype.k2, "@ > 1")`}
+					})
+
+					Expect(e).To(BeNil())
+
+					docs := decodeDocs(data)
+					Expect(docs[0]["test"]).To(Equal(map[interface{}]interface{}{
+						false: []interface{}{1},
+						true:  []interface{}{2, 3},
+					}))
+				})
+			})
+
+			Describe("to_entries", func() {
+				It("should convert a map to key/value entries", func() {
+					data, e := dorun(func(rp *RunParams) {
+						rp.Selector = `name == "input1document1"`
+						rp.Actions = []string{`test = to_entries(maptype.k1)`}
+					})
+
+					Expect(e).To(BeNil())
+
+					docs := decodeDocs(data)
+					Expect(docs[0]["test"]).To(Equal([]interface{}{map[interface{}]interface{}{"key": "k1", "value": "l2value"}}))
+				})
+			})
+
+			Describe("from_entries", func() {
+				It("should convert key/value entries to a map", func() {
+					data, e := dorun(func(rp *RunParams) {
+						rp.Selector = `name == "input1document1"`
+						rp.Actions = []string{`test = from_entries(to_entries(maptype.k1))`}
+					})
+
+					Expect(e).To(BeNil())
+
+					docs := decodeDocs(data)
+					Expect(docs[0]["test"]).To(Equal(map[interface{}]interface{}{"k1": "l2value"}))
+				})
+
+				It("should accept name/value entries", func() {
+					data, e := dorun(func(rp *RunParams) {
+						rp.Selector = `name == "input1document1"`
+						rp.Actions = []string{`test = from_entries([{"name": "A", "value": "1"}])`}
+					})
+
+					Expect(e).To(BeNil())
+
+					docs := decodeDocs(data)
+					Expect(docs[0]["test"]).To(Equal(map[interface{}]interface{}{"A": "1"}))
+				})
+			})
+
+			Describe("upsert", func() {
+				It("should merge obj in to the matching list entry", func() {
+					data, e := dorun(func(rp *RunParams) {
+						rp.Files = []string{"testdata/deployment.yaml"}
+						rp.Selector = `kind == "Deployment"`
+						rp.Actions = []string{`upsert("spec.template.spec.containers", "name", "app", {"imagePullPolicy": "Always"})`}
+					})
+
+					Expect(e).To(BeNil())
+
+					docs := decodeDocs(data)
+					c := containersOf(docs[0])
+					Expect(c).To(HaveLen(2))
+					Expect(c[0]["imagePullPolicy"]).To(Equal("Always"))
+					Expect(c[0]["image"]).To(Equal("registry.example.com/app:1.0"))
+					Expect(c[1]["imagePullPolicy"]).To(BeNil())
+				})
+
+				It("should append obj if there is no matching entry", func() {
+					data, e := dorun(func(rp *RunParams) {
+						rp.Files = []string{"testdata/deployment.yaml"}
+						rp.Selector = `kind == "Deployment"`
+						rp.Actions = []string{`upsert("spec.template.spec.containers", "name", "new", {"image": "new:1.0"})`}
+					})
+
+					Expect(e).To(BeNil())
+
+					docs := decodeDocs(data)
+					c := containersOf(docs[0])
+					Expect(c).To(HaveLen(3))
+					Expect(c[2]["name"]).To(Equal("new"))
+					Expect(c[2]["image"]).To(Equal("new:1.0"))
+				})
+
+				It("should upsert the same list more than once in an action", func() {
+					data, e := dorun(func(rp *RunParams) {
+						rp.Files = []string{"testdata/deployment.yaml"}
+						rp.Selector = `kind == "Deployment"`
+						rp.Actions = []string{`[upsert("spec.template.spec.containers", "name", "app", {"imagePullPolicy": "Always"}), upsert("spec.template.spec.containers", "name", "sidecar", {"imagePullPolicy": "Never"})]`}
+					})
+
+					Expect(e).To(BeNil())
+
+					docs := decodeDocs(data)
+					c := containersOf(docs[0])
+					Expect(c).To(HaveLen(2))
+					Expect(c[0]["imagePullPolicy"]).To(Equal("Always"))
+					Expect(c[1]["imagePullPolicy"]).To(Equal("Never"))
+				})
+
+				It("should create the list if it does not exist", func() {
+					data, e := dorun(func(rp *RunParams) {
+						rp.Selector = `name == "input1document1"`
+						rp.Actions = []string{`upsert("items.list", "name", "a", {"value": 1})`}
+					})
+
+					Expect(e).To(BeNil())
+
+					docs := decodeDocs(data)
+					items := docs[0]["items"].(map[interface{}]interface{})
+					Expect(items["list"]).To(Equal([]interface{}{map[interface{}]interface{}{"name": "a", "value": 1}}))
+				})
+
+				It("should error if argument count != 4", func() {
 					_, e := dorun(func(rp *RunParams) {
-						rp.Actions = []string{`test = b64decode()`}
+						rp.Actions = []string{`upsert("list", "name", "a")`}
 					})
 
 					Expect(e).NotTo(BeNil())
-					Expect(merry.UserMessage(e)).To(ContainSubstring("requires exactly one argument"))
+					Expect(merry.UserMessage(e)).To(ContainSubstring("requires exactly 4 arguments"))
 				})
+			})
 
-				It("should error if first argument is not a string", func() {
+			Describe("remove_where", func() {
+				It("should remove entries matching pred", func() {
+					data, e := dorun(func(rp *RunParams) {
+						rp.Files = []string{"testdata/deployment.yaml"}
+						rp.Selector = `kind == "Deployment"`
+						rp.Actions = []string{`remove_where("spec.template.spec.containers", "@.name == \"sidecar\"")`}
+					})
+
+					Expect(e).To(BeNil())
+
+					docs := decodeDocs(data)
+					c := containersOf(docs[0])
+					Expect(c).To(HaveLen(1))
+					Expect(c[0]["name"]).To(Equal("app"))
+				})
+			})
+
+			Describe("set_env", func() {
+				It("should replace an existing env var", func() {
+					data, e := dorun(func(rp *RunParams) {
+						rp.Files = []string{"testdata/deployment.yaml"}
+						rp.Actions = []string{`set_env("app", "EXISTING", "new")`}
+					})
+
+					Expect(e).To(BeNil())
+
+					docs := decodeDocs(data)
+					env := containersOf(docs[0])[0]["env"].([]interface{})
+					Expect(env).To(Equal([]interface{}{map[interface{}]interface{}{"name": "EXISTING", "value": "new"}}))
+				})
+
+				It("should apply every update when called more than once in an action", func() {
+					data, e := dorun(func(rp *RunParams) {
+						rp.Files = []string{"testdata/deployment.yaml"}
+						rp.Selector = `kind == "Deployment"`
+						rp.Actions = []string{`[set_env("app", "EXISTING", "new"), set_env("app", "KEY", "value")]`}
+					})
+
+					Expect(e).To(BeNil())
+
+					docs := decodeDocs(data)
+					env := containersOf(docs[0])[0]["env"].([]interface{})
+					Expect(env).To(Equal([]interface{}{
+						map[interface{}]interface{}{"name": "EXISTING", "value": "new"},
+						map[interface{}]interface{}{"name": "KEY", "value": "value"},
+					}))
+				})
+
+				It("should add an env var to containers without env", func() {
+					data, e := dorun(func(rp *RunParams) {
+						rp.Files = []string{"testdata/deployment.yaml"}
+						rp.Actions = []string{`set_env("app", "KEY", 3)`}
+					})
+
+					Expect(e).To(BeNil())
+
+					docs := decodeDocs(data)
+					env := containersOf(docs[0])[0]["env"].([]interface{})
+					Expect(env).To(HaveLen(2))
+					Expect(env[1]).To(Equal(map[interface{}]interface{}{"name": "KEY", "value": "3"}))
+
+					env = containersOf(docs[1])[0]["env"].([]interface{})
+					Expect(env).To(Equal([]interface{}{map[interface{}]interface{}{"name": "KEY", "value": "3"}}))
+				})
+
+				It("should not change other containers or documents", func() {
+					data, e := dorun(func(rp *RunParams) {
+						rp.Actions = []string{`set_env("app", "KEY", "value")`}
+					})
+
+					Expect(e).To(BeNil())
+					Expect(decodeDocs(data)).To(HaveLen(4))
+				})
+			})
+
+			Describe("set_image", func() {
+				It("should set the image of the named container", func() {
+					data, e := dorun(func(rp *RunParams) {
+						rp.Files = []string{"testdata/deployment.yaml"}
+						rp.Actions = []string{`set_image("app", "repo:tag")`}
+					})
+
+					Expect(e).To(BeNil())
+
+					docs := decodeDocs(data)
+					Expect(containersOf(docs[0])[0]["image"]).To(Equal("repo:tag"))
+					Expect(containersOf(docs[0])[1]["image"]).To(Equal("sidecar:2.0"))
+					Expect(containersOf(docs[1])[0]["image"]).To(Equal("repo:tag"))
+				})
+			})
+
+			Describe("add_volume_mount", func() {
+				It("should add a volume mount to the named container", func() {
+					data, e := dorun(func(rp *RunParams) {
+						rp.Files = []string{"testdata/deployment.yaml"}
+						rp.Selector = `kind == "Deployment"`
+						rp.Actions = []string{`add_volume_mount("app", "config", "/etc/config", true)`}
+					})
+
+					Expect(e).To(BeNil())
+
+					docs := decodeDocs(data)
+					mounts := containersOf(docs[0])[0]["volumeMounts"]
+					Expect(mounts).To(Equal([]interface{}{map[interface{}]interface{}{"name": "config", "mountPath": "/etc/config", "readOnly": true}}))
+				})
+
+				It("should error if argument count is wrong", func() {
 					_, e := dorun(func(rp *RunParams) {
-						rp.Actions = []string{`test = b64decode([])`}
+						rp.Files = []string{"testdata/deployment.yaml"}
+						rp.Actions = []string{`add_volume_mount("app", "config")`}
 					})
 
 					Expect(e).NotTo(BeNil())
-					Expect(merry.UserMessage(e)).To(ContainSubstring("expects input to be a string"))
+					Expect(merry.UserMessage(e)).To(ContainSubstring("takes 3 or 4 arguments"))
+				})
+			})
+
+			Describe("add_volume", func() {
+				It("should replace a volume with the same name", func() {
+					data, e := dorun(func(rp *RunParams) {
+						rp.Files = []string{"testdata/deployment.yaml"}
+						rp.Selector = `kind == "Deployment"`
+						rp.Actions = []string{`add_volume({"name": "config", "secret": {"secretName": "web"}})`}
+					})
+
+					Expect(e).To(BeNil())
+
+					docs := decodeDocs(data)
+					spec := docs[0]["spec"].(map[interface{}]interface{})["template"].(map[interface{}]interface{})["spec"].(map[interface{}]interface{})
+					volumes := spec["volumes"].([]interface{})
+					Expect(volumes).To(HaveLen(1))
+					Expect(volumes[0].(map[interface{}]interface{})["configMap"]).To(BeNil())
+					Expect(volumes[0].(map[interface{}]interface{})["secret"]).NotTo(BeNil())
 				})
 			})
 
@@ -543,6 +3254,26 @@ var _ = Describe("Kpatch", func() {
 				PIt("should invoke RHS for each element of LHS")
 				PIt("should make LHS a slice if it is not already")
 				PIt("should not onvoke RHS for nil elements")
+
+				It("should return errors from LHS in strict mode", func() {
+					_, e := dorun(func(rp *RunParams) {
+						rp.Strict = true
+						rp.Actions = []string{`test = missing.key | upper(@)`}
+					})
+
+					Expect(e).NotTo(BeNil())
+					Expect(merry.UserMessage(e)).To(ContainSubstring("key 'missing.key' does not exist"))
+				})
+
+				It("should return errors from RHS", func() {
+					_, e := dorun(func(rp *RunParams) {
+						rp.Strict = true
+						rp.Actions = []string{`test = list | upper(@.missing)`}
+					})
+
+					Expect(e).NotTo(BeNil())
+					Expect(merry.UserMessage(e)).To(ContainSubstring("does not exist"))
+				})
 			})
 
 			Describe("if", func() {
@@ -0,0 +1,277 @@
+package kpatch
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"reflect"
+
+	"github.com/PaesslerAG/gval"
+	"github.com/ansel1/merry"
+	"github.com/imdario/mergo"
+	"github.com/mikesimons/traverser"
+	yaml "gopkg.in/yaml.v2"
+)
+
+// selectorLanguage is the language selectors are evaluated in. With a tracer its && and || record
+// the value of each operand.
+func (s *kpatch) selectorLanguage() gval.Language {
+	lang := gval.NewLanguage(gval.Full(),
+		s.stringLanguage(),
+		s.collectionLanguage(),
+		gval.VariableSelector(s.selectVar),
+		gval.Function("v", s.fnVar),
+		gval.Function("has", s.fnHas),
+		gval.Function("get", s.fnGet),
+		gval.Function("param", s.fnParam),
+	)
+	if s.trace != nil {
+		lang = gval.NewLanguage(lang, s.trace.logical("&&"), s.trace.logical("||"))
+	}
+	return lang
+}
+
+// actionLanguage is the language actions are evaluated in
+func (s *kpatch) actionLanguage() gval.Language {
+	return gval.NewLanguage(gval.Full(),
+		s.stringLanguage(),
+		s.collectionLanguage(),
+		s.upsertLanguage(),
+		gval.PostfixOperator("|", func(c context.Context, p *gval.Parser, e gval.Evaluable) (gval.Evaluable, error) {
+			pre, err := p.ParseExpression(c)
+			if err != nil {
+				return nil, err
+			}
+
+			return func(c context.Context, v interface{}) (interface{}, error) {
+				input, err := e(c, v)
+				if err != nil {
+					return nil, err
+				}
+
+				// Make input a slice if it's not already
+				if reflect.ValueOf(input).Kind() != reflect.Slice {
+					input = []interface{}{input}
+				}
+
+				// Apply RHS for every element of LHS
+				var out []interface{}
+				for _, item := range input.([]interface{}) {
+					if item == nil {
+						continue
+					}
+					tmp := s.currentItem
+					s.currentItem = item
+					z, err := pre(c, v)
+					s.currentItem = tmp
+					if err != nil {
+						return nil, err
+					}
+					if z != nil {
+						out = append(out, z)
+					}
+				}
+
+				return out, nil
+			}, nil
+		}),
+		gval.VariableSelector(s.selectVar),
+		gval.Function("splice_replace", func(args ...interface{}) (interface{}, error) {
+			s.targets = append(
+				s.targets,
+				tTarget{
+					opFn: func() (traverser.Op, error) {
+						return traverser.Splice(reflect.ValueOf(args[1]))
+					},
+					target: reflect.ValueOf(args[0]),
+					op:     "splice",
+					value:  args[1],
+				},
+			)
+			return nil, nil
+		}),
+		gval.Function("print", func(args ...interface{}) (interface{}, error) {
+			fmt.Fprintln(s.log, args...)
+			return nil, nil
+		}),
+		gval.Function("if", s.fnIf),
+		gval.Function("nil", s.fnNil),
+		gval.Function("yaml_parse", s.fnYamlParse),
+		//gval.Function("YAML_PARSE", mutatingFn(s.fnYamlParse, kp)),
+
+		gval.Function("yaml_dump", func(args ...interface{}) (interface{}, error) {
+			r, err := yaml.Marshal(args[0])
+			return string(r), err
+		}),
+		gval.Function("merge", func(args ...interface{}) (interface{}, error) {
+			var err error
+			out := make(map[interface{}]interface{})
+			a := args[0].(map[interface{}]interface{})
+			b := args[1].(map[interface{}]interface{})
+
+			err = mergo.Map(&out, a)
+			if err != nil {
+				return nil, err
+			}
+
+			err = mergo.Map(&out, b, mergo.WithOverride)
+			if err != nil {
+				return nil, err
+			}
+
+			return out, nil
+		}),
+		gval.Function("v", s.fnVar),
+		gval.Function("has", s.fnHas),
+		gval.Function("get", s.fnGet),
+		gval.Function("param", s.fnParam),
+		gval.Function("unset", s.fnUnset),
+		gval.Function("assert", s.fnAssert),
+		gval.Function("drop", func(args ...interface{}) (interface{}, error) {
+			s.drop = true
+			return nil, nil
+		}),
+		gval.Function("concat", func(args ...interface{}) (interface{}, error) {
+			var out []interface{}
+			for _, arg := range args {
+				v, ok := arg.([]interface{})
+				if !ok {
+					out = append(out, arg)
+					continue
+				}
+				out = append(out, v...)
+			}
+			return out, nil
+		}),
+		gval.Function("b64decode", s.fnB64Decode),
+		gval.Function("b64encode", s.fnB64Encode),
+		gval.Function("configmap_from_files", s.fnConfigMapFromFiles),
+		gval.Function("secret_from_files", s.fnSecretFromFiles),
+		gval.Function("encrypt", s.fnEncrypt),
+		gval.Function("decrypt", s.fnDecrypt),
+		//gval.Function("B64ENCODE", mutatingFn(s.fnB64Encode, kp)),
+		//gval.Function("B64DECODE", mutatingFn(s.fnB64Decode, kp)),
+		gval.InfixEvalOperator("=", func(a, b gval.Evaluable) (gval.Evaluable, error) {
+			if !b.IsConst() {
+				return func(c context.Context, o interface{}) (interface{}, error) {
+					s.missingKeyMode = "get"
+					val, err := b(c, o)
+
+					if err != nil {
+						return nil, err
+					}
+
+					if reflect.ValueOf(val) == reflect.ValueOf(s.doc) {
+						val, err = deepCopy(s.doc)
+						if err != nil {
+							log.Fatalln("Couldn't deep copy root: ", err)
+						}
+					}
+
+					s.missingKeyMode = "set"
+					target, err := a(c, o)
+					if err != nil {
+						return nil, err
+					}
+
+					s.missingKeyMode = "get"
+
+					if reflect.ValueOf(target) == reflect.ValueOf(s.doc) {
+						s.doc = val.(map[interface{}]interface{})
+						return nil, nil
+					}
+
+					val, err = s.typed(val)
+					if err != nil {
+						return nil, err
+					}
+
+					s.targets = append(
+						s.targets,
+						tTarget{
+							opFn: func() (traverser.Op, error) {
+								return traverser.Set(reflect.ValueOf(val))
+							},
+							target: reflect.ValueOf(interface{}(target)),
+							op:     "set",
+							value:  val,
+						},
+					)
+					return nil, nil
+				}, nil
+			}
+			val, err := b(nil, nil)
+			if err != nil {
+				return nil, err
+			}
+
+			return func(c context.Context, v interface{}) (interface{}, error) {
+				s.missingKeyMode = "set"
+				target, err := a(c, v)
+				if err != nil {
+					return nil, err
+				}
+
+				if reflect.ValueOf(target) == reflect.ValueOf(s.doc) {
+					s.doc = val.(map[interface{}]interface{})
+					return nil, nil
+				}
+
+				s.missingKeyMode = "get"
+				typedVal, err := s.typed(val)
+				if err != nil {
+					return nil, err
+				}
+
+				s.targets = append(
+					s.targets,
+					tTarget{
+						opFn: func() (traverser.Op, error) {
+							return traverser.Set(reflect.ValueOf(typedVal))
+						},
+						target: reflect.ValueOf(target),
+						op:     "set",
+						value:  typedVal,
+					},
+				)
+				return nil, nil
+			}, nil
+		}),
+	)
+}
+
+// applyAction evaluates expr against the current document and then makes the changes it
+// targeted
+func (s *kpatch) applyAction(lang gval.Language, expr string) error {
+	s.targets = make([]tTarget, 0)
+	s.lang = lang
+
+	_, err := lang.Evaluate(expr, s.doc)
+	if err != nil {
+		return merry.Wrap(err).WithUserMessagef("action expression error: %s", err)
+	}
+	if s.trace != nil {
+		s.trace.action(expr)
+	}
+
+	t := &traverser.Traverser{
+		Node: func(keys []string, data reflect.Value) (traverser.Op, error) {
+			for _, target := range s.targets {
+				if data == target.target {
+					if s.trace != nil {
+						s.trace.target(keys, data, target)
+					}
+					return target.opFn()
+				}
+			}
+			return traverser.Noop()
+		},
+	}
+
+	result, err := t.Traverse(reflect.ValueOf(s.doc))
+	if err != nil {
+		return merry.Wrap(err).WithUserMessagef("error applying changes: %s", err)
+	}
+	s.doc = result.Interface().(map[interface{}]interface{})
+	return nil
+}
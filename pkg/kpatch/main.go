@@ -1,19 +1,19 @@
 package kpatch
 
 import (
-	"context"
+	"bytes"
 	"fmt"
 	"io"
 	"io/ioutil"
-	"log"
 	"os"
 	"reflect"
+	"strings"
 
+	"filippo.io/age"
 	"github.com/ansel1/merry"
 
 	"github.com/mikesimons/traverser"
 
-	"github.com/PaesslerAG/gval"
 	"github.com/imdario/mergo"
 	yaml "gopkg.in/yaml.v2"
 )
@@ -21,6 +21,21 @@ import (
 type tTarget struct {
 	opFn   func() (traverser.Op, error)
 	target reflect.Value
+	// op and value describe the change for tracing
+	op    string
+	value interface{}
+}
+
+// document is a processed document held until the whole stream has been read
+type document struct {
+	source   string
+	index    int
+	selected bool
+	data     map[interface{}]interface{}
+	// comment is the comment the document was read with when preserving comments
+	comment string
+	// query is the result of the query expression for selected documents
+	query interface{}
 }
 
 func getInputBytes(input string) ([]byte, error) {
@@ -77,244 +92,339 @@ func mutatingFn(fn gvalFn, kp *kpatch) gvalFn {
 }
 */
 
-func Run(args []string, selector string, merges []string, exprs []string, output io.WriteCloser) error {
+func getParams(params []string) (map[string]string, error) {
+	out := make(map[string]string)
+	for _, p := range params {
+		parts := strings.SplitN(p, "=", 2)
+		if len(parts) != 2 {
+			return nil, fmt.Errorf("error parsing param '%s': expected key=value", p)
+		}
+		out[parts[0]] = parts[1]
+	}
+	return out, nil
+}
+
+// Options controls how Run processes documents
+type Options struct {
+	// Selector is evaluated against each document to decide whether to process it
+	Selector string
+	// Merges are YAML files or inline YAML merged in to selected documents
+	Merges []string
+	// Actions are expressions applied to selected documents
+	Actions []string
+	// Params are key=value pairs available to expressions via param()
+	Params []string
+	// Strict makes reading a missing key an error
+	Strict bool
+	// Images is an images config file or inline YAML used to rewrite container images
+	Images string
+	// ListImages writes the container images of selected documents instead of the documents
+	ListImages bool
+	// Query is an expression evaluated against each selected document after merges, actions
+	// and image and namespace changes. The results are written instead of the documents.
+	Query string
+	// Namespace moves selected namespaced documents to the namespace and updates references to it
+	Namespace string
+	// NamePrefix is prepended to the names of selected documents
+	NamePrefix string
+	// NameSuffix is appended to the names of selected documents
+	NameSuffix string
+	// NameKinds limits NamePrefix and NameSuffix to these kinds
+	NameKinds []string
+	// NameReferences is a YAML file or inline YAML of extra name reference fields
+	NameReferences string
+	// HashConfigMaps is "name" to suffix selected ConfigMaps and Secrets with a hash of their
+	// content or "annotation" to add a checksum of them to the pod templates referring to them
+	HashConfigMaps string
+	// ConfigMaps are name=path[,path...] ConfigMaps to generate from directories, files and .env files
+	ConfigMaps []string
+	// Secrets are name=path[,path...] Secrets to generate from directories, files and .env files
+	Secrets []string
+	// SecretsDecoded moves Secret data in to plain stringData before selection and actions and
+	// encodes it back in to data afterwards
+	SecretsDecoded bool
+	// NormalizeSecrets encodes Secret stringData in to data so output only uses data
+	NormalizeSecrets bool
+	// AgeKeyFile is an age key file used by decrypt() and DecryptSecrets
+	AgeKeyFile string
+	// DecryptSecrets decrypts age encrypted Secret values before selection and actions
+	DecryptSecrets bool
+	// Sort is the order of the output: install, uninstall, name or none to keep input order
+	Sort string
+	// SortOrder is a YAML file or inline YAML list of kinds used instead of the default install order
+	SortOrder string
+	// Dedupe resolves documents with the same group, kind, namespace and name: error, first, last or merge
+	Dedupe string
+	// DedupeStrategy is how lists are merged by Dedupe merge: replace or append
+	DedupeStrategy string
+	// MigrateAPIs is a Kubernetes version. Selected documents using APIs removed in or before
+	// it are converted to their replacements.
+	MigrateAPIs string
+	// Report writes a report about selected documents instead of the documents. Merges,
+	// actions and transformers are not applied. The only report is "deprecations".
+	Report string
+	// ReportFormat is table or json
+	ReportFormat string
+	// KubeVersion is the Kubernetes version reports and validation are for
+	KubeVersion string
+	// Validate checks every output document against the Kubernetes OpenAPI schema
+	Validate bool
+	// Schemas are Kubernetes OpenAPI schemas or CRD YAML files used by Validate and to convert
+	// values assigned by actions to the type of the field in the schema
+	Schemas []string
+	// Typed converts values assigned by actions to the type of the field in the schema. It is
+	// an error when they can't be converted exactly.
+	Typed bool
+	// OutputDir writes each output document to its own file in this directory instead of output
+	OutputDir string
+	// Layout is the path of each document in OutputDir with {{namespace}}, {{kind}}, {{name}},
+	// {{group}}, {{version}} and {{index}} replaced by the document's values
+	Layout string
+	// OnCollision is what to do when documents have the same path: append or error
+	OnCollision string
+	// Kustomization writes a kustomization.yaml listing the files in OutputDir
+	Kustomization bool
+	// Clean removes YAML files in OutputDir that weren't written by this run
+	Clean bool
+	// PreserveComments keeps the comments at the top of each document, e.g. Helm's "# Source:"
+	PreserveComments bool
+	// OnlySelected leaves documents the selector didn't select out of the output
+	OnlySelected bool
+	// Trace writes the selector result with the values of its parts, the variables actions read
+	// and the changes they make for each document to stderr or Log
+	Trace bool
+	// Log is a file print() and Trace write to instead of stderr
+	Log string
+}
+
+func Run(args []string, opts Options, output io.WriteCloser) error {
+	return run(args, Stdin, Stderr, opts, output)
+}
+
+// run is Run reading stdin for the input "-" and writing warnings, print() and the trace
+// to stderr unless there is a Log
+func run(args []string, stdin io.Reader, stderr io.Writer, opts Options, output io.WriteCloser) error {
 	var err error
 	var input io.Reader
 	defer output.Close()
 	encoder := yaml.NewEncoder(output)
 
+	generated, err := generateDocuments(opts.ConfigMaps, opts.Secrets)
+	if err != nil {
+		return merry.Wrap(err).WithUserMessagef("%s", err)
+	}
+
 	if len(args) == 0 {
 		args = []string{"-"}
 	}
 
-	nextInput := inputReaderFn(args)
+	paramData, err := getParams(opts.Params)
+	if err != nil {
+		return merry.Wrap(err).WithUserMessagef("%s", err)
+	}
 
-	for input, err = nextInput(); input != nil && err == nil; input, err = nextInput() {
+	var identities []age.Identity
+	if opts.AgeKeyFile != "" {
+		identities, err = getAgeIdentities(opts.AgeKeyFile)
+		if err != nil {
+			return merry.Wrap(err).WithUserMessagef("%s", err)
+		}
+	}
 
-		decoder := yaml.NewDecoder(input)
+	if opts.DecryptSecrets && identities == nil {
+		return merry.New("decrypting secrets requires an age key file").WithUserMessage("decrypting secrets requires an age key file")
+	}
 
-		mergeData, err := getMergeData(merges)
+	var images *imageConfig
+	if opts.Images != "" {
+		images, err = getImageConfig(opts.Images)
 		if err != nil {
-			return merry.Wrap(err)
+			return merry.Wrap(err).WithUserMessagef("%s", err)
 		}
+	}
 
-		kp := &kpatch{
-			missingKeyMode: "get",
-			doc:            make(map[interface{}]interface{}),
+	var report *deprecationReport
+	if opts.Report != "" {
+		report, err = newDeprecationReport(opts.Report, opts.KubeVersion, opts.ReportFormat)
+		if err != nil {
+			return merry.Wrap(err).WithUserMessagef("%s", err)
 		}
+	}
 
-		lang := gval.NewLanguage(gval.Full(),
-			gval.PostfixOperator("|", func(c context.Context, p *gval.Parser, e gval.Evaluable) (gval.Evaluable, error) {
-				pre, err := p.ParseExpression(c)
-				if err != nil {
-					return nil, err
-				}
-
-				return func(c context.Context, v interface{}) (interface{}, error) {
-					input, err := e(c, v)
-					if err != nil {
-						return nil, err
-					}
-
-					// Make input a slice if it's not already
-					if reflect.ValueOf(input).Kind() != reflect.Slice {
-						input = []interface{}{input}
-					}
+	logOutput := stderr
+	if opts.Log != "" {
+		f, err := Fs.OpenFile(opts.Log, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+		if err != nil {
+			return merry.Wrap(err).WithUserMessagef("error opening log '%s': %s", opts.Log, err)
+		}
+		defer f.Close()
+		logOutput = f
+	}
 
-					// Apply RHS for every element of LHS
-					var out []interface{}
-					for _, item := range input.([]interface{}) {
-						tmp := kp.currentItem
-						kp.currentItem = item
-						z, _ := pre(c, v)
-						if z != nil {
-							out = append(out, z)
-						}
-						kp.currentItem = tmp
-					}
+	var trace *tracer
+	if opts.Trace {
+		trace = &tracer{w: logOutput}
+	}
 
-					return out, nil
-				}, nil
-			}),
-			gval.VariableSelector(func(path gval.Evaluables) gval.Evaluable {
-				return func(c context.Context, v interface{}) (interface{}, error) {
-					var root interface{}
-					keys, _ := path.EvalStrings(c, v)
-					root = kp.doc
-
-					if keys[0] == "@" {
-						root = kp.currentItem
-						keys = keys[1:]
-					}
+	var schemas *schemaSet
+	if opts.Validate || (opts.Typed && len(opts.Actions) > 0) {
+		if schemas, err = loadSchemas(opts, stderr); err != nil {
+			return merry.Wrap(err).WithUserMessagef("%s", err)
+		}
+	}
 
-					if len(keys) == 0 {
-						return root, nil
-					}
+	var outDir *outputDir
+	if opts.OutputDir != "" {
+		outDir, err = newOutputDir(opts.OutputDir, opts.Layout, opts.OnCollision, opts.Kustomization, opts.Clean)
+		if err != nil {
+			return merry.Wrap(err).WithUserMessagef("%s", err)
+		}
+	}
 
-					val, err := traverser.GetKey(&root, keys)
+	var migrator *apiMigrator
+	if opts.MigrateAPIs != "" {
+		migrator, err = newAPIMigrator(opts.MigrateAPIs, stderr)
+		if err != nil {
+			return merry.Wrap(err).WithUserMessagef("%s", err)
+		}
+	}
 
-					if err != nil && kp.missingKeyMode == "set" {
-						err := traverser.SetKey(&root, keys, "")
-						if err != nil {
-							return nil, err
-						}
-						return traverser.GetKey(&root, keys)
-					}
+	var namespace *namespaceTransformer
+	if opts.Namespace != "" {
+		namespace = newNamespaceTransformer(opts.Namespace)
+	}
 
-					err = nil
+	references, err := getNameReferences(opts.NameReferences)
+	if err != nil {
+		return merry.Wrap(err).WithUserMessagef("%s", err)
+	}
 
-					return val, err
-				}
-			}),
-			gval.Function("splice_replace", func(args ...interface{}) (interface{}, error) {
-				kp.targets = append(
-					kp.targets,
-					tTarget{
-						opFn: func() (traverser.Op, error) {
-							return traverser.Splice(reflect.ValueOf(args[1]))
-						},
-						target: reflect.ValueOf(args[0]),
-					},
-				)
-				return nil, nil
-			}),
-			gval.Function("print", func(args ...interface{}) (interface{}, error) {
-				fmt.Print(args...)
-				return nil, nil
-			}),
-			gval.Function("if", kp.fnIf),
-			gval.Function("nil", kp.fnNil),
-			gval.Function("yaml_parse", kp.fnYamlParse),
-			//gval.Function("YAML_PARSE", mutatingFn(kp.fnYamlParse, kp)),
-
-			gval.Function("yaml_dump", func(args ...interface{}) (interface{}, error) {
-				r, err := yaml.Marshal(args[0])
-				return string(r), err
-			}),
-			gval.Function("merge", func(args ...interface{}) (interface{}, error) {
-				var err error
-				out := make(map[interface{}]interface{})
-				a := args[0].(map[interface{}]interface{})
-				b := args[1].(map[interface{}]interface{})
-
-				err = mergo.Map(&out, a)
-				if err != nil {
-					return nil, err
-				}
+	var names *nameTransformer
+	if opts.NamePrefix != "" || opts.NameSuffix != "" {
+		names = newNameTransformer(opts.NamePrefix, opts.NameSuffix, opts.NameKinds, references)
+	}
 
-				err = mergo.Map(&out, b, mergo.WithOverride)
-				if err != nil {
-					return nil, err
-				}
+	var hash *hashTransformer
+	if opts.HashConfigMaps != "" {
+		hash, err = newHashTransformer(opts.HashConfigMaps, references)
+		if err != nil {
+			return merry.Wrap(err).WithUserMessagef("%s", err)
+		}
+	}
 
-				return out, nil
-			}),
-			gval.Function("v", kp.fnVar),
-			gval.Function("unset", kp.fnUnset),
-			gval.Function("drop", func(args ...interface{}) (interface{}, error) {
-				kp.drop = true
-				return nil, nil
-			}),
-			gval.Function("concat", func(args ...interface{}) (interface{}, error) {
-				var out []interface{}
-				for _, arg := range args {
-					v, ok := arg.([]interface{})
-					if !ok {
-						out = append(out, arg)
-						continue
-					}
-					out = append(out, v...)
-				}
-				return out, nil
-			}),
-			gval.Function("b64decode", kp.fnB64Decode),
-			gval.Function("b64encode", kp.fnB64Encode),
-			//gval.Function("B64ENCODE", mutatingFn(kp.fnB64Encode, kp)),
-			//gval.Function("B64DECODE", mutatingFn(kp.fnB64Decode, kp)),
-			gval.InfixEvalOperator("=", func(a, b gval.Evaluable) (gval.Evaluable, error) {
-				if !b.IsConst() {
-					return func(c context.Context, o interface{}) (interface{}, error) {
-						kp.missingKeyMode = "get"
-						val, err := b(c, o)
+	var dedupe *deduper
+	if opts.Dedupe != "" {
+		dedupe, err = newDeduper(opts.Dedupe, opts.DedupeStrategy, stderr)
+		if err != nil {
+			return merry.Wrap(err).WithUserMessagef("%s", err)
+		}
+	}
 
-						if err != nil {
-							return nil, err
-						}
+	var sorter *documentSorter
+	if opts.Sort != "" {
+		sorter, err = newDocumentSorter(opts.Sort, opts.SortOrder)
+		if err != nil {
+			return merry.Wrap(err).WithUserMessagef("%s", err)
+		}
+	}
 
-						if reflect.ValueOf(val) == reflect.ValueOf(kp.doc) {
-							val, err = deepCopy(kp.doc)
-							if err != nil {
-								log.Fatalln("Couldn't deep copy root: ", err)
-							}
-						}
+	var docs []*document
+	var failures []assertionFailure
 
-						kp.missingKeyMode = "set"
-						target, err := a(c, o)
-						if err != nil {
-							return nil, err
-						}
+	queue := newGeneratedQueue()
+	newKpatch := func(source string) *kpatch {
+		kp := &kpatch{
+			missingKeyMode: "get",
+			doc:            make(map[interface{}]interface{}),
+			strict:         opts.Strict,
+			params:         paramData,
+			source:         source,
+			identities:     identities,
+			failures:       &failures,
+			trace:          trace,
+			log:            logOutput,
+			generated:      queue,
+		}
+		if opts.Typed {
+			kp.schemas = schemas
+		}
+		return kp
+	}
 
-						kp.missingKeyMode = "get"
+	nextInput := stdinReaderFn(args, stdin)
+	if len(generated) > 0 {
+		nextInput = appendInput(nextInput, bytes.NewReader(generated))
+	}
+	nextInput = generatedInput(nextInput, queue)
+	current := 0
 
-						if reflect.ValueOf(target) == reflect.ValueOf(kp.doc) {
-							kp.doc = val.(map[interface{}]interface{})
-							return nil, nil
-						}
+	for input, err = nextInput(); input != nil && err == nil; input, err = nextInput() {
+		// Inputs after the files are generated documents
+		source := generatedSource
+		if current < len(args) {
+			source = args[current]
+		}
+		current++
 
-						kp.targets = append(
-							kp.targets,
-							tTarget{
-								opFn: func() (traverser.Op, error) {
-									return traverser.Set(reflect.ValueOf(val))
-								},
-								target: reflect.ValueOf(interface{}(target)),
-							},
-						)
-						return nil, nil
-					}, nil
-				}
-				val, err := b(nil, nil)
-				if err != nil {
-					return nil, err
-				}
+		var comments []string
+		if opts.PreserveComments {
+			content, err := ioutil.ReadAll(input)
+			if err != nil {
+				return merry.Wrap(err).WithUserMessagef("error reading '%s': %s", source, err)
+			}
+			comments = leadingComments(content)
+			input = bytes.NewReader(content)
+		}
 
-				return func(c context.Context, v interface{}) (interface{}, error) {
-					kp.missingKeyMode = "set"
-					target, err := a(c, v)
-					if err != nil {
-						return nil, err
-					}
+		decoder := yaml.NewDecoder(input)
 
-					if reflect.ValueOf(target) == reflect.ValueOf(kp.doc) {
-						kp.doc = val.(map[interface{}]interface{})
-						return nil, nil
-					}
+		mergeData, err := getMergeData(opts.Merges)
+		if err != nil {
+			return merry.Wrap(err)
+		}
 
-					kp.missingKeyMode = "get"
-					kp.targets = append(
-						kp.targets,
-						tTarget{
-							opFn: func() (traverser.Op, error) {
-								return traverser.Set(reflect.ValueOf(val))
-							},
-							target: reflect.ValueOf(target),
-						},
-					)
-					return nil, nil
-				}, nil
-			}),
-		)
+		kp := newKpatch(source)
+		selectorLang := kp.selectorLanguage()
+		lang := kp.actionLanguage()
 
 		for decoder.Decode(&kp.doc) == nil {
+			kp.index++
 			if len(kp.doc) == 0 {
 				continue
 			}
 
 			kp.currentItem = kp.doc
 
+			if schemas != nil {
+				if err = schemas.addCRD(kp.doc); err != nil {
+					return merry.Wrap(err).WithUserMessagef("%s", err)
+				}
+			}
+
+			if opts.DecryptSecrets {
+				if err = decryptSecret(kp.doc, identities); err != nil {
+					return merry.Wrap(err).WithUserMessagef("error decrypting secret in %s: %s", kp.docName(), err)
+				}
+			}
+
+			if opts.SecretsDecoded {
+				if err = decodeSecret(kp.doc); err != nil {
+					return merry.Wrap(err).WithUserMessagef("error decoding secret in %s: %s", kp.docName(), err)
+				}
+			}
+
+			if trace != nil {
+				trace.document(kp.docName(), kp.doc)
+			}
+
 			var value interface{}
-			if selector != "" {
-				value, err = gval.Evaluate(selector, kp.doc)
+			if opts.Selector != "" {
+				kp.lang = selectorLang
+				if trace != nil {
+					value, err = trace.selector(selectorLang, opts.Selector, kp.doc)
+				} else {
+					value, err = selectorLang.Evaluate(opts.Selector, kp.doc)
+				}
 				if err != nil {
 					return merry.Wrap(err).WithUserMessagef("error evaluating selector: %s", err)
 				}
@@ -322,8 +432,8 @@ func Run(args []string, selector string, merges []string, exprs []string, output
 				value = interface{}(true)
 			}
 
-			if value == true {
-				if len(merges) > 0 {
+			if value == true && report == nil {
+				if len(opts.Merges) > 0 {
 					for _, m := range mergeData {
 						mCopy, err := deepCopy(m)
 						if err != nil {
@@ -337,40 +447,32 @@ func Run(args []string, selector string, merges []string, exprs []string, output
 					}
 				}
 
-				if len(exprs) > 0 {
-					for _, expr := range exprs {
-						kp.targets = make([]tTarget, 0)
-
-						_, err := lang.Evaluate(expr, kp.doc)
-						if err != nil {
-							return merry.Wrap(err).WithUserMessagef("action expression error: %s", err)
+				if len(opts.Actions) > 0 {
+					for _, expr := range opts.Actions {
+						if err = kp.applyAction(lang, expr); err != nil {
+							return err
 						}
+					}
 
-						t := &traverser.Traverser{
-							Node: func(keys []string, data reflect.Value) (traverser.Op, error) {
-								for _, target := range kp.targets {
-									if data == target.target {
-										return target.opFn()
-									}
-								}
-								return traverser.Noop()
-							},
-						}
+				}
 
-						result, err := t.Traverse(reflect.ValueOf(kp.doc))
-						if err != nil {
-							return merry.Wrap(err).WithUserMessagef("error applying changes: %s", err)
-						}
-						kp.doc = result.Interface().(map[interface{}]interface{})
-					}
+				if migrator != nil {
+					migrator.migrate(kp.doc, kp.docName())
+				}
 
+				if images != nil {
+					if err = images.rewriteImages(kp.doc); err != nil {
+						return merry.Wrap(err).WithUserMessagef("error rewriting images in %s: %s", kp.docName(), err)
+					}
 				}
 			}
 
 			if !kp.drop {
-				if err = encoder.Encode(kp.doc); err != nil {
-					return merry.Wrap(err).WithUserMessagef("error encoding output: %s", err)
+				doc := &document{source: source, index: kp.index, selected: value == true, data: kp.doc}
+				if kp.index <= len(comments) {
+					doc.comment = comments[kp.index-1]
 				}
+				docs = append(docs, doc)
 			}
 
 			kp.Reset()
@@ -381,5 +483,113 @@ func Run(args []string, selector string, merges []string, exprs []string, output
 		return merry.Wrap(err).WithUserMessagef("unknown error: %s", err)
 	}
 
+	if report != nil {
+		if err = report.write(docs, output); err != nil {
+			return merry.Wrap(err).WithUserMessagef("%s", err)
+		}
+		return nil
+	}
+
+	if namespace != nil {
+		namespace.transform(docs)
+	}
+
+	if opts.Query != "" {
+		for _, doc := range docs {
+			if !doc.selected {
+				continue
+			}
+			kp := newKpatch(doc.source)
+			kp.index = doc.index
+			kp.doc = doc.data
+			kp.currentItem = doc.data
+			kp.lang = kp.actionLanguage()
+			doc.query, err = kp.lang.Evaluate(opts.Query, kp.doc)
+			if err != nil {
+				return merry.Wrap(err).WithUserMessagef("query expression error: %s", err)
+			}
+		}
+	}
+
+	if opts.SecretsDecoded || opts.NormalizeSecrets {
+		for _, doc := range docs {
+			normalizeSecret(doc.data)
+		}
+	}
+
+	if dedupe != nil {
+		docs, err = dedupe.dedupe(docs)
+		if err != nil {
+			return merry.Wrap(err).WithUserMessagef("%s", err)
+		}
+	}
+
+	if names != nil {
+		names.transform(docs)
+	}
+
+	if hash != nil {
+		if err = hash.transform(docs); err != nil {
+			return merry.Wrap(err).WithUserMessagef("%s", err)
+		}
+	}
+
+	if sorter != nil {
+		sorter.sort(docs)
+	}
+
+	if opts.Validate {
+		if err = schemas.validateDocuments(docs, stderr); err != nil {
+			return merry.Wrap(err).WithUserMessagef("%s", err)
+		}
+	}
+
+	if len(failures) > 0 {
+		return assertionError(failures)
+	}
+
+	if opts.OnlySelected {
+		var selected []*document
+		for _, doc := range docs {
+			if doc.selected {
+				selected = append(selected, doc)
+			}
+		}
+		docs = selected
+	}
+
+	switch {
+	case opts.ListImages:
+		for _, doc := range docs {
+			if doc.selected {
+				if err = listImages(doc.data, output); err != nil {
+					return merry.Wrap(err).WithUserMessagef("error listing images: %s", err)
+				}
+			}
+		}
+	case opts.Query != "":
+		for _, doc := range docs {
+			if doc.selected {
+				if err = writeQueryResult(doc.query, output); err != nil {
+					return merry.Wrap(err).WithUserMessagef("error encoding output: %s", err)
+				}
+			}
+		}
+	case outDir != nil:
+		if err = outDir.write(docs); err != nil {
+			return merry.Wrap(err).WithUserMessagef("%s", err)
+		}
+	case opts.PreserveComments:
+		if err = writeDocuments(docs, output); err != nil {
+			return merry.Wrap(err).WithUserMessagef("error encoding output: %s", err)
+		}
+	default:
+		for _, doc := range docs {
+			if err = encoder.Encode(doc.data); err != nil {
+				return merry.Wrap(err).WithUserMessagef("error encoding output: %s", err)
+			}
+		}
+	}
+
 	return nil
 }
@@ -0,0 +1,396 @@
+package kpatch
+
+import (
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+)
+
+// kubeVersion is a Kubernetes minor release
+type kubeVersion struct {
+	major int
+	minor int
+}
+
+// parseKubeVersion parses versions like 1.25, v1.25 or 1.25.3
+func parseKubeVersion(version string) (kubeVersion, error) {
+	parts := strings.Split(strings.TrimPrefix(version, "v"), ".")
+	if len(parts) < 2 || len(parts) > 3 {
+		return kubeVersion{}, fmt.Errorf("invalid Kubernetes version '%s': expected major.minor", version)
+	}
+
+	major, err := strconv.Atoi(parts[0])
+	if err != nil {
+		return kubeVersion{}, fmt.Errorf("invalid Kubernetes version '%s': expected major.minor", version)
+	}
+	minor, err := strconv.Atoi(parts[1])
+	if err != nil {
+		return kubeVersion{}, fmt.Errorf("invalid Kubernetes version '%s': expected major.minor", version)
+	}
+
+	return kubeVersion{major: major, minor: minor}, nil
+}
+
+func (v kubeVersion) atLeast(other kubeVersion) bool {
+	return v.major > other.major || (v.major == other.major && v.minor >= other.minor)
+}
+
+func (v kubeVersion) String() string {
+	return fmt.Sprintf("%d.%d", v.major, v.minor)
+}
+
+// apiMigration moves a kind from a deprecated apiVersion to its replacement
+type apiMigration struct {
+	kind         string
+	from         string
+	to           string
+	deprecatedIn kubeVersion
+	removedIn    kubeVersion
+	// convert updates the schema of a document after its apiVersion has changed and returns
+	// anything that needs checking by hand
+	convert func(doc map[interface{}]interface{}) []string
+	// manual is why the migration can't be done automatically. The document is left alone.
+	manual string
+}
+
+// migrations builds an apiMigration for each kind
+func migrations(kinds []string, from string, to string, deprecatedIn kubeVersion, removedIn kubeVersion, convert func(map[interface{}]interface{}) []string) []apiMigration {
+	var out []apiMigration
+	for _, kind := range kinds {
+		out = append(out, apiMigration{kind: kind, from: from, to: to, deprecatedIn: deprecatedIn, removedIn: removedIn, convert: convert})
+	}
+	return out
+}
+
+var (
+	v1_9  = kubeVersion{1, 9}
+	v1_10 = kubeVersion{1, 10}
+	v1_14 = kubeVersion{1, 14}
+	v1_16 = kubeVersion{1, 16}
+	v1_17 = kubeVersion{1, 17}
+	v1_19 = kubeVersion{1, 19}
+	v1_20 = kubeVersion{1, 20}
+	v1_21 = kubeVersion{1, 21}
+	v1_22 = kubeVersion{1, 22}
+	v1_23 = kubeVersion{1, 23}
+	v1_25 = kubeVersion{1, 25}
+	v1_26 = kubeVersion{1, 26}
+)
+
+var rbacKinds = []string{"ClusterRole", "ClusterRoleBinding", "Role", "RoleBinding"}
+var webhookKinds = []string{"MutatingWebhookConfiguration", "ValidatingWebhookConfiguration"}
+
+// apiMigrations are the deprecated APIs removed from Kubernetes and how to convert them
+var apiMigrations = concatMigrations(
+	migrations([]string{"Deployment", "DaemonSet", "ReplicaSet"}, "extensions/v1beta1", "apps/v1", v1_9, v1_16, convertExtensionsWorkload),
+	migrations([]string{"Deployment", "StatefulSet"}, "apps/v1beta1", "apps/v1", v1_9, v1_16, convertAppsWorkload),
+	migrations([]string{"Deployment", "StatefulSet", "DaemonSet", "ReplicaSet"}, "apps/v1beta2", "apps/v1", v1_9, v1_16, convertAppsWorkload),
+	migrations([]string{"NetworkPolicy"}, "extensions/v1beta1", "networking.k8s.io/v1", v1_9, v1_16, nil),
+	migrations([]string{"PodSecurityPolicy"}, "extensions/v1beta1", "policy/v1beta1", v1_10, v1_16, nil),
+	migrations([]string{"Ingress"}, "extensions/v1beta1", "networking.k8s.io/v1", v1_14, v1_22, convertIngress),
+	migrations([]string{"Ingress"}, "networking.k8s.io/v1beta1", "networking.k8s.io/v1", v1_19, v1_22, convertIngress),
+	migrations([]string{"IngressClass"}, "networking.k8s.io/v1beta1", "networking.k8s.io/v1", v1_19, v1_22, nil),
+	migrations(rbacKinds, "rbac.authorization.k8s.io/v1beta1", "rbac.authorization.k8s.io/v1", v1_17, v1_22, nil),
+	migrations(webhookKinds, "admissionregistration.k8s.io/v1beta1", "admissionregistration.k8s.io/v1", v1_16, v1_22, convertWebhooks),
+	migrations([]string{"APIService"}, "apiregistration.k8s.io/v1beta1", "apiregistration.k8s.io/v1", v1_19, v1_22, nil),
+	migrations([]string{"PriorityClass"}, "scheduling.k8s.io/v1beta1", "scheduling.k8s.io/v1", v1_14, v1_22, nil),
+	migrations([]string{"CSIDriver", "CSINode", "StorageClass", "VolumeAttachment"}, "storage.k8s.io/v1beta1", "storage.k8s.io/v1", v1_19, v1_22, nil),
+	migrations([]string{"CertificateSigningRequest"}, "certificates.k8s.io/v1beta1", "certificates.k8s.io/v1", v1_19, v1_22, convertCSR),
+	migrations([]string{"Lease"}, "coordination.k8s.io/v1beta1", "coordination.k8s.io/v1", v1_19, v1_22, nil),
+	migrations([]string{"CronJob"}, "batch/v1beta1", "batch/v1", v1_21, v1_25, nil),
+	migrations([]string{"EndpointSlice"}, "discovery.k8s.io/v1beta1", "discovery.k8s.io/v1", v1_21, v1_25, convertEndpointSlice),
+	migrations([]string{"Event"}, "events.k8s.io/v1beta1", "events.k8s.io/v1", v1_19, v1_25, nil),
+	migrations([]string{"HorizontalPodAutoscaler"}, "autoscaling/v2beta1", "autoscaling/v2", v1_22, v1_25, convertHPAMetrics),
+	migrations([]string{"HorizontalPodAutoscaler"}, "autoscaling/v2beta2", "autoscaling/v2", v1_23, v1_26, nil),
+	migrations([]string{"PodDisruptionBudget"}, "policy/v1beta1", "policy/v1", v1_21, v1_25, convertPDB),
+	migrations([]string{"RuntimeClass"}, "node.k8s.io/v1beta1", "node.k8s.io/v1", v1_20, v1_25, nil),
+	[]apiMigration{
+		{
+			kind: "CustomResourceDefinition", from: "apiextensions.k8s.io/v1beta1", to: "apiextensions.k8s.io/v1", deprecatedIn: v1_16, removedIn: v1_22,
+			manual: "validation, printer columns and subresources move in to each version and a structural schema is required",
+		},
+		{
+			kind: "PodSecurityPolicy", from: "policy/v1beta1", deprecatedIn: v1_21, removedIn: v1_25,
+			manual: "it has no replacement, use Pod Security Admission namespace labels instead",
+		},
+	},
+)
+
+func concatMigrations(lists ...[]apiMigration) []apiMigration {
+	var out []apiMigration
+	for _, l := range lists {
+		out = append(out, l...)
+	}
+	return out
+}
+
+// findMigration returns the migration for a document's kind and apiVersion or nil if it is current
+func findMigration(doc map[interface{}]interface{}) *apiMigration {
+	for i, m := range apiMigrations {
+		if doc["kind"] == m.kind && doc["apiVersion"] == m.from {
+			return &apiMigrations[i]
+		}
+	}
+	return nil
+}
+
+// apiMigrator rewrites APIs removed in or before a Kubernetes version
+type apiMigrator struct {
+	target   kubeVersion
+	warnings io.Writer
+}
+
+func newAPIMigrator(target string, warnings io.Writer) (*apiMigrator, error) {
+	version, err := parseKubeVersion(target)
+	if err != nil {
+		return nil, err
+	}
+	return &apiMigrator{target: version, warnings: warnings}, nil
+}
+
+// migrate converts doc, a deprecated API, in place. Migrations are repeated so an API that
+// was deprecated more than once ends up at the newest version available in the target.
+// Anything that needs checking by hand is reported as a warning against name.
+func (t *apiMigrator) migrate(doc map[interface{}]interface{}, name string) {
+	for {
+		m := findMigration(doc)
+		if m == nil || !t.target.atLeast(m.removedIn) {
+			return
+		}
+
+		if m.manual != "" {
+			warnf(t.warnings, "%s: %s %s was removed in %s and can't be converted automatically: %s", name, m.from, m.kind, m.removedIn, m.manual)
+			return
+		}
+
+		doc["apiVersion"] = m.to
+		if m.convert == nil {
+			continue
+		}
+		for _, warning := range m.convert(doc) {
+			warnf(t.warnings, "%s: converted %s %s to %s but %s", name, m.from, m.kind, m.to, warning)
+		}
+	}
+}
+
+// mapAt returns the map at keys in node or nil
+func mapAt(node interface{}, keys ...string) map[interface{}]interface{} {
+	for _, key := range keys {
+		m, _ := node.(map[interface{}]interface{})
+		node = m[key]
+	}
+	m, _ := node.(map[interface{}]interface{})
+	return m
+}
+
+func listAt(node interface{}, keys ...string) []interface{} {
+	parent := mapAt(node, keys[:len(keys)-1]...)
+	list, _ := parent[keys[len(keys)-1]].([]interface{})
+	return list
+}
+
+// convertAppsWorkload adds the selector required by apps/v1 that older versions defaulted
+// from the pod template labels
+func convertAppsWorkload(doc map[interface{}]interface{}) []string {
+	spec := mapAt(doc, "spec")
+	if spec == nil || spec["selector"] != nil {
+		return nil
+	}
+
+	labels := mapAt(spec, "template", "metadata", "labels")
+	if len(labels) == 0 {
+		return []string{"spec.selector is required and there are no pod template labels to copy"}
+	}
+
+	matchLabels := make(map[interface{}]interface{})
+	for k, v := range labels {
+		matchLabels[k] = v
+	}
+	spec["selector"] = map[interface{}]interface{}{"matchLabels": matchLabels}
+	return nil
+}
+
+// convertExtensionsWorkload is convertAppsWorkload that also warns about defaults that changed
+// from extensions/v1beta1 for fields the document doesn't set
+func convertExtensionsWorkload(doc map[interface{}]interface{}) []string {
+	warnings := convertAppsWorkload(doc)
+
+	spec := mapAt(doc, "spec")
+	if _, ok := spec["rollbackTo"]; ok {
+		delete(spec, "rollbackTo")
+		warnings = append(warnings, "spec.rollbackTo is not supported and was removed")
+	}
+	delete(spec, "templateGeneration")
+
+	switch doc["kind"] {
+	case "DaemonSet":
+		if mapAt(spec, "updateStrategy")["type"] == nil {
+			warnings = append(warnings, "spec.updateStrategy.type now defaults to RollingUpdate instead of OnDelete")
+		}
+	case "Deployment":
+		if _, ok := spec["revisionHistoryLimit"]; !ok {
+			warnings = append(warnings, "spec.revisionHistoryLimit now defaults to 10 instead of keeping every old ReplicaSet")
+		}
+		if _, ok := spec["progressDeadlineSeconds"]; !ok {
+			warnings = append(warnings, "spec.progressDeadlineSeconds now defaults to 600 instead of never timing out")
+		}
+		rollingUpdate := mapAt(spec, "strategy", "rollingUpdate")
+		if mapAt(spec, "strategy")["type"] != "Recreate" && (rollingUpdate["maxUnavailable"] == nil || rollingUpdate["maxSurge"] == nil) {
+			warnings = append(warnings, "spec.strategy.rollingUpdate maxUnavailable and maxSurge now default to 25% instead of 1")
+		}
+	}
+	return warnings
+}
+
+// convertIngressBackend turns serviceName / servicePort in to service.name / service.port
+func convertIngressBackend(backend map[interface{}]interface{}) {
+	name, ok := backend["serviceName"]
+	if !ok {
+		return
+	}
+
+	port := make(map[interface{}]interface{})
+	switch p := backend["servicePort"].(type) {
+	case int:
+		port["number"] = p
+	case string:
+		if n, err := strconv.Atoi(p); err == nil {
+			port["number"] = n
+		} else {
+			port["name"] = p
+		}
+	}
+
+	delete(backend, "serviceName")
+	delete(backend, "servicePort")
+	backend["service"] = map[interface{}]interface{}{"name": name, "port": port}
+}
+
+func convertIngress(doc map[interface{}]interface{}) []string {
+	spec := mapAt(doc, "spec")
+	if spec == nil {
+		return nil
+	}
+
+	if backend, ok := spec["backend"].(map[interface{}]interface{}); ok {
+		convertIngressBackend(backend)
+		delete(spec, "backend")
+		spec["defaultBackend"] = backend
+	}
+
+	for _, rule := range listAt(spec, "rules") {
+		for _, item := range listAt(rule, "http", "paths") {
+			path, ok := item.(map[interface{}]interface{})
+			if !ok {
+				continue
+			}
+			if backend := mapAt(path, "backend"); backend != nil {
+				convertIngressBackend(backend)
+			}
+			// pathType is required and this was the behaviour when it was missing
+			if _, ok := path["pathType"]; !ok {
+				path["pathType"] = "ImplementationSpecific"
+			}
+		}
+	}
+	return nil
+}
+
+// convertWebhooks sets the fields that are required in v1 or whose default changed to the
+// v1beta1 defaults so that behaviour doesn't change
+func convertWebhooks(doc map[interface{}]interface{}) []string {
+	var warnings []string
+	defaults := map[interface{}]interface{}{
+		"admissionReviewVersions": []interface{}{"v1beta1"},
+		"failurePolicy":           "Ignore",
+		"matchPolicy":             "Exact",
+		"timeoutSeconds":          30,
+	}
+
+	for _, item := range listAt(doc, "webhooks") {
+		webhook, ok := item.(map[interface{}]interface{})
+		if !ok {
+			continue
+		}
+
+		for key, value := range defaults {
+			if _, ok := webhook[key]; !ok {
+				webhook[key] = value
+			}
+		}
+
+		switch webhook["sideEffects"] {
+		case "None", "NoneOnDryRun":
+		default:
+			warnings = append(warnings, fmt.Sprintf("webhook '%v' must set sideEffects to None or NoneOnDryRun", webhook["name"]))
+		}
+	}
+	return warnings
+}
+
+func convertCSR(doc map[interface{}]interface{}) []string {
+	if mapAt(doc, "spec")["signerName"] == nil {
+		return []string{"spec.signerName is required"}
+	}
+	return nil
+}
+
+func convertEndpointSlice(doc map[interface{}]interface{}) []string {
+	for _, item := range listAt(doc, "endpoints") {
+		endpoint, ok := item.(map[interface{}]interface{})
+		if !ok {
+			continue
+		}
+		if topology, ok := endpoint["topology"]; ok {
+			delete(endpoint, "topology")
+			endpoint["deprecatedTopology"] = topology
+		}
+	}
+	return nil
+}
+
+// convertHPAMetrics moves v2beta1 metric targets in to the target field used by v2
+func convertHPAMetrics(doc map[interface{}]interface{}) []string {
+	var warnings []string
+	for _, item := range listAt(doc, "spec", "metrics") {
+		metric, ok := item.(map[interface{}]interface{})
+		if !ok {
+			continue
+		}
+
+		switch metric["type"] {
+		case "Resource":
+			resource := mapAt(metric, "resource")
+			if v, ok := resource["targetAverageUtilization"]; ok {
+				resource["target"] = map[interface{}]interface{}{"type": "Utilization", "averageUtilization": v}
+				delete(resource, "targetAverageUtilization")
+			}
+			if v, ok := resource["targetAverageValue"]; ok {
+				resource["target"] = map[interface{}]interface{}{"type": "AverageValue", "averageValue": v}
+				delete(resource, "targetAverageValue")
+			}
+		case "Pods":
+			pods := mapAt(metric, "pods")
+			if name, ok := pods["metricName"]; ok {
+				pods["metric"] = map[interface{}]interface{}{"name": name}
+				delete(pods, "metricName")
+			}
+			if v, ok := pods["targetAverageValue"]; ok {
+				pods["target"] = map[interface{}]interface{}{"type": "AverageValue", "averageValue": v}
+				delete(pods, "targetAverageValue")
+			}
+		default:
+			warnings = append(warnings, fmt.Sprintf("%v metrics must be converted by hand", metric["type"]))
+		}
+	}
+	return warnings
+}
+
+// convertPDB warns about the change in meaning of an empty selector
+func convertPDB(doc map[interface{}]interface{}) []string {
+	if len(mapAt(doc, "spec", "selector")) == 0 {
+		return []string{"an empty selector now selects every pod in the namespace instead of none"}
+	}
+	return nil
+}
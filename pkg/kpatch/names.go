@@ -0,0 +1,300 @@
+package kpatch
+
+import (
+	"fmt"
+	"strings"
+
+	yaml "gopkg.in/yaml.v2"
+)
+
+// fieldSpec is a field holding a name. Lists along the path are traversed automatically.
+type fieldSpec struct {
+	// Kind is the kind of document containing the field; empty matches any kind
+	Kind string `yaml:"kind"`
+	Path string `yaml:"path"`
+}
+
+// nameReference lists the fields that refer to documents of Kind by name
+type nameReference struct {
+	Kind       string      `yaml:"kind"`
+	FieldSpecs []fieldSpec `yaml:"fieldSpecs"`
+}
+
+// podSpecFields returns a fieldSpec for each workload kind for paths relative to the pod spec
+func podSpecFields(paths ...string) []fieldSpec {
+	var out []fieldSpec
+	for _, kind := range workloadKinds {
+		prefix := strings.Join(podSpecKeys(kind), ".")
+		for _, path := range paths {
+			out = append(out, fieldSpec{Kind: kind, Path: prefix + "." + path})
+		}
+	}
+	return out
+}
+
+// containerFields returns podSpecFields for paths relative to every kind of container
+func containerFields(paths ...string) []fieldSpec {
+	var prefixed []string
+	for _, list := range containerLists {
+		for _, path := range paths {
+			prefixed = append(prefixed, list+"."+path)
+		}
+	}
+	return podSpecFields(prefixed...)
+}
+
+func fields(specs ...[]fieldSpec) []fieldSpec {
+	var out []fieldSpec
+	for _, s := range specs {
+		out = append(out, s...)
+	}
+	return out
+}
+
+// defaultNameReferences are the fields of built in kinds that refer to other documents by name.
+// Where the map holding a name also has a kind (e.g. subjects, roleRef) it must match too.
+var defaultNameReferences = []nameReference{
+	{
+		Kind: "ConfigMap",
+		FieldSpecs: fields(
+			podSpecFields("volumes.configMap.name", "volumes.projected.sources.configMap.name"),
+			containerFields("env.valueFrom.configMapKeyRef.name", "envFrom.configMapRef.name"),
+		),
+	},
+	{
+		Kind: "Secret",
+		FieldSpecs: fields(
+			podSpecFields("volumes.secret.secretName", "volumes.projected.sources.secret.name", "imagePullSecrets.name"),
+			containerFields("env.valueFrom.secretKeyRef.name", "envFrom.secretRef.name"),
+			[]fieldSpec{
+				{Kind: "ServiceAccount", Path: "secrets.name"},
+				{Kind: "ServiceAccount", Path: "imagePullSecrets.name"},
+				{Kind: "Ingress", Path: "spec.tls.secretName"},
+			},
+		),
+	},
+	{
+		Kind: "ServiceAccount",
+		FieldSpecs: fields(
+			podSpecFields("serviceAccountName", "serviceAccount"),
+			[]fieldSpec{
+				{Kind: "RoleBinding", Path: "subjects.name"},
+				{Kind: "ClusterRoleBinding", Path: "subjects.name"},
+			},
+		),
+	},
+	{
+		Kind: "PersistentVolumeClaim",
+		FieldSpecs: fields(
+			podSpecFields("volumes.persistentVolumeClaim.claimName"),
+		),
+	},
+	{
+		Kind: "PriorityClass",
+		FieldSpecs: fields(
+			podSpecFields("priorityClassName"),
+		),
+	},
+	{
+		Kind: "Role",
+		FieldSpecs: []fieldSpec{
+			{Kind: "RoleBinding", Path: "roleRef.name"},
+		},
+	},
+	{
+		Kind: "ClusterRole",
+		FieldSpecs: []fieldSpec{
+			{Kind: "RoleBinding", Path: "roleRef.name"},
+			{Kind: "ClusterRoleBinding", Path: "roleRef.name"},
+		},
+	},
+	{
+		Kind: "Service",
+		FieldSpecs: []fieldSpec{
+			{Kind: "Ingress", Path: "spec.rules.http.paths.backend.service.name"},
+			{Kind: "Ingress", Path: "spec.rules.http.paths.backend.serviceName"},
+			{Kind: "Ingress", Path: "spec.defaultBackend.service.name"},
+			{Kind: "Ingress", Path: "spec.backend.serviceName"},
+			{Kind: "StatefulSet", Path: "spec.serviceName"},
+			{Kind: "APIService", Path: "spec.service.name"},
+			{Kind: "MutatingWebhookConfiguration", Path: "webhooks.clientConfig.service.name"},
+			{Kind: "ValidatingWebhookConfiguration", Path: "webhooks.clientConfig.service.name"},
+		},
+	},
+	{
+		Kind: "Deployment",
+		FieldSpecs: []fieldSpec{
+			{Kind: "HorizontalPodAutoscaler", Path: "spec.scaleTargetRef.name"},
+		},
+	},
+	{
+		Kind: "StatefulSet",
+		FieldSpecs: []fieldSpec{
+			{Kind: "HorizontalPodAutoscaler", Path: "spec.scaleTargetRef.name"},
+		},
+	},
+}
+
+// excludedFromRename are kinds whose names are fixed by their content or would need
+// every document in them to move
+var excludedFromRename = map[string]bool{
+	"APIService":               true,
+	"CustomResourceDefinition": true,
+	"Namespace":                true,
+}
+
+// resourceID identifies a document by kind, namespace and name
+type resourceID struct {
+	kind      string
+	namespace string
+	name      string
+}
+
+func (id resourceID) String() string {
+	if id.namespace == "" {
+		return fmt.Sprintf("%s/%s", id.kind, id.name)
+	}
+	return fmt.Sprintf("%s/%s/%s", id.kind, id.namespace, id.name)
+}
+
+func docID(doc map[interface{}]interface{}) resourceID {
+	kind, _ := doc["kind"].(string)
+	metadata, _ := doc["metadata"].(map[interface{}]interface{})
+	namespace, _ := metadata["namespace"].(string)
+	name, _ := metadata["name"].(string)
+	return resourceID{kind: kind, namespace: namespace, name: name}
+}
+
+// nameTransformer renames selected documents and updates references to them across the stream
+type nameTransformer struct {
+	prefix     string
+	suffix     string
+	kinds      map[string]bool
+	references []nameReference
+}
+
+// getNameReferences returns defaultNameReferences extended with those in a YAML file or inline
+// YAML
+func getNameReferences(references string) ([]nameReference, error) {
+	if references == "" {
+		return defaultNameReferences, nil
+	}
+
+	var extra []nameReference
+	refBytes, err := getInputBytes(references)
+	if err != nil {
+		return nil, fmt.Errorf("error loading name references '%s': %s", references, err)
+	}
+
+	err = yaml.UnmarshalStrict(refBytes, &extra)
+	if err != nil {
+		return nil, fmt.Errorf("error parsing name references '%s': %s", references, err)
+	}
+	return append(append([]nameReference{}, defaultNameReferences...), extra...), nil
+}
+
+func newNameTransformer(prefix string, suffix string, kinds []string, references []nameReference) *nameTransformer {
+	t := &nameTransformer{
+		prefix:     prefix,
+		suffix:     suffix,
+		references: references,
+	}
+
+	if len(kinds) > 0 {
+		t.kinds = make(map[string]bool)
+		for _, kind := range kinds {
+			t.kinds[kind] = true
+		}
+	}
+	return t
+}
+
+func (t *nameTransformer) transform(docs []*document) {
+	renamed := make(map[resourceID]string)
+
+	for _, doc := range docs {
+		id := docID(doc.data)
+		if !doc.selected || id.name == "" || excludedFromRename[id.kind] {
+			continue
+		}
+		if t.kinds != nil && !t.kinds[id.kind] {
+			continue
+		}
+
+		name := t.prefix + id.name + t.suffix
+		doc.data["metadata"].(map[interface{}]interface{})["name"] = name
+		renamed[id] = name
+	}
+
+	if len(renamed) == 0 {
+		return
+	}
+
+	for _, doc := range docs {
+		updateReferences(doc.data, t.references, renamed)
+	}
+}
+
+// updateReferences renames every reference in doc to a document in renamed
+func updateReferences(doc map[interface{}]interface{}, references []nameReference, renamed map[resourceID]string) {
+	eachReference(doc, references, func(target resourceID, parent map[interface{}]interface{}, key string) {
+		if newName, ok := renamed[target]; ok {
+			parent[key] = newName
+		}
+	})
+}
+
+// eachReference calls fn for every field in doc that refers to another document by name
+func eachReference(doc map[interface{}]interface{}, references []nameReference, fn func(target resourceID, parent map[interface{}]interface{}, key string)) {
+	id := docID(doc)
+
+	for _, ref := range references {
+		for _, spec := range ref.FieldSpecs {
+			if spec.Kind != "" && spec.Kind != id.kind {
+				continue
+			}
+
+			keys := strings.Split(spec.Path, ".")
+			walkFields(doc, keys, func(parent map[interface{}]interface{}, key string) {
+				name, ok := parent[key].(string)
+				if !ok {
+					return
+				}
+
+				// Maps other than the document itself that say what they refer to must agree
+				if kind, ok := parent["kind"]; ok && len(keys) > 1 && kind != ref.Kind {
+					return
+				}
+
+				namespace := id.namespace
+				if ns, ok := parent["namespace"].(string); ok && len(keys) > 1 {
+					namespace = ns
+				}
+				if clusterScopedKinds[ref.Kind] {
+					namespace = ""
+				}
+
+				fn(resourceID{kind: ref.Kind, namespace: namespace, name: name}, parent, key)
+			})
+		}
+	}
+}
+
+// walkFields calls fn with the map holding the last key for every value at keys.
+// Lists found along the way are traversed.
+func walkFields(node interface{}, keys []string, fn func(parent map[interface{}]interface{}, key string)) {
+	switch v := node.(type) {
+	case []interface{}:
+		for _, item := range v {
+			walkFields(item, keys, fn)
+		}
+	case map[interface{}]interface{}:
+		if len(keys) == 1 {
+			if _, ok := v[keys[0]]; ok {
+				fn(v, keys[0])
+			}
+			return
+		}
+		walkFields(v[keys[0]], keys[1:], fn)
+	}
+}
@@ -0,0 +1,132 @@
+package kpatch
+
+// namespaceTransformer moves namespaced resources to a namespace and updates references to them
+type namespaceTransformer struct {
+	namespace    string
+	clusterKinds map[string]bool
+	// moved are the kind/namespace/name of the documents that were moved
+	moved map[string]bool
+}
+
+func newNamespaceTransformer(namespace string) *namespaceTransformer {
+	clusterKinds := make(map[string]bool)
+	for kind := range clusterScopedKinds {
+		clusterKinds[kind] = true
+	}
+	return &namespaceTransformer{namespace: namespace, clusterKinds: clusterKinds, moved: make(map[string]bool)}
+}
+
+// transform moves the selected documents in docs to the namespace and updates references to
+// them. The scope of every CRD is read first so custom kinds are known to be cluster scoped
+// wherever their CRD is in the stream and whether or not it was selected.
+func (t *namespaceTransformer) transform(docs []*document) {
+	for _, doc := range docs {
+		if doc.data["kind"] == "CustomResourceDefinition" {
+			t.recordScope(doc.data)
+		}
+	}
+
+	for _, doc := range docs {
+		if doc.selected {
+			t.move(doc.data)
+		}
+	}
+
+	t.updateReferences(docs)
+}
+
+// move sets the namespace of a namespaced document and removes it from a cluster scoped one
+func (t *namespaceTransformer) move(doc map[interface{}]interface{}) {
+	kind, _ := doc["kind"].(string)
+
+	metadata, ok := doc["metadata"].(map[interface{}]interface{})
+	if !ok {
+		metadata = make(map[interface{}]interface{})
+	}
+
+	if t.clusterKinds[kind] {
+		delete(metadata, "namespace")
+		return
+	}
+
+	previous, _ := metadata["namespace"].(string)
+	name, _ := metadata["name"].(string)
+	if namespaceOrDefault(previous) != t.namespace {
+		t.moved[namespacedIdentity(kind, previous, name)] = true
+	}
+	metadata["namespace"] = t.namespace
+	doc["metadata"] = metadata
+}
+
+// updateReferences moves references to documents that were moved in docs, e.g.
+// ClusterRoleBinding subjects and webhook services
+func (t *namespaceTransformer) updateReferences(docs []*document) {
+	for _, doc := range docs {
+		switch doc.data["kind"] {
+		case "RoleBinding", "ClusterRoleBinding":
+			subjects, _ := doc.data["subjects"].([]interface{})
+			for _, item := range subjects {
+				subject, ok := item.(map[interface{}]interface{})
+				if ok && subject["kind"] == "ServiceAccount" {
+					t.updateRef(subject, "ServiceAccount")
+				}
+			}
+		case "MutatingWebhookConfiguration", "ValidatingWebhookConfiguration":
+			webhooks, _ := doc.data["webhooks"].([]interface{})
+			for _, item := range webhooks {
+				t.updateServiceRef(item, []string{"clientConfig", "service"})
+			}
+		case "APIService":
+			t.updateServiceRef(doc.data, []string{"spec", "service"})
+		case "CustomResourceDefinition":
+			t.updateServiceRef(doc.data, []string{"spec", "conversion", "webhook", "clientConfig", "service"})
+		}
+	}
+}
+
+// recordScope remembers custom kinds that are cluster scoped
+func (t *namespaceTransformer) recordScope(crd map[interface{}]interface{}) {
+	spec, _ := crd["spec"].(map[interface{}]interface{})
+	names, _ := spec["names"].(map[interface{}]interface{})
+	kind, _ := names["kind"].(string)
+	if kind != "" && spec["scope"] == "Cluster" {
+		t.clusterKinds[kind] = true
+	}
+}
+
+// updateRef moves a reference to a document of kind that was moved. References to documents
+// that weren't moved or aren't in the stream are left alone.
+func (t *namespaceTransformer) updateRef(ref map[interface{}]interface{}, kind string) {
+	ns, _ := ref["namespace"].(string)
+	name, _ := ref["name"].(string)
+	if t.moved[namespacedIdentity(kind, ns, name)] {
+		ref["namespace"] = t.namespace
+	}
+}
+
+func (t *namespaceTransformer) updateServiceRef(item interface{}, keys []string) {
+	for _, key := range keys {
+		m, ok := item.(map[interface{}]interface{})
+		if !ok {
+			return
+		}
+		item = m[key]
+	}
+
+	if service, ok := item.(map[interface{}]interface{}); ok {
+		t.updateRef(service, "Service")
+	}
+}
+
+// namespaceOrDefault returns the namespace a resource without one is created in
+func namespaceOrDefault(namespace string) string {
+	if namespace == "" {
+		return "default"
+	}
+	return namespace
+}
+
+// namespacedIdentity identifies a namespaced resource treating no namespace as the default one
+func namespacedIdentity(kind string, namespace string, name string) string {
+	return kind + "/" + namespaceOrDefault(namespace) + "/" + name
+}
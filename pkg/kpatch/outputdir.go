@@ -0,0 +1,212 @@
+package kpatch
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/spf13/afero"
+	yaml "gopkg.in/yaml.v2"
+)
+
+const (
+	collisionAppend = "append"
+	collisionError  = "error"
+
+	defaultLayout = "{{namespace}}/{{kind}}-{{name}}.yaml"
+
+	kustomizationFile = "kustomization.yaml"
+)
+
+var layoutField = regexp.MustCompile(`{{\s*(\w+)\s*}}`)
+
+// outputDir writes each document to its own file in a directory
+type outputDir struct {
+	dir           string
+	layout        string
+	collision     string
+	kustomization bool
+	clean         bool
+}
+
+func newOutputDir(dir string, layout string, collision string, kustomization bool, clean bool) (*outputDir, error) {
+	if layout == "" {
+		layout = defaultLayout
+	}
+	for _, match := range layoutField.FindAllStringSubmatch(layout, -1) {
+		if _, ok := layoutValues(&document{data: map[interface{}]interface{}{}})[match[1]]; !ok {
+			return nil, fmt.Errorf("unknown layout field '%s': expected namespace, kind, name, group, version or index", match[1])
+		}
+	}
+
+	switch collision {
+	case "":
+		collision = collisionAppend
+	case collisionAppend, collisionError:
+	default:
+		return nil, fmt.Errorf("unknown collision mode '%s': expected %s or %s", collision, collisionAppend, collisionError)
+	}
+
+	return &outputDir{dir: filepath.Clean(dir), layout: layout, collision: collision, kustomization: kustomization, clean: clean}, nil
+}
+
+// layoutValues are the fields available to layouts. Empty values drop their part of the path so
+// cluster scoped documents aren't put in a directory named after an empty namespace.
+func layoutValues(doc *document) map[string]string {
+	id := docID(doc.data)
+	apiVersion, _ := doc.data["apiVersion"].(string)
+	group, version := "", apiVersion
+	if i := strings.LastIndex(apiVersion, "/"); i >= 0 {
+		group, version = apiVersion[:i], apiVersion[i+1:]
+	}
+
+	return map[string]string{
+		"namespace": id.namespace,
+		"kind":      id.kind,
+		"name":      id.name,
+		"group":     group,
+		"version":   version,
+		"index":     fmt.Sprint(doc.index),
+	}
+}
+
+// path returns the path of doc relative to the output directory
+func (o *outputDir) path(doc *document) string {
+	values := layoutValues(doc)
+
+	path := layoutField.ReplaceAllStringFunc(o.layout, func(field string) string {
+		// Values must not add directories of their own
+		return strings.Replace(values[layoutField.FindStringSubmatch(field)[1]], "/", "_", -1)
+	})
+
+	var parts []string
+	for _, part := range strings.Split(path, "/") {
+		if part != "" {
+			parts = append(parts, part)
+		}
+	}
+	return filepath.Join(parts...)
+}
+
+// outside reports whether path, relative to the output directory, is outside of it
+func outside(path string) bool {
+	return filepath.IsAbs(path) || path == ".." || strings.HasPrefix(path, ".."+string(filepath.Separator))
+}
+
+// write writes docs to their files, an optional kustomization.yaml listing them and removes
+// stale YAML files when clean is set.
+func (o *outputDir) write(docs []*document) error {
+	var order []string
+	content := make(map[string]*bytes.Buffer)
+	owners := make(map[string]*document)
+
+	for _, doc := range docs {
+		path := o.path(doc)
+		if path == "" || outside(path) || path == kustomizationFile && o.kustomization {
+			return fmt.Errorf("layout '%s' gives %s an invalid path '%s'", o.layout, doc, path)
+		}
+
+		out, err := yaml.Marshal(doc.data)
+		if err != nil {
+			return fmt.Errorf("error encoding %s: %s", doc, err)
+		}
+
+		buf, ok := content[path]
+		if ok {
+			if o.collision == collisionError {
+				return fmt.Errorf("%s and %s are both written to '%s'", owners[path], doc, path)
+			}
+			buf.WriteString("---\n")
+		} else {
+			buf = &bytes.Buffer{}
+			content[path] = buf
+			owners[path] = doc
+			order = append(order, path)
+		}
+		buf.Write(out)
+	}
+
+	if o.kustomization {
+		resources := append([]string{}, order...)
+		for i, path := range resources {
+			resources[i] = filepath.ToSlash(path)
+		}
+		out, err := yaml.Marshal(yaml.MapSlice{
+			{Key: "apiVersion", Value: "kustomize.config.k8s.io/v1beta1"},
+			{Key: "kind", Value: "Kustomization"},
+			{Key: "resources", Value: resources},
+		})
+		if err != nil {
+			return err
+		}
+		content[kustomizationFile] = bytes.NewBuffer(out)
+		order = append(order, kustomizationFile)
+	}
+
+	if o.clean {
+		if err := o.removeStale(content); err != nil {
+			return err
+		}
+	}
+
+	for _, path := range order {
+		file := filepath.Join(o.dir, path)
+		if err := Fs.MkdirAll(filepath.Dir(file), 0755); err != nil {
+			return fmt.Errorf("error creating directory for '%s': %s", file, err)
+		}
+		if err := afero.WriteFile(Fs, file, content[path].Bytes(), 0644); err != nil {
+			return fmt.Errorf("error writing '%s': %s", file, err)
+		}
+	}
+	return nil
+}
+
+// removeStale removes YAML files in the output directory that aren't about to be written and
+// any directories left empty
+func (o *outputDir) removeStale(keep map[string]*bytes.Buffer) error {
+	if _, err := Fs.Stat(o.dir); os.IsNotExist(err) {
+		return nil
+	}
+
+	var dirs []string
+	err := afero.Walk(Fs, o.dir, func(file string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if info.IsDir() {
+			dirs = append(dirs, file)
+			return nil
+		}
+
+		rel, err := filepath.Rel(o.dir, file)
+		if err != nil {
+			return err
+		}
+		ext := filepath.Ext(file)
+		if _, ok := keep[rel]; ok || (ext != ".yaml" && ext != ".yml") {
+			return nil
+		}
+		return Fs.Remove(file)
+	})
+	if err != nil {
+		return fmt.Errorf("error cleaning '%s': %s", o.dir, err)
+	}
+
+	// Deepest first so parents are empty by the time they are checked
+	sort.Sort(sort.Reverse(sort.StringSlice(dirs)))
+	for _, dir := range dirs {
+		if dir == o.dir {
+			continue
+		}
+		if empty, err := afero.IsEmpty(Fs, dir); err == nil && empty {
+			if err = Fs.Remove(dir); err != nil {
+				return fmt.Errorf("error cleaning '%s': %s", o.dir, err)
+			}
+		}
+	}
+	return nil
+}
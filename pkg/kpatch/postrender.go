@@ -0,0 +1,166 @@
+package kpatch
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"sort"
+
+	"github.com/ansel1/merry"
+	yaml "gopkg.in/yaml.v2"
+)
+
+// PostRenderConfigEnv is the environment variable the post-render config is read from when it
+// isn't given as a flag since Helm runs post-renderers without arguments by default
+const PostRenderConfigEnv = "KPATCH_POST_RENDER_CONFIG"
+
+// postRenderRule is one step of a post-render config. Each rule is applied to the output of the
+// previous one.
+type postRenderRule struct {
+	Selector       string        `yaml:"selector,omitempty"`
+	Actions        []string      `yaml:"actions,omitempty"`
+	Merges         []interface{} `yaml:"merges,omitempty"`
+	Strict         bool          `yaml:"strict,omitempty"`
+	Images         interface{}   `yaml:"images,omitempty"`
+	Namespace      string        `yaml:"namespace,omitempty"`
+	NamePrefix     string        `yaml:"namePrefix,omitempty"`
+	NameSuffix     string        `yaml:"nameSuffix,omitempty"`
+	NameKinds      []string      `yaml:"nameKinds,omitempty"`
+	HashConfigMaps string        `yaml:"hashConfigMaps,omitempty"`
+	MigrateAPIs    string        `yaml:"migrateAPIs,omitempty"`
+	Dedupe         string        `yaml:"dedupe,omitempty"`
+	Sort           string        `yaml:"sort,omitempty"`
+	Validate       bool          `yaml:"validate,omitempty"`
+	Typed          bool          `yaml:"typed,omitempty"`
+}
+
+// postRenderConfig is the rules file given to kpatch post-render
+type postRenderConfig struct {
+	Params      map[string]string `yaml:"params,omitempty"`
+	KubeVersion string            `yaml:"kubeVersion,omitempty"`
+	Rules       []postRenderRule  `yaml:"rules,omitempty"`
+}
+
+// inlineYAML returns v as a string Run will accept as a file name or inline YAML
+func inlineYAML(v interface{}) (string, error) {
+	if s, ok := v.(string); ok {
+		return s, nil
+	}
+	out, err := yaml.Marshal(v)
+	return string(out), err
+}
+
+func getPostRenderConfig(config string) (*postRenderConfig, error) {
+	configBytes, err := getInputBytes(config)
+	if err != nil {
+		return nil, fmt.Errorf("error loading post-render config '%s': %s", config, err)
+	}
+
+	return parsePostRenderConfig(configBytes, fmt.Sprintf("post-render config '%s'", config))
+}
+
+// parsePostRenderConfig parses a rules file. name describes where it came from in errors.
+func parsePostRenderConfig(configBytes []byte, name string) (*postRenderConfig, error) {
+	var c postRenderConfig
+	if err := yaml.UnmarshalStrict(configBytes, &c); err != nil {
+		return nil, fmt.Errorf("error parsing %s: %s", name, err)
+	}
+	if len(c.Rules) == 0 {
+		return nil, fmt.Errorf("%s has no rules", name)
+	}
+	return &c, nil
+}
+
+// options returns the Run options for rule
+func (c *postRenderConfig) options(rule postRenderRule) (Options, error) {
+	opts := Options{
+		Selector:       rule.Selector,
+		Actions:        rule.Actions,
+		Strict:         rule.Strict,
+		Namespace:      rule.Namespace,
+		NamePrefix:     rule.NamePrefix,
+		NameSuffix:     rule.NameSuffix,
+		NameKinds:      rule.NameKinds,
+		HashConfigMaps: rule.HashConfigMaps,
+		MigrateAPIs:    rule.MigrateAPIs,
+		Dedupe:         rule.Dedupe,
+		Sort:           rule.Sort,
+		Validate:       rule.Validate,
+		Typed:          rule.Typed,
+		KubeVersion:    c.KubeVersion,
+	}
+
+	keys := make([]string, 0, len(c.Params))
+	for key := range c.Params {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		opts.Params = append(opts.Params, key+"="+c.Params[key])
+	}
+
+	for _, merge := range rule.Merges {
+		m, err := inlineYAML(merge)
+		if err != nil {
+			return opts, err
+		}
+		opts.Merges = append(opts.Merges, m)
+	}
+
+	if rule.Images != nil {
+		images, err := inlineYAML(rule.Images)
+		if err != nil {
+			return opts, err
+		}
+		opts.Images = images
+	}
+	return opts, nil
+}
+
+type nopWriteCloser struct {
+	io.Writer
+}
+
+func (nopWriteCloser) Close() error { return nil }
+
+// apply runs each rule over content in turn writing warnings to stderr
+func (c *postRenderConfig) apply(content []byte, preserveComments bool, stderr io.Writer) ([]byte, error) {
+	for i, rule := range c.Rules {
+		opts, err := c.options(rule)
+		if err != nil {
+			return nil, merry.Wrap(err).WithUserMessagef("rule %d: %s", i+1, err)
+		}
+		opts.PreserveComments = preserveComments
+
+		var out bytes.Buffer
+		if err = run([]string{"-"}, bytes.NewReader(content), stderr, opts, nopWriteCloser{&out}); err != nil {
+			return nil, merry.Wrap(err).WithUserMessagef("rule %d: %s", i+1, merry.UserMessage(err))
+		}
+		content = out.Bytes()
+	}
+	return content, nil
+}
+
+// PostRender applies the rules in config to the manifests Helm writes to input, keeping the
+// "# Source:" comments Helm adds to each document.
+func PostRender(config string, input io.Reader, output io.WriteCloser) error {
+	defer output.Close()
+
+	c, err := getPostRenderConfig(config)
+	if err != nil {
+		return merry.Wrap(err).WithUserMessagef("%s", err)
+	}
+
+	content, err := ioutil.ReadAll(input)
+	if err != nil {
+		return merry.Wrap(err).WithUserMessagef("error reading manifests: %s", err)
+	}
+
+	if content, err = c.apply(content, true, Stderr); err != nil {
+		return err
+	}
+
+	_, err = output.Write(content)
+	return err
+}
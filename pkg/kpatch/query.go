@@ -0,0 +1,26 @@
+package kpatch
+
+import (
+	"fmt"
+	"io"
+
+	yaml "gopkg.in/yaml.v2"
+)
+
+// writeQueryResult writes scalars one per line and anything else as a YAML document
+func writeQueryResult(result interface{}, output io.Writer) error {
+	switch result.(type) {
+	case nil:
+		result = "null"
+	case map[interface{}]interface{}, map[string]interface{}, []interface{}:
+		out, err := yaml.Marshal(result)
+		if err != nil {
+			return err
+		}
+		_, err = fmt.Fprintf(output, "---\n%s", out)
+		return err
+	}
+
+	_, err := fmt.Fprintln(output, result)
+	return err
+}
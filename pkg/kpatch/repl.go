@@ -0,0 +1,588 @@
+package kpatch
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/PaesslerAG/gval"
+	"github.com/ansel1/merry"
+	"github.com/spf13/afero"
+	"golang.org/x/term"
+	yaml "gopkg.in/yaml.v2"
+)
+
+const replHelp = `Lines are actions applied to every selected document. Commands:
+  :next, :n            go to the next selected document
+  :prev, :p            go to the previous selected document
+  :doc N               go to document N
+  :list, :ls           list documents, * marks selected ones
+  :show                write the current document
+  :select [expr]       select documents with expr and explain it for the current document, or select all
+  :eval expr           evaluate expr against the current document without changing it
+  :diff                show how the current document differs from when it was loaded
+  :undo                undo the last action
+  :rules               write the rules the actions so far make
+  :save file           save the rules to a file for kpatch post-render or kpatch fn
+  :history             list the lines entered so far
+  :quit, :q            leave
+`
+
+// replDocument is a document loaded in to a repl session
+type replDocument struct {
+	source   string
+	index    int
+	original map[interface{}]interface{}
+	data     map[interface{}]interface{}
+}
+
+// key identifies the document for as long as the session lasts
+func (d *replDocument) key() string {
+	return fmt.Sprintf("%d:%s", d.index, d.source)
+}
+
+// replState is what :undo returns to
+type replState struct {
+	docs    []*replDocument
+	rules   []postRenderRule
+	current int
+	matched map[string]bool
+}
+
+// repl is an interactive session building selectors and actions against a set of documents
+type repl struct {
+	kp           *kpatch
+	selectorLang gval.Language
+	lang         gval.Language
+	out          io.Writer
+
+	docs     []*replDocument
+	current  int
+	selector string
+	rules    []postRenderRule
+	// matched are the documents the selector of the last rule matched before its first action.
+	// Later actions only join the rule while the selector matches the same documents as a rules
+	// file evaluates the selector once for all of the actions of a rule.
+	matched map[string]bool
+	undo    []replState
+	history []string
+
+	kubeVersion string
+}
+
+// loadReplDocuments reads the non empty documents in files
+func loadReplDocuments(files []string) ([]*replDocument, error) {
+	var docs []*replDocument
+	nextInput := inputReaderFn(files)
+	for i := range files {
+		input, err := nextInput()
+		if err != nil {
+			return nil, fmt.Errorf("error reading '%s': %s", files[i], err)
+		}
+		content, err := ioutil.ReadAll(input)
+		if err != nil {
+			return nil, fmt.Errorf("error reading '%s': %s", files[i], err)
+		}
+
+		decoder := yaml.NewDecoder(strings.NewReader(string(content)))
+		for index := 1; ; index++ {
+			doc := make(map[interface{}]interface{})
+			if err := decoder.Decode(&doc); err != nil {
+				break
+			}
+			if len(doc) == 0 {
+				continue
+			}
+
+			original, err := deepCopy(doc)
+			if err != nil {
+				return nil, err
+			}
+			docs = append(docs, &replDocument{source: files[i], index: index, original: original, data: doc})
+		}
+	}
+	return docs, nil
+}
+
+func newRepl(files []string, opts Options, out io.Writer) (*repl, error) {
+	params, err := getParams(opts.Params)
+	if err != nil {
+		return nil, err
+	}
+
+	kp := &kpatch{
+		missingKeyMode: "get",
+		doc:            make(map[interface{}]interface{}),
+		strict:         opts.Strict,
+		params:         params,
+		failures:       &[]assertionFailure{},
+		log:            out,
+	}
+	if opts.AgeKeyFile != "" {
+		if kp.identities, err = getAgeIdentities(opts.AgeKeyFile); err != nil {
+			return nil, err
+		}
+	}
+
+	docs, err := loadReplDocuments(files)
+	if err != nil {
+		return nil, err
+	}
+	if len(docs) == 0 {
+		return nil, fmt.Errorf("no documents in %s", strings.Join(files, ", "))
+	}
+
+	if opts.Typed {
+		if kp.schemas, err = loadSchemas(opts, Stderr); err != nil {
+			return nil, err
+		}
+		for _, doc := range docs {
+			if err = kp.schemas.addCRD(doc.data); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	r := &repl{kp: kp, out: out, docs: docs, selector: opts.Selector, kubeVersion: opts.KubeVersion}
+	r.selectorLang = kp.selectorLanguage()
+	r.lang = kp.actionLanguage()
+	return r, nil
+}
+
+func (r *repl) printf(format string, args ...interface{}) {
+	fmt.Fprintf(r.out, format, args...)
+}
+
+// error writes the user message of err if it has one so actions fail like they do in Run
+func (r *repl) error(err error) {
+	message := merry.UserMessage(err)
+	if message == "" {
+		message = err.Error()
+	}
+	r.printf("error: %s\n", message)
+}
+
+// use makes doc the document expressions are evaluated against
+func (r *repl) use(doc *replDocument) {
+	r.kp.Reset()
+	r.kp.doc = doc.data
+	r.kp.currentItem = doc.data
+	r.kp.source = doc.source
+	r.kp.index = doc.index
+}
+
+func (r *repl) selected(doc *replDocument) (bool, error) {
+	if r.selector == "" {
+		return true, nil
+	}
+	r.use(doc)
+	r.kp.lang = r.selectorLang
+	value, err := r.selectorLang.Evaluate(r.selector, doc.data)
+	return value == true, err
+}
+
+func (r *repl) prompt() string {
+	doc := r.docs[r.current]
+	return fmt.Sprintf("kpatch [%d/%d %s]> ", r.current+1, len(r.docs), docID(doc.data))
+}
+
+func (r *repl) describe(i int) string {
+	doc := r.docs[i]
+	return fmt.Sprintf("%d: %s (document %d of '%s')", i+1, docID(doc.data), doc.index, doc.source)
+}
+
+// seek goes step documents at a time from document from to the first selected document
+func (r *repl) seek(from int, step int) error {
+	for i := from; i >= 0 && i < len(r.docs); i += step {
+		ok, err := r.selected(r.docs[i])
+		if err != nil {
+			return err
+		}
+		if ok {
+			r.current = i
+			r.printf("%s\n", r.describe(i))
+			return nil
+		}
+	}
+	r.printf("no more selected documents\n")
+	return nil
+}
+
+func (r *repl) list() error {
+	for i, doc := range r.docs {
+		ok, err := r.selected(doc)
+		if err != nil {
+			return err
+		}
+
+		marker := " "
+		if ok {
+			marker = "*"
+		}
+		if i == r.current {
+			marker = ">" + marker
+		} else {
+			marker = " " + marker
+		}
+		r.printf("%s %s\n", marker, r.describe(i))
+	}
+	return nil
+}
+
+func (r *repl) show() error {
+	out, err := yaml.Marshal(r.docs[r.current].data)
+	if err != nil {
+		return err
+	}
+	r.printf("%s", out)
+	return nil
+}
+
+func (r *repl) diff(old map[interface{}]interface{}, new map[interface{}]interface{}) {
+	var differences []difference
+	compareValues("", old, new, &differences)
+	if len(differences) == 0 {
+		r.printf("no changes\n")
+	}
+	for _, d := range differences {
+		r.printf("%s\n", formatDifference(d))
+	}
+}
+
+// selectDocuments changes the selector and explains it for the current document
+func (r *repl) selectDocuments(expr string) {
+	r.selector = expr
+	if expr == "" {
+		r.printf("selecting every document\n")
+		return
+	}
+
+	// The tracer records the value of each part of the selector and the variables it reads
+	r.use(r.docs[r.current])
+	r.kp.lang = r.selectorLang
+	r.kp.trace = &tracer{w: r.out}
+	_, _ = r.kp.trace.selector(r.kp.selectorLanguage(), expr, r.kp.doc)
+	r.kp.trace = nil
+}
+
+// eval evaluates expr against a copy of the current document
+func (r *repl) eval(expr string) error {
+	doc, err := deepCopy(r.docs[r.current].data)
+	if err != nil {
+		return err
+	}
+
+	r.use(&replDocument{source: r.docs[r.current].source, index: r.docs[r.current].index, data: doc})
+	r.kp.lang = r.lang
+	value, err := r.lang.Evaluate(expr, doc)
+	*r.kp.failures = nil
+	if err != nil {
+		return err
+	}
+	r.printf("%s\n", formatValue(value))
+	return nil
+}
+
+// snapshot copies the session for :undo
+func (r *repl) snapshot() (replState, error) {
+	state := replState{rules: make([]postRenderRule, len(r.rules)), current: r.current, matched: r.matched}
+	for i, rule := range r.rules {
+		state.rules[i] = rule
+		state.rules[i].Actions = append([]string{}, rule.Actions...)
+	}
+
+	for _, doc := range r.docs {
+		data, err := deepCopy(doc.data)
+		if err != nil {
+			return state, err
+		}
+		state.docs = append(state.docs, &replDocument{source: doc.source, index: doc.index, original: doc.original, data: data})
+	}
+	return state, nil
+}
+
+func (r *repl) restore(state replState) {
+	r.docs, r.rules, r.current, r.matched = state.docs, state.rules, state.current, state.matched
+}
+
+// action applies expr to every selected document and shows how the current one changed
+func (r *repl) action(expr string) error {
+	state, err := r.snapshot()
+	if err != nil {
+		return err
+	}
+	before := state.docs[r.current].data
+
+	var kept []*replDocument
+	matched := make(map[string]bool)
+	changed := 0
+	current := r.docs[r.current]
+	for _, doc := range r.docs {
+		ok, err := r.selected(doc)
+		if err != nil {
+			r.restore(state)
+			return err
+		}
+		if !ok {
+			kept = append(kept, doc)
+			continue
+		}
+
+		matched[doc.key()] = true
+		old, err := deepCopy(doc.data)
+		if err != nil {
+			r.restore(state)
+			return err
+		}
+
+		r.use(doc)
+		if err = r.kp.applyAction(r.lang, expr); err != nil {
+			r.restore(state)
+			return err
+		}
+		doc.data = r.kp.doc
+
+		if r.kp.drop {
+			r.printf("dropped %s\n", docID(doc.data))
+			changed++
+			continue
+		}
+		var differences []difference
+		if compareValues("", old, doc.data, &differences); len(differences) > 0 {
+			changed++
+		}
+		kept = append(kept, doc)
+	}
+
+	if len(kept) == 0 {
+		r.restore(state)
+		return fmt.Errorf("the action would drop every document")
+	}
+
+	for _, f := range *r.kp.failures {
+		r.printf("assertion failed: %s\n", f)
+	}
+	*r.kp.failures = nil
+
+	r.docs = kept
+	r.current = 0
+	for i, doc := range kept {
+		if doc == current {
+			r.current = i
+		}
+	}
+
+	if n := len(r.rules); n > 0 && r.rules[n-1].Selector == r.selector && reflect.DeepEqual(r.matched, matched) {
+		r.rules[n-1].Actions = append(r.rules[n-1].Actions, expr)
+	} else {
+		r.matched = matched
+		rule := postRenderRule{Selector: r.selector, Actions: []string{expr}, Strict: r.kp.strict, Typed: r.kp.schemas != nil}
+		r.rules = append(r.rules, rule)
+	}
+	r.undo = append(r.undo, state)
+
+	if r.docs[r.current] == current {
+		r.diff(before, current.data)
+	}
+	r.printf("changed %d of %d selected documents\n", changed, len(matched))
+	return nil
+}
+
+func (r *repl) undoAction() {
+	if len(r.undo) == 0 {
+		r.printf("nothing to undo\n")
+		return
+	}
+
+	state := r.undo[len(r.undo)-1]
+	r.undo = r.undo[:len(r.undo)-1]
+	r.restore(state)
+	r.printf("undone\n")
+}
+
+// config returns the rules the actions so far make
+func (r *repl) config() postRenderConfig {
+	c := postRenderConfig{Params: r.kp.params, Rules: r.rules}
+	if r.kp.schemas != nil {
+		c.KubeVersion = r.kubeVersion
+	}
+	return c
+}
+
+func (r *repl) writeRules(w io.Writer) error {
+	out, err := yaml.Marshal(r.config())
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(out)
+	return err
+}
+
+func (r *repl) save(file string) error {
+	if len(r.rules) == 0 {
+		return fmt.Errorf("there are no actions to save")
+	}
+	out, err := yaml.Marshal(r.config())
+	if err != nil {
+		return err
+	}
+	if err = afero.WriteFile(Fs, file, out, 0644); err != nil {
+		return err
+	}
+	r.printf("saved %d rules to '%s'\n", len(r.rules), file)
+	return nil
+}
+
+// execute runs a line reporting whether the session is over
+func (r *repl) execute(line string) (bool, error) {
+	line = strings.TrimSpace(line)
+	if line == "" {
+		return false, nil
+	}
+	r.history = append(r.history, line)
+
+	if !strings.HasPrefix(line, ":") {
+		return false, r.action(line)
+	}
+
+	command, arg := line, ""
+	if i := strings.IndexAny(line, " \t"); i >= 0 {
+		command, arg = line[:i], strings.TrimSpace(line[i+1:])
+	}
+
+	switch command {
+	case ":help", ":h":
+		r.printf("%s", replHelp)
+	case ":next", ":n":
+		return false, r.seek(r.current+1, 1)
+	case ":prev", ":p":
+		return false, r.seek(r.current-1, -1)
+	case ":doc":
+		n, err := strconv.Atoi(arg)
+		if err != nil || n < 1 || n > len(r.docs) {
+			return false, fmt.Errorf(":doc expects a document number from 1 to %d", len(r.docs))
+		}
+		r.current = n - 1
+		r.printf("%s\n", r.describe(r.current))
+	case ":list", ":ls":
+		return false, r.list()
+	case ":show":
+		return false, r.show()
+	case ":select", ":s":
+		r.selectDocuments(arg)
+	case ":eval", ":e":
+		return false, r.eval(arg)
+	case ":diff":
+		doc := r.docs[r.current]
+		r.diff(doc.original, doc.data)
+	case ":undo", ":u":
+		r.undoAction()
+	case ":rules":
+		if len(r.rules) == 0 {
+			r.printf("no actions yet\n")
+			return false, nil
+		}
+		return false, r.writeRules(r.out)
+	case ":save":
+		if arg == "" {
+			return false, fmt.Errorf(":save expects a file name")
+		}
+		return false, r.save(arg)
+	case ":history":
+		for i, h := range r.history[:len(r.history)-1] {
+			r.printf("%d  %s\n", i+1, h)
+		}
+	case ":quit", ":q", ":exit":
+		return true, nil
+	default:
+		commands := []string{":help", ":next", ":prev", ":doc", ":list", ":show", ":select", ":eval", ":diff", ":undo", ":rules", ":save", ":history", ":quit"}
+		sort.Strings(commands)
+		return false, fmt.Errorf("unknown command %s, expected one of %s", command, strings.Join(commands, " "))
+	}
+	return false, nil
+}
+
+// lineReader returns a function reading lines from input. Terminals get line editing and
+// history, anything else is read a line at a time without prompts so sessions can be scripted.
+// Output must be written to the returned writer as the terminal is put in raw mode until
+// restore is called.
+func lineReader(input io.Reader, output io.Writer) (readLine func(prompt string) (string, error), out io.Writer, restore func()) {
+	if f, ok := input.(*os.File); ok && term.IsTerminal(int(f.Fd())) {
+		if state, err := term.MakeRaw(int(f.Fd())); err == nil {
+			t := term.NewTerminal(struct {
+				io.Reader
+				io.Writer
+			}{f, output}, "")
+			readLine = func(prompt string) (string, error) {
+				t.SetPrompt(prompt)
+				return t.ReadLine()
+			}
+			return readLine, t, func() { term.Restore(int(f.Fd()), state) }
+		}
+	}
+
+	scanner := bufio.NewScanner(input)
+	readLine = func(string) (string, error) {
+		if scanner.Scan() {
+			return scanner.Text(), nil
+		}
+		if err := scanner.Err(); err != nil {
+			return "", err
+		}
+		return "", io.EOF
+	}
+	return readLine, output, func() {}
+}
+
+// Repl runs an interactive session over the documents in files. Lines read from input are
+// actions applied to the selected documents, showing how the current document changed, or
+// commands to move between documents, change the selector, undo and save the actions as a
+// rules file for kpatch post-render or kpatch fn. Selectors and actions are evaluated in the
+// same languages as Run.
+func Repl(files []string, opts Options, input io.Reader, output io.Writer) error {
+	for _, file := range files {
+		if file == "-" {
+			msg := "can't read documents from stdin ('-') as the repl reads commands from it"
+			return merry.New(msg).WithUserMessage(msg)
+		}
+	}
+
+	readLine, out, restore := lineReader(input, output)
+	defer restore()
+
+	r, err := newRepl(files, opts, out)
+	if err != nil {
+		return merry.Wrap(err).WithUserMessagef("%s", err)
+	}
+
+	r.printf("%d documents loaded, :help lists commands\n", len(r.docs))
+	if r.selector != "" {
+		if err = r.seek(0, 1); err != nil {
+			r.error(err)
+		}
+	}
+
+	for {
+		line, err := readLine(r.prompt())
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return merry.Wrap(err).WithUserMessagef("error reading input: %s", err)
+		}
+
+		quit, err := r.execute(line)
+		if err != nil {
+			r.error(err)
+		}
+		if quit {
+			return nil
+		}
+	}
+}
@@ -0,0 +1,136 @@
+package kpatch
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"text/tabwriter"
+)
+
+const (
+	reportDeprecations = "deprecations"
+
+	reportTable = "table"
+	reportJSON  = "json"
+)
+
+// deprecation is a document using an API that is deprecated or removed in the report version
+type deprecation struct {
+	Kind         string `json:"kind"`
+	Namespace    string `json:"namespace,omitempty"`
+	Name         string `json:"name"`
+	APIVersion   string `json:"apiVersion"`
+	Replacement  string `json:"replacement"`
+	DeprecatedIn string `json:"deprecatedIn"`
+	RemovedIn    string `json:"removedIn"`
+	Removed      bool   `json:"removed"`
+	Source       string `json:"source"`
+	Index        int    `json:"index"`
+}
+
+// deprecationReport lists the documents using APIs deprecated in a Kubernetes version
+type deprecationReport struct {
+	version kubeVersion
+	format  string
+}
+
+func newDeprecationReport(report string, version string, format string) (*deprecationReport, error) {
+	if report != reportDeprecations {
+		return nil, fmt.Errorf("unknown report '%s': expected %s", report, reportDeprecations)
+	}
+
+	if format == "" {
+		format = reportTable
+	}
+	if format != reportTable && format != reportJSON {
+		return nil, fmt.Errorf("unknown report format '%s': expected %s or %s", format, reportTable, reportJSON)
+	}
+
+	if version == "" {
+		return nil, fmt.Errorf("the %s report requires a Kubernetes version", report)
+	}
+	v, err := parseKubeVersion(version)
+	if err != nil {
+		return nil, err
+	}
+
+	return &deprecationReport{version: v, format: format}, nil
+}
+
+// replacement follows m through any later migrations to the API that should be used instead
+func replacement(m *apiMigration) string {
+	for {
+		if m.to == "" {
+			return "none"
+		}
+		next := findMigration(map[interface{}]interface{}{"kind": m.kind, "apiVersion": m.to})
+		if next == nil {
+			return m.to
+		}
+		m = next
+	}
+}
+
+func (r *deprecationReport) find(docs []*document) []deprecation {
+	out := []deprecation{}
+	for _, doc := range docs {
+		m := findMigration(doc.data)
+		if !doc.selected || m == nil || !r.version.atLeast(m.deprecatedIn) {
+			continue
+		}
+
+		id := docID(doc.data)
+		out = append(out, deprecation{
+			Kind:         id.kind,
+			Namespace:    id.namespace,
+			Name:         id.name,
+			APIVersion:   m.from,
+			Replacement:  replacement(m),
+			DeprecatedIn: m.deprecatedIn.String(),
+			RemovedIn:    m.removedIn.String(),
+			Removed:      r.version.atLeast(m.removedIn),
+			Source:       doc.source,
+			Index:        doc.index,
+		})
+	}
+	return out
+}
+
+// write writes the report for docs to w. It returns an error when any of them use an API
+// that has been removed so that CI fails.
+func (r *deprecationReport) write(docs []*document, w io.Writer) error {
+	found := r.find(docs)
+
+	switch r.format {
+	case reportJSON:
+		encoder := json.NewEncoder(w)
+		encoder.SetIndent("", "  ")
+		if err := encoder.Encode(found); err != nil {
+			return err
+		}
+	default:
+		tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+		fmt.Fprintln(tw, "KIND\tNAMESPACE\tNAME\tAPI VERSION\tREPLACEMENT\tDEPRECATED\tREMOVED\tSOURCE")
+		for _, d := range found {
+			removed := d.RemovedIn
+			if d.Removed {
+				removed += " (removed)"
+			}
+			fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%s\t%s\t%s\tdocument %d of '%s'\n", d.Kind, d.Namespace, d.Name, d.APIVersion, d.Replacement, d.DeprecatedIn, removed, d.Index, d.Source)
+		}
+		if err := tw.Flush(); err != nil {
+			return err
+		}
+	}
+
+	removed := 0
+	for _, d := range found {
+		if d.Removed {
+			removed++
+		}
+	}
+	if removed > 0 {
+		return fmt.Errorf("%d resources use APIs removed in Kubernetes %s", removed, r.version)
+	}
+	return nil
+}
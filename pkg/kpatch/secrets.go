@@ -0,0 +1,82 @@
+package kpatch
+
+import (
+	"encoding/base64"
+	"fmt"
+	"unicode/utf8"
+)
+
+// decodeSecret moves the values of a Secret's data that decode to valid UTF-8 in to stringData
+// so they can be selected and patched as plain strings. Binary values are left in data.
+// Existing stringData takes precedence as it does in the API server.
+func decodeSecret(doc map[interface{}]interface{}) error {
+	if doc["kind"] != "Secret" {
+		return nil
+	}
+
+	data, ok := doc["data"].(map[interface{}]interface{})
+	if !ok {
+		return nil
+	}
+
+	stringData, ok := doc["stringData"].(map[interface{}]interface{})
+	if !ok {
+		stringData = make(map[interface{}]interface{})
+	}
+
+	for key, value := range data {
+		encoded, ok := value.(string)
+		if !ok {
+			return fmt.Errorf("data key '%v' is not a string", key)
+		}
+
+		decoded, err := base64.StdEncoding.DecodeString(encoded)
+		if err != nil {
+			return fmt.Errorf("error decoding data key '%v': %s", key, err)
+		}
+
+		if !utf8.Valid(decoded) {
+			continue
+		}
+
+		if _, ok := stringData[key]; !ok {
+			stringData[key] = string(decoded)
+		}
+		delete(data, key)
+	}
+
+	if len(data) == 0 {
+		delete(doc, "data")
+	}
+	if len(stringData) > 0 {
+		doc["stringData"] = stringData
+	}
+	return nil
+}
+
+// normalizeSecret base64 encodes the values of a Secret's stringData in to data so the output
+// only uses data. stringData overrides data as it does in the API server.
+func normalizeSecret(doc map[interface{}]interface{}) {
+	if doc["kind"] != "Secret" {
+		return
+	}
+
+	stringData, ok := doc["stringData"].(map[interface{}]interface{})
+	if !ok {
+		return
+	}
+
+	data, ok := doc["data"].(map[interface{}]interface{})
+	if !ok {
+		data = make(map[interface{}]interface{})
+	}
+
+	for key, value := range stringData {
+		data[key] = b64encode(fmt.Sprint(value))
+	}
+
+	delete(doc, "stringData")
+	if len(data) > 0 {
+		doc["data"] = data
+	}
+}
@@ -0,0 +1,137 @@
+package kpatch
+
+import (
+	"fmt"
+	"sort"
+
+	yaml "gopkg.in/yaml.v2"
+)
+
+const (
+	sortInstall   = "install"
+	sortUninstall = "uninstall"
+	sortName      = "name"
+	sortNone      = "none"
+
+	// otherKinds marks where kinds not listed in a sort order go
+	otherKinds = "*"
+)
+
+// defaultSortOrder is Helm's InstallOrder. Kinds that aren't listed, including custom
+// resources, go after APIService and before the webhooks, which Helm installs last, so their
+// CRDs are installed first and webhooks that may intercept them last.
+var defaultSortOrder = []string{
+	"PriorityClass",
+	"Namespace",
+	"NetworkPolicy",
+	"ResourceQuota",
+	"LimitRange",
+	"PodSecurityPolicy",
+	"PodDisruptionBudget",
+	"ServiceAccount",
+	"Secret",
+	"SecretList",
+	"ConfigMap",
+	"StorageClass",
+	"PersistentVolume",
+	"PersistentVolumeClaim",
+	"CustomResourceDefinition",
+	"ClusterRole",
+	"ClusterRoleList",
+	"ClusterRoleBinding",
+	"ClusterRoleBindingList",
+	"Role",
+	"RoleList",
+	"RoleBinding",
+	"RoleBindingList",
+	"Service",
+	"DaemonSet",
+	"Pod",
+	"ReplicationController",
+	"ReplicaSet",
+	"Deployment",
+	"HorizontalPodAutoscaler",
+	"StatefulSet",
+	"Job",
+	"CronJob",
+	"IngressClass",
+	"Ingress",
+	"APIService",
+	otherKinds,
+	"MutatingWebhookConfiguration",
+	"ValidatingWebhookConfiguration",
+}
+
+// documentSorter reorders the output stream
+type documentSorter struct {
+	mode  string
+	ranks map[string]int
+	other int
+}
+
+// newDocumentSorter creates a sorter for mode. order is a YAML file or inline YAML list of kinds
+// to use instead of defaultSortOrder and may contain "*" to place unlisted kinds.
+func newDocumentSorter(mode string, order string) (*documentSorter, error) {
+	switch mode {
+	case sortInstall, sortUninstall, sortName, sortNone:
+	default:
+		return nil, fmt.Errorf("unknown sort '%s': expected %s, %s, %s or %s", mode, sortInstall, sortUninstall, sortName, sortNone)
+	}
+
+	kinds := defaultSortOrder
+	if order != "" {
+		orderBytes, err := getInputBytes(order)
+		if err != nil {
+			return nil, fmt.Errorf("error loading sort order '%s': %s", order, err)
+		}
+
+		kinds = nil
+		if err = yaml.UnmarshalStrict(orderBytes, &kinds); err != nil {
+			return nil, fmt.Errorf("error parsing sort order '%s': %s", order, err)
+		}
+	}
+
+	s := &documentSorter{mode: mode, ranks: make(map[string]int), other: len(kinds)}
+	for i, kind := range kinds {
+		if kind == otherKinds {
+			s.other = i
+			continue
+		}
+		s.ranks[kind] = i
+	}
+	return s, nil
+}
+
+func (s *documentSorter) rank(doc *document) int {
+	if rank, ok := s.ranks[docID(doc.data).kind]; ok {
+		return rank
+	}
+	return s.other
+}
+
+// sort orders docs in place. Documents that compare equal keep their input order.
+func (s *documentSorter) sort(docs []*document) {
+	var less func(a, b *document) bool
+
+	switch s.mode {
+	case sortInstall:
+		less = func(a, b *document) bool { return s.rank(a) < s.rank(b) }
+	case sortUninstall:
+		less = func(a, b *document) bool { return s.rank(a) > s.rank(b) }
+	case sortName:
+		less = func(a, b *document) bool {
+			idA, idB := docID(a.data), docID(b.data)
+			if idA.kind != idB.kind {
+				return idA.kind < idB.kind
+			}
+			if idA.namespace != idB.namespace {
+				return idA.namespace < idB.namespace
+			}
+			return idA.name < idB.name
+		}
+	default:
+		return
+	}
+
+	sort.SliceStable(docs, func(i, j int) bool { return less(docs[i], docs[j]) })
+}
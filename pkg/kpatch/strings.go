@@ -0,0 +1,255 @@
+package kpatch
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"regexp"
+	"strings"
+
+	"github.com/PaesslerAG/gval"
+	"github.com/ansel1/merry"
+)
+
+// dnsLabelLength is the maximum length of a DNS label and so of most resource names
+const dnsLabelLength = 63
+
+// stringLanguage contains the string functions available to selectors and actions
+func (s *kpatch) stringLanguage() gval.Language {
+	return gval.NewLanguage(
+		gval.Function("upper", s.fnUpper),
+		gval.Function("lower", s.fnLower),
+		gval.Function("trim", s.fnTrim),
+		gval.Function("replace", s.fnReplace),
+		gval.Function("regex_replace", s.fnRegexReplace),
+		gval.Function("regex_match", s.fnRegexMatch),
+		gval.Function("split", s.fnSplit),
+		gval.Function("join", s.fnJoin),
+		gval.Function("has_prefix", s.fnHasPrefix),
+		gval.Function("has_suffix", s.fnHasSuffix),
+		gval.Function("trunc", s.fnTrunc),
+		gval.Function("printf", s.fnPrintf),
+		gval.Function("sha256", s.fnSha256),
+	)
+}
+
+// stringArgs checks that exactly count arguments were given and that they are all strings
+func stringArgs(signature string, count int, args []interface{}) ([]string, error) {
+	if len(args) != count {
+		if count == 1 {
+			return nil, merry.Errorf("%s requires exactly one argument", signature)
+		}
+		return nil, merry.Errorf("%s requires exactly %d arguments", signature, count)
+	}
+
+	var out []string
+	for _, arg := range args {
+		str, ok := arg.(string)
+		if !ok {
+			return nil, merry.Errorf("%s expects arguments to be strings", signature)
+		}
+		out = append(out, str)
+	}
+	return out, nil
+}
+
+func (s *kpatch) fnUpper(args ...interface{}) (interface{}, error) {
+	str, err := stringArgs("upper(input)", 1, args)
+	if err != nil {
+		return nil, err
+	}
+	return strings.ToUpper(str[0]), nil
+}
+
+func (s *kpatch) fnLower(args ...interface{}) (interface{}, error) {
+	str, err := stringArgs("lower(input)", 1, args)
+	if err != nil {
+		return nil, err
+	}
+	return strings.ToLower(str[0]), nil
+}
+
+func (s *kpatch) fnTrim(args ...interface{}) (interface{}, error) {
+	str, err := stringArgs("trim(input)", 1, args)
+	if err != nil {
+		return nil, err
+	}
+	return strings.TrimSpace(str[0]), nil
+}
+
+func (s *kpatch) fnReplace(args ...interface{}) (interface{}, error) {
+	str, err := stringArgs("replace(input, old, new)", 3, args)
+	if err != nil {
+		return nil, err
+	}
+	return strings.Replace(str[0], str[1], str[2], -1), nil
+}
+
+func (s *kpatch) fnRegexReplace(args ...interface{}) (interface{}, error) {
+	str, err := stringArgs("regex_replace(input, pattern, replacement)", 3, args)
+	if err != nil {
+		return nil, err
+	}
+	re, err := regexp.Compile(str[1])
+	if err != nil {
+		return nil, merry.Errorf("regex_replace(input, pattern, replacement) invalid pattern: %s", err)
+	}
+	return re.ReplaceAllString(str[0], str[2]), nil
+}
+
+func (s *kpatch) fnRegexMatch(args ...interface{}) (interface{}, error) {
+	str, err := stringArgs("regex_match(input, pattern)", 2, args)
+	if err != nil {
+		return nil, err
+	}
+	re, err := regexp.Compile(str[1])
+	if err != nil {
+		return nil, merry.Errorf("regex_match(input, pattern) invalid pattern: %s", err)
+	}
+
+	matches := re.FindStringSubmatch(str[0])
+	if matches == nil {
+		return nil, nil
+	}
+
+	var out []interface{}
+	for _, m := range matches {
+		out = append(out, m)
+	}
+	return out, nil
+}
+
+func (s *kpatch) fnSplit(args ...interface{}) (interface{}, error) {
+	str, err := stringArgs("split(input, separator)", 2, args)
+	if err != nil {
+		return nil, err
+	}
+	var out []interface{}
+	for _, part := range strings.Split(str[0], str[1]) {
+		out = append(out, part)
+	}
+	return out, nil
+}
+
+func (s *kpatch) fnJoin(args ...interface{}) (interface{}, error) {
+	if len(args) != 2 {
+		return nil, merry.Errorf("join(list, separator) requires exactly 2 arguments")
+	}
+	list, ok := args[0].([]interface{})
+	if !ok {
+		return nil, merry.Errorf("join(list, separator) expects list to be a slice")
+	}
+	sep, ok := args[1].(string)
+	if !ok {
+		return nil, merry.Errorf("join(list, separator) expects separator to be a string")
+	}
+
+	var parts []string
+	for _, item := range list {
+		parts = append(parts, fmt.Sprintf("%v", item))
+	}
+	return strings.Join(parts, sep), nil
+}
+
+func (s *kpatch) fnHasPrefix(args ...interface{}) (interface{}, error) {
+	str, err := stringArgs("has_prefix(input, prefix)", 2, args)
+	if err != nil {
+		return nil, err
+	}
+	return strings.HasPrefix(str[0], str[1]), nil
+}
+
+func (s *kpatch) fnHasSuffix(args ...interface{}) (interface{}, error) {
+	str, err := stringArgs("has_suffix(input, suffix)", 2, args)
+	if err != nil {
+		return nil, err
+	}
+	return strings.HasSuffix(str[0], str[1]), nil
+}
+
+// fnTrunc truncates input to length characters (63 by default) and strips any trailing '-' or
+// '.' left behind so the result is still a valid DNS label
+func (s *kpatch) fnTrunc(args ...interface{}) (interface{}, error) {
+	if len(args) < 1 || len(args) > 2 {
+		return nil, merry.Errorf("trunc(input, [length]) takes 1 or 2 arguments")
+	}
+	input, ok := args[0].(string)
+	if !ok {
+		return nil, merry.Errorf("trunc(input, [length]) expects input to be a string")
+	}
+
+	length := dnsLabelLength
+	if len(args) > 1 {
+		l, ok := args[1].(float64)
+		if !ok || l < 1 {
+			return nil, merry.Errorf("trunc(input, [length]) expects length to be a positive number")
+		}
+		length = int(l)
+	}
+
+	runes := []rune(input)
+	if len(runes) <= length {
+		return input, nil
+	}
+	return strings.TrimRight(string(runes[:length]), "-."), nil
+}
+
+func (s *kpatch) fnPrintf(args ...interface{}) (interface{}, error) {
+	if len(args) < 1 {
+		return nil, merry.Errorf("printf(format, ...) requires a format argument")
+	}
+	format, ok := args[0].(string)
+	if !ok {
+		return nil, merry.Errorf("printf(format, ...) expects format to be a string")
+	}
+
+	// Numbers in expressions are always float64 which would make %d useless so whole numbers
+	// given to integer verbs (and * widths) are converted
+	verbs := formatVerbs(format)
+	var values []interface{}
+	for i, arg := range args[1:] {
+		if f, ok := arg.(float64); ok && f == float64(int64(f)) && i < len(verbs) && strings.ContainsRune("dxXobc*", verbs[i]) {
+			arg = int64(f)
+		}
+		values = append(values, arg)
+	}
+	return fmt.Sprintf(format, values...), nil
+}
+
+// formatVerbs returns the verb each argument of a fmt format is used by in order with '*' for
+// widths and precisions given as arguments. Formats with explicit argument indexes aren't
+// analysed and return what was found before the first index.
+func formatVerbs(format string) []rune {
+	var verbs []rune
+	for i := 0; i < len(format); i++ {
+		if format[i] != '%' {
+			continue
+		}
+		for i++; i < len(format) && strings.IndexByte("+-# 0123456789.*", format[i]) >= 0; i++ {
+			if format[i] == '*' {
+				verbs = append(verbs, '*')
+			}
+		}
+		if i == len(format) {
+			break
+		}
+
+		switch format[i] {
+		case '[':
+			return verbs
+		case '%':
+		default:
+			verbs = append(verbs, rune(format[i]))
+		}
+	}
+	return verbs
+}
+
+func (s *kpatch) fnSha256(args ...interface{}) (interface{}, error) {
+	str, err := stringArgs("sha256(input)", 1, args)
+	if err != nil {
+		return nil, err
+	}
+	sum := sha256.Sum256([]byte(str[0]))
+	return hex.EncodeToString(sum[:]), nil
+}
@@ -0,0 +1,267 @@
+package kpatch
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"reflect"
+	"strings"
+
+	"github.com/PaesslerAG/gval"
+)
+
+// tracer writes what the selector and actions did to each document
+type tracer struct {
+	w io.Writer
+	// reads are the variables read by the expression being evaluated
+	reads []traceRead
+	// open are the selector operands being evaluated, innermost last
+	open []*traceOperand
+}
+
+type traceRead struct {
+	path  string
+	value interface{}
+}
+
+func (t *tracer) printf(depth int, format string, args ...interface{}) {
+	fmt.Fprintf(t.w, strings.Repeat("  ", depth)+format+"\n", args...)
+}
+
+// read records a variable read while evaluating an expression
+func (t *tracer) read(keys []string, value interface{}) {
+	t.reads = append(t.reads, traceRead{path: strings.Join(keys, "."), value: value})
+}
+
+// document starts the trace of a document
+func (t *tracer) document(name string, doc map[interface{}]interface{}) {
+	t.reads = nil
+	t.printf(0, "%s %s", name, docID(doc))
+}
+
+// traceOperand is what evaluating a selector, or an operand of a && or || in it, did
+type traceOperand struct {
+	evaluated bool
+	value     string
+	reads     []traceRead
+	// logical is the && or || the operand is, if it's one
+	logical *traceLogical
+	// start is where the operand's reads start in tracer.reads
+	start int
+}
+
+// traceLogical is an evaluated && or ||
+type traceLogical struct {
+	op          string
+	left, right *traceOperand
+	// end is where its reads end in tracer.reads
+	end int
+}
+
+// operands returns the n operands of a chain of l's operator, e.g. a, b and c of a && b && c
+// which is evaluated as (a && b) && c, or nil if l isn't such a chain
+func (l *traceLogical) operands(n int) []*traceOperand {
+	if n < 2 {
+		return nil
+	}
+	if n == 2 {
+		return []*traceOperand{l.left, l.right}
+	}
+	if l.left.logical == nil || l.left.logical.op != l.op {
+		return nil
+	}
+	operands := l.left.logical.operands(n - 1)
+	if operands == nil {
+		return nil
+	}
+	return append(operands, l.right)
+}
+
+// operand records the value of eval and the variables it read in o
+func (t *tracer) operand(o *traceOperand, eval func() (interface{}, error)) (interface{}, error) {
+	o.start = len(t.reads)
+	t.open = append(t.open, o)
+	value, err := eval()
+	t.open = t.open[:len(t.open)-1]
+
+	// A && or || that read nothing before it and nothing after it is the whole operand. In
+	// others, e.g. x ? a && b : c, it's only part of it.
+	if o.logical != nil && o.logical.end != len(t.reads) {
+		o.logical = nil
+	}
+	o.evaluated = true
+	o.reads = append([]traceRead{}, t.reads[o.start:]...)
+	if err != nil {
+		o.value = fmt.Sprintf("error: %s", err)
+	} else {
+		o.value = formatValue(value)
+	}
+	return value, err
+}
+
+// logical replaces the && or || operator op with one that records the value of its operands in
+// the operand being evaluated. Operands that decide the result on their own short circuit like
+// gval's and gval's operator gives the result otherwise so the values are the same as untraced.
+func (t *tracer) logical(op string) gval.Language {
+	combine, err := gval.Full().NewEvaluable("a " + op + " b")
+	if err != nil {
+		panic(err)
+	}
+	shortCircuit := op == "||"
+
+	return gval.InfixEvalOperator(op, func(a, b gval.Evaluable) (gval.Evaluable, error) {
+		return func(c context.Context, v interface{}) (interface{}, error) {
+			l := &traceLogical{op: op, left: &traceOperand{}, right: &traceOperand{}}
+			if n := len(t.open); n > 0 && t.open[n-1].logical == nil && t.open[n-1].start == len(t.reads) {
+				t.open[n-1].logical = l
+			}
+			defer func() { l.end = len(t.reads) }()
+
+			left, err := t.operand(l.left, func() (interface{}, error) { return a(c, v) })
+			if err != nil {
+				return nil, err
+			}
+			if left == shortCircuit {
+				return shortCircuit, nil
+			}
+			right, err := t.operand(l.right, func() (interface{}, error) { return b(c, v) })
+			if err != nil {
+				return nil, err
+			}
+			return combine(c, map[string]interface{}{"a": left, "b": right})
+		}, nil
+	})
+}
+
+// selector evaluates the selector expr with lang, which must have the operators from logical,
+// and writes it and its value followed by the value of each part of it
+func (t *tracer) selector(lang gval.Language, expr string, doc map[interface{}]interface{}) (interface{}, error) {
+	t.reads = nil
+	o := &traceOperand{}
+	value, err := t.operand(o, func() (interface{}, error) { return lang.Evaluate(expr, doc) })
+	t.reads = nil
+
+	t.explain("selector ", expr, o, 1)
+	return value, err
+}
+
+// explain writes expr and its value from o followed by those of the operands of a top level &&
+// or || so it's clear which part of a selector didn't match. Other expressions are followed by
+// the variables they read.
+func (t *tracer) explain(label string, expr string, o *traceOperand, depth int) {
+	if !o.evaluated {
+		t.printf(depth, "%s%s => not evaluated", label, strings.TrimSpace(expr))
+		return
+	}
+	t.printf(depth, "%s%s => %s", label, strings.TrimSpace(expr), o.value)
+
+	// The text of the operands is only used to label them so the parts written are always those
+	// that were evaluated
+	if o.logical != nil {
+		parts := splitLogical(expr)
+		if operands := o.logical.operands(len(parts)); operands != nil {
+			for i, operand := range operands {
+				t.explain("", parts[i], operand, depth+1)
+			}
+			return
+		}
+	}
+	for _, r := range o.reads {
+		t.printf(depth+1, "%s: %s", r.path, formatValue(r.value))
+	}
+}
+
+// action writes an action and the variables it read once it has been evaluated
+func (t *tracer) action(expr string) {
+	t.printf(1, "action %s", strings.TrimSpace(expr))
+	for _, r := range t.reads {
+		t.printf(2, "%s: %s", r.path, formatValue(r.value))
+	}
+	t.reads = nil
+}
+
+// target writes a change an action made at keys
+func (t *tracer) target(keys []string, data reflect.Value, target tTarget) {
+	var old interface{}
+	if data.IsValid() {
+		old = data.Interface()
+	}
+
+	path := strings.Join(keys, ".")
+	if target.op == "unset" {
+		t.printf(2, "unset %s: %s", path, formatValue(old))
+		return
+	}
+	t.printf(2, "%s %s: %s -> %s", target.op, path, formatValue(old), formatValue(target.value))
+}
+
+// scanExpression calls fn with the index of each character of expr outside quotes and the
+// depth of brackets it's in, counting the bracket itself, until fn returns false
+func scanExpression(expr string, fn func(i int, depth int) bool) {
+	depth := 0
+	var quote byte
+	for i := 0; i < len(expr); i++ {
+		c := expr[i]
+		switch {
+		case quote != 0:
+			if c == '\\' && quote != '`' {
+				i++
+			} else if c == quote {
+				quote = 0
+			}
+			continue
+		case c == '"' || c == '\'' || c == '`':
+			quote = c
+			continue
+		case c == '(' || c == '[' || c == '{':
+			depth++
+		case c == ')' || c == ']' || c == '}':
+			depth--
+		}
+		if !fn(i, depth) {
+			return
+		}
+	}
+}
+
+// wrapped reports whether expr is entirely in one pair of parentheses
+func wrapped(expr string) bool {
+	if !strings.HasPrefix(expr, "(") || !strings.HasSuffix(expr, ")") {
+		return false
+	}
+
+	whole := true
+	scanExpression(expr, func(i int, depth int) bool {
+		if depth == 0 && i < len(expr)-1 {
+			whole = false
+		}
+		return whole
+	})
+	return whole
+}
+
+// splitLogical splits expr in to the operands of its top level || or, failing that, && (which
+// binds tighter). Parentheses around the whole expression are removed first. Expressions
+// without either are a single operand.
+func splitLogical(expr string) []string {
+	expr = strings.TrimSpace(expr)
+	for wrapped(expr) {
+		expr = strings.TrimSpace(expr[1 : len(expr)-1])
+	}
+
+	for _, op := range []string{"||", "&&"} {
+		var operands []string
+		start := 0
+		scanExpression(expr, func(i int, depth int) bool {
+			if depth == 0 && i >= start && strings.HasPrefix(expr[i:], op) {
+				operands = append(operands, expr[start:i])
+				start = i + len(op)
+			}
+			return true
+		})
+		if len(operands) > 0 {
+			return append(operands, expr[start:])
+		}
+	}
+	return []string{expr}
+}
@@ -0,0 +1,179 @@
+package kpatch
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+
+	"github.com/ansel1/merry"
+)
+
+// fieldSchema returns the schema of the field at keys in doc or nil if it isn't known
+func (s *schemaSet) fieldSchema(doc map[interface{}]interface{}, keys []string) *schema {
+	def := s.kinds[kindKey(doc["apiVersion"], doc["kind"])]
+	for _, key := range keys {
+		def = s.resolve(def)
+		if def == nil {
+			return nil
+		}
+
+		switch {
+		case def.Type == "array":
+			if _, err := strconv.Atoi(key); err != nil {
+				return nil
+			}
+			def = def.Items
+		case def.Properties[key] != nil:
+			def = def.Properties[key]
+		case def.AdditionalProperties != nil:
+			def = def.AdditionalProperties.schema
+		default:
+			return nil
+		}
+	}
+	return s.resolve(def)
+}
+
+// wholeNumber returns f as an int if it has no fractional part
+func wholeNumber(f float64) (int, bool) {
+	if f != math.Trunc(f) || math.Abs(f) > 1<<53 {
+		return 0, false
+	}
+	return int(f), true
+}
+
+// coerce converts value to the type def declares. Maps and lists are converted field by field in
+// to copies. Values that can't be converted exactly are an error rather than being changed.
+func (s *schemaSet) coerce(def *schema, value interface{}) (interface{}, error) {
+	def = s.resolve(def)
+	if def == nil || value == nil {
+		return value, nil
+	}
+
+	if def.IntOrString || def.Format == "int-or-string" || def.Format == "quantity" {
+		if f, ok := value.(float64); ok {
+			if i, ok := wholeNumber(f); ok {
+				return i, nil
+			}
+		}
+		return value, nil
+	}
+
+	switch def.Type {
+	case "object", "":
+		m, ok := value.(map[interface{}]interface{})
+		if literal, isLiteral := value.(map[string]interface{}); isLiteral {
+			// gval map literals have string keys
+			m, ok = make(map[interface{}]interface{}, len(literal)), true
+			for k, v := range literal {
+				m[k] = v
+			}
+		}
+		if !ok {
+			return value, nil
+		}
+
+		out := make(map[interface{}]interface{}, len(m))
+		for k, v := range m {
+			key := fmt.Sprint(k)
+			prop := def.Properties[key]
+			if prop == nil && def.AdditionalProperties != nil {
+				prop = def.AdditionalProperties.schema
+			}
+
+			var err error
+			if out[k], err = s.coerce(prop, v); err != nil {
+				return nil, fmt.Errorf("%s: %s", key, err)
+			}
+		}
+		return out, nil
+	case "array":
+		list, ok := value.([]interface{})
+		if !ok {
+			return value, nil
+		}
+
+		out := make([]interface{}, len(list))
+		for i, v := range list {
+			var err error
+			if out[i], err = s.coerce(def.Items, v); err != nil {
+				return nil, fmt.Errorf("[%d]: %s", i, err)
+			}
+		}
+		return out, nil
+	case "string":
+		switch v := value.(type) {
+		case string:
+			return v, nil
+		case bool:
+			return strconv.FormatBool(v), nil
+		case int, int64, uint64:
+			return fmt.Sprint(v), nil
+		case float64:
+			// 1.10 is parsed as 1.1 so only whole numbers are known to be what was written
+			if i, ok := wholeNumber(v); ok {
+				return strconv.Itoa(i), nil
+			}
+			return nil, fmt.Errorf("the field is a string and %v may not be the number written, quote it", v)
+		}
+	case "integer":
+		switch v := value.(type) {
+		case int, int64, uint64:
+			return v, nil
+		case float64:
+			if i, ok := wholeNumber(v); ok {
+				return i, nil
+			}
+			return nil, fmt.Errorf("%v is not an integer", v)
+		case string:
+			i, err := strconv.Atoi(strings.TrimSpace(v))
+			if err != nil {
+				return nil, fmt.Errorf("'%s' is not an integer", v)
+			}
+			return i, nil
+		}
+	case "number":
+		switch v := value.(type) {
+		case int, int64, uint64, float64:
+			return v, nil
+		case string:
+			f, err := strconv.ParseFloat(strings.TrimSpace(v), 64)
+			if err != nil {
+				return nil, fmt.Errorf("'%s' is not a number", v)
+			}
+			return f, nil
+		}
+	case "boolean":
+		switch v := value.(type) {
+		case bool:
+			return v, nil
+		case string:
+			switch strings.TrimSpace(v) {
+			case "true":
+				return true, nil
+			case "false":
+				return false, nil
+			}
+			return nil, fmt.Errorf("'%s' is not a boolean", v)
+		}
+	default:
+		return value, nil
+	}
+
+	return nil, fmt.Errorf("expected a %s but got %T", def.Type, value)
+}
+
+// typed converts val to the schema type of the field last selected for assignment. Fields
+// without a schema are left as they are.
+func (s *kpatch) typed(val interface{}) (interface{}, error) {
+	if s.schemas == nil || s.assignPath == nil {
+		return val, nil
+	}
+
+	out, err := s.schemas.coerce(s.schemas.fieldSchema(s.doc, s.assignPath), val)
+	if err != nil {
+		return nil, merry.Errorf("can't assign %v to %s in %s: %s", val, strings.Join(s.assignPath, "."), s.docName(), err)
+	}
+	return out, nil
+}
@@ -0,0 +1,279 @@
+package kpatch
+
+import (
+	"fmt"
+
+	"github.com/PaesslerAG/gval"
+	"github.com/ansel1/merry"
+	"github.com/imdario/mergo"
+	"github.com/mikesimons/traverser"
+)
+
+// upsertLanguage contains the functions for updating named entries in lists
+func (s *kpatch) upsertLanguage() gval.Language {
+	return gval.NewLanguage(
+		gval.Function("upsert", s.fnUpsert),
+		gval.Function("remove_where", s.fnRemoveWhere),
+		gval.Function("set_env", s.fnSetEnv),
+		gval.Function("set_image", s.fnSetImage),
+		gval.Function("add_volume_mount", s.fnAddVolumeMount),
+		gval.Function("add_volume", s.fnAddVolume),
+	)
+}
+
+// setPath sets the value at keys creating any missing parent maps
+func (s *kpatch) setPath(keys []string, val interface{}) error {
+	parent := s.doc
+	if len(keys) > 1 {
+		p, err := traverser.GetKey(&s.doc, keys[:len(keys)-1])
+		if err != nil || p == nil {
+			root := interface{}(s.doc)
+			return traverser.SetKey(&root, keys, val)
+		}
+
+		var ok bool
+		parent, ok = p.(map[interface{}]interface{})
+		if !ok {
+			return merry.Errorf("can not set '%s' on a non map value", keys[len(keys)-1])
+		}
+	}
+
+	parent[keys[len(keys)-1]] = val
+	return nil
+}
+
+// matches reports whether item is a map with item[key] equal to value
+func matches(item interface{}, key string, value interface{}) bool {
+	m, ok := item.(map[interface{}]interface{})
+	if !ok {
+		return false
+	}
+	return fmt.Sprintf("%v", m[key]) == fmt.Sprintf("%v", value)
+}
+
+// upsertList returns a copy of list with obj merged in to (or replacing, if merge is false)
+// every entry where entry[key] == value. obj is appended if there are no matching entries.
+func upsertList(list []interface{}, key string, value interface{}, obj map[interface{}]interface{}, merge bool) ([]interface{}, error) {
+	out := make([]interface{}, 0, len(list)+1)
+	found := false
+
+	for _, item := range list {
+		if !matches(item, key, value) {
+			out = append(out, item)
+			continue
+		}
+		found = true
+
+		if !merge {
+			out = append(out, obj)
+			continue
+		}
+
+		merged, err := deepCopy(item.(map[interface{}]interface{}))
+		if err != nil {
+			return nil, err
+		}
+		err = mergo.Map(&merged, obj, mergo.WithOverride)
+		if err != nil {
+			return nil, err
+		}
+		out = append(out, merged)
+	}
+
+	if !found {
+		if _, ok := obj[key]; !ok {
+			obj[key] = value
+		}
+		out = append(out, obj)
+	}
+
+	return out, nil
+}
+
+func (s *kpatch) fnUpsert(args ...interface{}) (interface{}, error) {
+	if len(args) != 4 {
+		return nil, merry.Errorf("upsert(list_path, match_key, match_value, obj) requires exactly 4 arguments")
+	}
+	keys, ok := pathArg(args[0])
+	if !ok {
+		return nil, merry.Errorf("upsert(list_path, match_key, match_value, obj) expects list_path to be a string or slice")
+	}
+	matchKey, ok := args[1].(string)
+	if !ok {
+		return nil, merry.Errorf("upsert(list_path, match_key, match_value, obj) expects match_key to be a string")
+	}
+	obj, ok := mapArg(args[3])
+	if !ok {
+		return nil, merry.Errorf("upsert(list_path, match_key, match_value, obj) expects obj to be a map")
+	}
+
+	val, _ := traverser.GetKey(&s.doc, keys)
+	list, ok := listArg(val)
+	if !ok {
+		return nil, merry.Errorf("upsert(list_path, match_key, match_value, obj) expects list_path to be a list")
+	}
+
+	out, err := upsertList(list, matchKey, args[2], obj, true)
+	if err != nil {
+		return nil, err
+	}
+	return nil, s.setPath(keys, out)
+}
+
+func (s *kpatch) fnRemoveWhere(args ...interface{}) (interface{}, error) {
+	if len(args) != 2 {
+		return nil, merry.Errorf("remove_where(list_path, pred) requires exactly 2 arguments")
+	}
+	keys, ok := pathArg(args[0])
+	if !ok {
+		return nil, merry.Errorf("remove_where(list_path, pred) expects list_path to be a string or slice")
+	}
+
+	val, err := traverser.GetKey(&s.doc, keys)
+	if err != nil || val == nil {
+		return nil, nil
+	}
+
+	list, eval, err := s.lambdaArgs("remove_where(list_path, pred)", []interface{}{val, args[1]})
+	if err != nil {
+		return nil, err
+	}
+
+	out := make([]interface{}, 0, len(list))
+	for _, item := range list {
+		remove, err := eval(item)
+		if err != nil {
+			return nil, err
+		}
+		if remove != true {
+			out = append(out, item)
+		}
+	}
+
+	return nil, s.setPath(keys, out)
+}
+
+// containerArgs returns the containers named by the first argument of a container function
+func (s *kpatch) containerArgs(signature string, count int, args []interface{}) ([]map[interface{}]interface{}, error) {
+	if len(args) != count {
+		return nil, merry.Errorf("%s requires exactly %d arguments", signature, count)
+	}
+	name, ok := args[0].(string)
+	if !ok {
+		return nil, merry.Errorf("%s expects container to be a string", signature)
+	}
+
+	spec := podSpec(s.doc)
+	if spec == nil {
+		return nil, nil
+	}
+	return containers(spec, name), nil
+}
+
+// upsertIn upserts obj in to the list at m[listKey] replacing entries with the same name
+func (s *kpatch) upsertIn(m map[interface{}]interface{}, listKey string, obj map[interface{}]interface{}) error {
+	list, ok := listArg(m[listKey])
+	if !ok {
+		return merry.Errorf("expected '%s' to be a list", listKey)
+	}
+
+	out, err := upsertList(list, "name", obj["name"], obj, false)
+	if err != nil {
+		return err
+	}
+
+	m[listKey] = out
+	return nil
+}
+
+func (s *kpatch) fnSetEnv(args ...interface{}) (interface{}, error) {
+	found, err := s.containerArgs("set_env(container, name, value)", 3, args)
+	if err != nil {
+		return nil, err
+	}
+
+	name, ok := args[1].(string)
+	if !ok {
+		return nil, merry.Errorf("set_env(container, name, value) expects name to be a string")
+	}
+
+	for _, c := range found {
+		env := map[interface{}]interface{}{"name": name, "value": fmt.Sprintf("%v", args[2])}
+		if err := s.upsertIn(c, "env", env); err != nil {
+			return nil, err
+		}
+	}
+	return nil, nil
+}
+
+func (s *kpatch) fnSetImage(args ...interface{}) (interface{}, error) {
+	found, err := s.containerArgs("set_image(container, image)", 2, args)
+	if err != nil {
+		return nil, err
+	}
+
+	image, ok := args[1].(string)
+	if !ok {
+		return nil, merry.Errorf("set_image(container, image) expects image to be a string")
+	}
+
+	for _, c := range found {
+		c["image"] = image
+	}
+	return nil, nil
+}
+
+func (s *kpatch) fnAddVolumeMount(args ...interface{}) (interface{}, error) {
+	if len(args) < 3 || len(args) > 4 {
+		return nil, merry.Errorf("add_volume_mount(container, name, mount_path, [read_only]) takes 3 or 4 arguments")
+	}
+	found, err := s.containerArgs("add_volume_mount(container, name, mount_path, [read_only])", len(args), args)
+	if err != nil {
+		return nil, err
+	}
+
+	name, ok := args[1].(string)
+	if !ok {
+		return nil, merry.Errorf("add_volume_mount(container, name, mount_path, [read_only]) expects name to be a string")
+	}
+	mountPath, ok := args[2].(string)
+	if !ok {
+		return nil, merry.Errorf("add_volume_mount(container, name, mount_path, [read_only]) expects mount_path to be a string")
+	}
+
+	if len(args) == 4 {
+		if _, ok := args[3].(bool); !ok {
+			return nil, merry.Errorf("add_volume_mount(container, name, mount_path, [read_only]) expects read_only to be a bool")
+		}
+	}
+
+	for _, c := range found {
+		mount := map[interface{}]interface{}{"name": name, "mountPath": mountPath}
+		if len(args) == 4 {
+			mount["readOnly"] = args[3]
+		}
+		if err := s.upsertIn(c, "volumeMounts", mount); err != nil {
+			return nil, err
+		}
+	}
+	return nil, nil
+}
+
+func (s *kpatch) fnAddVolume(args ...interface{}) (interface{}, error) {
+	if len(args) != 1 {
+		return nil, merry.Errorf("add_volume(volume) requires exactly one argument")
+	}
+	volume, ok := mapArg(args[0])
+	if !ok {
+		return nil, merry.Errorf("add_volume(volume) expects volume to be a map")
+	}
+	if _, ok := volume["name"].(string); !ok {
+		return nil, merry.Errorf("add_volume(volume) expects volume to have a name")
+	}
+
+	spec := podSpec(s.doc)
+	if spec == nil {
+		return nil, nil
+	}
+	return nil, s.upsertIn(spec, "volumes", volume)
+}
@@ -3,6 +3,7 @@ package kpatch
 import (
 	"bytes"
 	"encoding/gob"
+	"fmt"
 	"io"
 	"os"
 
@@ -11,6 +12,16 @@ import (
 
 var Fs = afero.NewOsFs()
 
+// Stdin is read for the input "-"
+var Stdin io.Reader = os.Stdin
+
+// Stderr receives warnings about documents that were processed but may not be what was intended
+var Stderr io.Writer = os.Stderr
+
+func warnf(w io.Writer, format string, args ...interface{}) {
+	fmt.Fprintf(w, "warning: "+format+"\n", args...)
+}
+
 func init() {
 	gob.Register(map[interface{}]interface{}{})
 	gob.Register([]interface{}{})
@@ -35,6 +46,11 @@ func deepCopy(m map[interface{}]interface{}) (map[interface{}]interface{}, error
 }
 
 func inputReaderFn(inputs []string) func() (io.Reader, error) {
+	return stdinReaderFn(inputs, Stdin)
+}
+
+// stdinReaderFn is inputReaderFn reading stdin for the input "-"
+func stdinReaderFn(inputs []string, stdin io.Reader) func() (io.Reader, error) {
 	current := 0
 	return func() (io.Reader, error) {
 		if current >= len(inputs) {
@@ -45,7 +61,7 @@ func inputReaderFn(inputs []string) func() (io.Reader, error) {
 		current++
 
 		if input == "-" {
-			return io.Reader(os.Stdin), nil
+			return stdin, nil
 		}
 
 		_, err := Fs.Stat(input)
@@ -56,3 +72,15 @@ func inputReaderFn(inputs []string) func() (io.Reader, error) {
 		return Fs.Open(input)
 	}
 }
+
+// appendInput returns a reader function that reads extra once next is exhausted
+func appendInput(next func() (io.Reader, error), extra io.Reader) func() (io.Reader, error) {
+	return func() (io.Reader, error) {
+		input, err := next()
+		if input != nil || err != nil || extra == nil {
+			return input, err
+		}
+		input, extra = extra, nil
+		return input, nil
+	}
+}
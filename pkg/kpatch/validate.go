@@ -0,0 +1,422 @@
+package kpatch
+
+import (
+	"bytes"
+	"compress/gzip"
+	"embed"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"path"
+	"sort"
+	"strings"
+
+	yaml "gopkg.in/yaml.v2"
+)
+
+// bundledSchemas are Kubernetes OpenAPI schemas stripped by hack/openapi-schema.go
+//
+//go:embed schemas/*.json.gz
+var bundledSchemas embed.FS
+
+const objectMetaRef = "#/definitions/io.k8s.apimachinery.pkg.apis.meta.v1.ObjectMeta"
+
+// schema is the subset of OpenAPI used by Kubernetes and CRD schemas needed for validation
+type schema struct {
+	Type                 string             `json:"type"`
+	Format               string             `json:"format"`
+	Properties           map[string]*schema `json:"properties"`
+	AdditionalProperties *additional        `json:"additionalProperties"`
+	Items                *schema            `json:"items"`
+	Required             []string           `json:"required"`
+	Enum                 []interface{}      `json:"enum"`
+	AllOf                []*schema          `json:"allOf"`
+	Ref                  string             `json:"$ref"`
+	IntOrString          bool               `json:"x-kubernetes-int-or-string"`
+	PreserveUnknown      bool               `json:"x-kubernetes-preserve-unknown-fields"`
+	GroupVersionKinds    []struct {
+		Group   string `json:"group"`
+		Version string `json:"version"`
+		Kind    string `json:"kind"`
+	} `json:"x-kubernetes-group-version-kind"`
+}
+
+// additional is additionalProperties which may be a schema or a boolean
+type additional struct {
+	allowed bool
+	schema  *schema
+}
+
+func (a *additional) UnmarshalJSON(b []byte) error {
+	if err := json.Unmarshal(b, &a.allowed); err == nil {
+		return nil
+	}
+	a.allowed = true
+	return json.Unmarshal(b, &a.schema)
+}
+
+func apiVersion(group string, version string) string {
+	if group == "" {
+		return version
+	}
+	return group + "/" + version
+}
+
+// schemaSet holds the schema of every known apiVersion and kind
+type schemaSet struct {
+	definitions map[string]*schema
+	kinds       map[string]*schema
+}
+
+func kindKey(apiVersion interface{}, kind interface{}) string {
+	return fmt.Sprintf("%v %v", apiVersion, kind)
+}
+
+// bundledVersions returns the Kubernetes versions with a bundled schema
+func bundledVersions() []string {
+	var versions []string
+	entries, _ := bundledSchemas.ReadDir("schemas")
+	for _, entry := range entries {
+		name := strings.TrimSuffix(strings.TrimPrefix(entry.Name(), "kubernetes-"), ".json.gz")
+		versions = append(versions, name)
+	}
+	sort.Strings(versions)
+	return versions
+}
+
+// newSchemaSet loads the bundled schema for version (the newest bundled if empty) and then
+// every file in schemaFiles. A file may be a Kubernetes OpenAPI v2 document which replaces the
+// bundled schema or YAML containing CustomResourceDefinitions.
+func newSchemaSet(version string, schemaFiles []string) (*schemaSet, error) {
+	s := &schemaSet{definitions: make(map[string]*schema), kinds: make(map[string]*schema)}
+
+	var crds []map[interface{}]interface{}
+	var openAPI []byte
+	for _, file := range schemaFiles {
+		content, err := getInputBytes(file)
+		if err != nil {
+			return nil, fmt.Errorf("error loading schema '%s': %s", file, err)
+		}
+
+		if strings.HasPrefix(strings.TrimSpace(string(content)), "{") {
+			openAPI = content
+			continue
+		}
+
+		decoder := yaml.NewDecoder(bytes.NewReader(content))
+		for {
+			doc := make(map[interface{}]interface{})
+			if err := decoder.Decode(&doc); err != nil {
+				break
+			}
+			crds = append(crds, doc)
+		}
+	}
+
+	if openAPI == nil {
+		versions := bundledVersions()
+		if version == "" {
+			version = versions[len(versions)-1]
+		}
+		v, err := parseKubeVersion(version)
+		if err != nil {
+			return nil, err
+		}
+
+		f, err := bundledSchemas.Open(path.Join("schemas", fmt.Sprintf("kubernetes-%s.json.gz", v)))
+		if err != nil {
+			return nil, fmt.Errorf("no bundled schema for Kubernetes %s (only %s bundled), pass the OpenAPI schema of a %s cluster with --schema", v, strings.Join(versions, ", "), v)
+		}
+		defer f.Close()
+
+		r, err := gzip.NewReader(f)
+		if err != nil {
+			return nil, err
+		}
+		if openAPI, err = ioutil.ReadAll(r); err != nil {
+			return nil, err
+		}
+	}
+
+	var doc struct {
+		Definitions map[string]*schema `json:"definitions"`
+	}
+	if err := json.Unmarshal(openAPI, &doc); err != nil {
+		return nil, fmt.Errorf("error parsing OpenAPI schema: %s", err)
+	}
+
+	s.definitions = doc.Definitions
+	for _, def := range s.definitions {
+		for _, gvk := range def.GroupVersionKinds {
+			s.kinds[kindKey(apiVersion(gvk.Group, gvk.Version), gvk.Kind)] = def
+		}
+	}
+
+	for _, crd := range crds {
+		if err := s.addCRD(crd); err != nil {
+			return nil, err
+		}
+	}
+	return s, nil
+}
+
+// loadSchemas is newSchemaSet for opts. Unless the schemas validate, only field types are needed
+// and they rarely change between versions so the latest bundled schema is used, with a warning,
+// when there is no schema for opts.KubeVersion.
+func loadSchemas(opts Options, warnings io.Writer) (*schemaSet, error) {
+	schemas, err := newSchemaSet(opts.KubeVersion, opts.Schemas)
+	if err != nil && !opts.Validate && len(opts.Schemas) == 0 {
+		versions := bundledVersions()
+		warnf(warnings, "%s; using the field types of Kubernetes %s", err, versions[len(versions)-1])
+		schemas, err = newSchemaSet("", nil)
+	}
+	return schemas, err
+}
+
+// toJSONValue converts YAML maps in v to maps with string keys so they can be marshalled as JSON
+func toJSONValue(v interface{}) interface{} {
+	switch v := v.(type) {
+	case map[interface{}]interface{}:
+		out := make(map[string]interface{})
+		for key, value := range v {
+			out[fmt.Sprint(key)] = toJSONValue(value)
+		}
+		return out
+	case []interface{}:
+		out := make([]interface{}, len(v))
+		for i, value := range v {
+			out[i] = toJSONValue(value)
+		}
+		return out
+	}
+	return v
+}
+
+func parseCRDSchema(v interface{}) (*schema, error) {
+	b, err := json.Marshal(toJSONValue(v))
+	if err != nil {
+		return nil, err
+	}
+
+	var s schema
+	err = json.Unmarshal(b, &s)
+	return &s, err
+}
+
+// addCRD adds the schema of every version of a CustomResourceDefinition. Other documents are ignored.
+func (s *schemaSet) addCRD(crd map[interface{}]interface{}) error {
+	if crd["kind"] != "CustomResourceDefinition" {
+		return nil
+	}
+
+	group, _ := mapAt(crd, "spec")["group"].(string)
+	kind, _ := mapAt(crd, "spec", "names")["kind"].(string)
+	// v1beta1 CRDs may have one schema for every version
+	shared := mapAt(crd, "spec", "validation")["openAPIV3Schema"]
+
+	versions := listAt(crd, "spec", "versions")
+	if version, ok := mapAt(crd, "spec")["version"].(string); ok && len(versions) == 0 {
+		versions = []interface{}{map[interface{}]interface{}{"name": version}}
+	}
+
+	for _, item := range versions {
+		version, _ := item.(map[interface{}]interface{})
+		raw := mapAt(version, "schema")["openAPIV3Schema"]
+		if raw == nil {
+			raw = shared
+		}
+
+		def := &schema{Type: "object", PreserveUnknown: true}
+		if raw != nil {
+			var err error
+			if def, err = parseCRDSchema(raw); err != nil {
+				return fmt.Errorf("error parsing schema of %s: %s", docID(crd), err)
+			}
+		}
+
+		if def.Properties == nil {
+			def.Properties = make(map[string]*schema)
+		}
+		for _, key := range []string{"apiVersion", "kind"} {
+			if def.Properties[key] == nil {
+				def.Properties[key] = &schema{Type: "string"}
+			}
+		}
+		if _, ok := s.definitions[strings.TrimPrefix(objectMetaRef, "#/definitions/")]; ok {
+			def.Properties["metadata"] = &schema{Ref: objectMetaRef}
+		}
+
+		s.kinds[kindKey(apiVersion(group, fmt.Sprint(version["name"])), kind)] = def
+	}
+	return nil
+}
+
+func (s *schemaSet) resolve(def *schema) *schema {
+	for def != nil && def.Ref != "" {
+		def = s.definitions[strings.TrimPrefix(def.Ref, "#/definitions/")]
+	}
+	return def
+}
+
+// joinPath appends key to a dotted path. Keys that contain dots, e.g. annotations named after a
+// domain, are written as ["key"] so the path can be read back.
+func joinPath(parent string, key string) string {
+	if strings.ContainsAny(key, ".[]") {
+		return fmt.Sprintf("%s[%q]", parent, key)
+	}
+	if parent == "" {
+		return key
+	}
+	return parent + "." + key
+}
+
+func isInt(value interface{}) bool {
+	switch value.(type) {
+	case int, int64, uint64:
+		return true
+	}
+	return false
+}
+
+func isNumber(value interface{}) bool {
+	_, ok := value.(float64)
+	return ok || isInt(value)
+}
+
+// check appends an error for every part of value at path that doesn't match def
+func (s *schemaSet) check(def *schema, value interface{}, path string, errs *[]string) {
+	def = s.resolve(def)
+	if def == nil || value == nil {
+		return
+	}
+
+	for _, sub := range def.AllOf {
+		s.check(sub, value, path, errs)
+	}
+
+	fail := func(format string, args ...interface{}) {
+		*errs = append(*errs, fmt.Sprintf("%s: %s", path, fmt.Sprintf(format, args...)))
+	}
+
+	if len(def.Enum) > 0 {
+		found := false
+		for _, allowed := range def.Enum {
+			if fmt.Sprint(allowed) == fmt.Sprint(value) {
+				found = true
+			}
+		}
+		if !found {
+			fail("value '%v' is not one of %v", value, def.Enum)
+			return
+		}
+	}
+
+	if def.IntOrString || def.Format == "int-or-string" || def.Format == "quantity" {
+		if _, ok := value.(string); !ok && !isNumber(value) {
+			fail("expected a string or number but got %T", value)
+		}
+		return
+	}
+
+	typ := def.Type
+	if typ == "" && def.Properties != nil {
+		typ = "object"
+	}
+
+	switch typ {
+	case "object":
+		m, ok := value.(map[interface{}]interface{})
+		if !ok {
+			fail("expected an object but got %T", value)
+			return
+		}
+
+		for _, key := range def.Required {
+			if _, ok := m[key]; !ok {
+				*errs = append(*errs, fmt.Sprintf("%s: required field is missing", joinPath(path, key)))
+			}
+		}
+
+		keys := sortedKeys(m)
+		for _, k := range keys {
+			key := fmt.Sprint(k)
+			if prop, ok := def.Properties[key]; ok {
+				s.check(prop, m[k], joinPath(path, key), errs)
+				continue
+			}
+
+			switch {
+			case def.AdditionalProperties != nil && def.AdditionalProperties.schema != nil:
+				s.check(def.AdditionalProperties.schema, m[k], joinPath(path, key), errs)
+			case def.AdditionalProperties != nil && def.AdditionalProperties.allowed:
+			case def.PreserveUnknown || def.Properties == nil:
+			default:
+				*errs = append(*errs, fmt.Sprintf("%s: unknown field", joinPath(path, key)))
+			}
+		}
+	case "array":
+		list, ok := value.([]interface{})
+		if !ok {
+			fail("expected a list but got %T", value)
+			return
+		}
+		for i, item := range list {
+			s.check(def.Items, item, fmt.Sprintf("%s[%d]", path, i), errs)
+		}
+	case "string":
+		if _, ok := value.(string); !ok {
+			fail("expected a string but got %T", value)
+		}
+	case "integer":
+		if !isInt(value) {
+			fail("expected an integer but got %T", value)
+		}
+	case "number":
+		if !isNumber(value) {
+			fail("expected a number but got %T", value)
+		}
+	case "boolean":
+		if _, ok := value.(bool); !ok {
+			fail("expected a boolean but got %T", value)
+		}
+	}
+}
+
+// validate returns the errors found in doc. ok is false when there is no schema for it.
+func (s *schemaSet) validate(doc map[interface{}]interface{}) (errs []string, ok bool) {
+	def, ok := s.kinds[kindKey(doc["apiVersion"], doc["kind"])]
+	if !ok {
+		return nil, false
+	}
+
+	s.check(def, doc, "", &errs)
+	return errs, true
+}
+
+// validateDocuments validates docs adding the schemas of any CRDs among them first. Documents
+// without a schema are reported to warnings.
+func (s *schemaSet) validateDocuments(docs []*document, warnings io.Writer) error {
+	for _, doc := range docs {
+		if err := s.addCRD(doc.data); err != nil {
+			return err
+		}
+	}
+
+	var errs []string
+	for _, doc := range docs {
+		docErrs, ok := s.validate(doc.data)
+		if !ok {
+			warnf(warnings, "%s: no schema for %v %v, not validated", doc, doc.data["apiVersion"], doc.data["kind"])
+			continue
+		}
+		for _, err := range docErrs {
+			errs = append(errs, fmt.Sprintf("%s (%s): %s", docID(doc.data), doc, err))
+		}
+	}
+
+	if len(errs) > 0 {
+		return fmt.Errorf("validation failed:\n  %s", strings.Join(errs, "\n  "))
+	}
+	return nil
+}
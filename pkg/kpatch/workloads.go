@@ -0,0 +1,56 @@
+package kpatch
+
+import (
+	"github.com/mikesimons/traverser"
+)
+
+// workloadKinds are the kinds that contain a pod spec
+var workloadKinds = []string{"Pod", "Deployment", "StatefulSet", "DaemonSet", "ReplicaSet", "ReplicationController", "Job", "CronJob"}
+
+// podSpecKeys returns the path to the pod spec for workload kinds or nil for anything else
+func podSpecKeys(kind interface{}) []string {
+	switch kind {
+	case "Pod":
+		return []string{"spec"}
+	case "CronJob":
+		return []string{"spec", "jobTemplate", "spec", "template", "spec"}
+	case "Deployment", "StatefulSet", "DaemonSet", "ReplicaSet", "ReplicationController", "Job":
+		return []string{"spec", "template", "spec"}
+	}
+	return nil
+}
+
+// podSpec returns the pod spec of a workload document or nil if it does not have one
+func podSpec(doc map[interface{}]interface{}) map[interface{}]interface{} {
+	keys := podSpecKeys(doc["kind"])
+	if keys == nil {
+		return nil
+	}
+
+	spec, err := traverser.GetKey(&doc, keys)
+	if err != nil {
+		return nil
+	}
+
+	m, _ := spec.(map[interface{}]interface{})
+	return m
+}
+
+// containerLists are the pod spec keys that hold containers
+var containerLists = []string{"containers", "initContainers", "ephemeralContainers"}
+
+// containers returns every container in a pod spec with the given name.
+// An empty name returns all containers.
+func containers(spec map[interface{}]interface{}, name string) []map[interface{}]interface{} {
+	var out []map[interface{}]interface{}
+	for _, key := range containerLists {
+		list, _ := spec[key].([]interface{})
+		for _, item := range list {
+			c, ok := item.(map[interface{}]interface{})
+			if ok && (name == "" || c["name"] == name) {
+				out = append(out, c)
+			}
+		}
+	}
+	return out
+}